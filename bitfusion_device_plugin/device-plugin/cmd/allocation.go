@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// allocationPolicy decides which devices GetPreferredAllocation prefers
+type allocationPolicy string
+
+const (
+	// policyNone doesn't advertise GetPreferredAllocation
+	policyNone allocationPolicy = ""
+	// policyPack prefers devices on as few Bitfusion servers and GPUs as possible
+	policyPack allocationPolicy = "pack"
+	// policySpread prefers devices evenly spread over the Bitfusion servers
+	policySpread allocationPolicy = "spread"
+)
+
+// parseAllocationPolicy validates an allocation policy name
+func parseAllocationPolicy(name string) (allocationPolicy, error) {
+	switch policy := allocationPolicy(name); policy {
+	case policyNone, policyPack, policySpread:
+		return policy, nil
+	}
+	return policyNone, fmt.Errorf("unknown allocation policy %q, expect %q or %q ", name, policyPack, policySpread)
+}
+
+// gpuDevices is the available devices of one Bitfusion GPU
+type gpuDevices struct {
+	gpu    int
+	ids    []string
+	pinned bool
+}
+
+// serverDevices is the available devices of one Bitfusion server grouped by GPU
+type serverDevices struct {
+	server string
+	gpus   []*gpuDevices
+	pinned bool
+}
+
+func (s *serverDevices) count() int {
+	count := 0
+	for _, gpu := range s.gpus {
+		count += len(gpu.ids)
+	}
+	return count
+}
+
+// groupDevices groups the available devices by server and GPU, the groups holding must devices are pinned
+func groupDevices(slots map[string]deviceSlot, available []string, must map[string]bool) []*serverDevices {
+	var servers []*serverDevices
+	byServer := make(map[string]*serverDevices)
+	byGPU := make(map[deviceSlot]*gpuDevices)
+	for _, id := range available {
+		slot, ok := slots[id]
+		if !ok {
+			slot = deviceSlot{GPU: -1}
+		}
+		server, ok := byServer[slot.Server]
+		if !ok {
+			server = &serverDevices{server: slot.Server}
+			byServer[slot.Server] = server
+			servers = append(servers, server)
+		}
+		gpu, ok := byGPU[slot]
+		if !ok {
+			gpu = &gpuDevices{gpu: slot.GPU}
+			byGPU[slot] = gpu
+			server.gpus = append(server.gpus, gpu)
+		}
+		if must[id] {
+			server.pinned = true
+			gpu.pinned = true
+			continue
+		}
+		gpu.ids = append(gpu.ids, id)
+	}
+	return servers
+}
+
+// preferredDevices picks size devices out of available by policy, must devices are always included
+func preferredDevices(policy allocationPolicy, slots map[string]deviceSlot, available, must []string, size int) []string {
+	chosen := append([]string{}, must...)
+	mustSet := make(map[string]bool)
+	for _, id := range must {
+		mustSet[id] = true
+	}
+	servers := groupDevices(slots, available, mustSet)
+
+	switch policy {
+	case policyPack:
+		// Pinned first, then the largest groups, so the devices share as few hosts as possible
+		sort.SliceStable(servers, func(i, j int) bool {
+			if servers[i].pinned != servers[j].pinned {
+				return servers[i].pinned
+			}
+			return servers[i].count() > servers[j].count()
+		})
+		for _, server := range servers {
+			gpus := server.gpus
+			sort.SliceStable(gpus, func(i, j int) bool {
+				if gpus[i].pinned != gpus[j].pinned {
+					return gpus[i].pinned
+				}
+				return len(gpus[i].ids) > len(gpus[j].ids)
+			})
+			for _, gpu := range gpus {
+				for _, id := range gpu.ids {
+					if len(chosen) >= size {
+						return chosen
+					}
+					chosen = append(chosen, id)
+				}
+			}
+		}
+	case policySpread:
+		// Take one device at a time from the server and GPU with the most devices left
+		for len(chosen) < size {
+			var server *serverDevices
+			for _, s := range servers {
+				if s.count() > 0 && (server == nil || s.count() > server.count()) {
+					server = s
+				}
+			}
+			if server == nil {
+				break
+			}
+			var gpu *gpuDevices
+			for _, g := range server.gpus {
+				if len(g.ids) > 0 && (gpu == nil || len(g.ids) > len(gpu.ids)) {
+					gpu = g
+				}
+			}
+			chosen = append(chosen, gpu.ids[0])
+			gpu.ids = gpu.ids[1:]
+		}
+	}
+	return chosen
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// testPool is a synthetic device set, server -> shares of each GPU.
+// Device IDs are <server><gpu>-<n>, e.g. a1-0 is the first share of GPU 1 on server a
+func testPool(pool map[string][]int) (map[string]deviceSlot, []string) {
+	slots := make(map[string]deviceSlot)
+	var available []string
+	for _, server := range []string{"a", "b", "c"} {
+		for gpu, shares := range pool[server] {
+			for n := 0; n < shares; n++ {
+				id := fmt.Sprintf("%s%d-%d", server, gpu, n)
+				slots[id] = deviceSlot{Server: server, GPU: gpu}
+				available = append(available, id)
+			}
+		}
+	}
+	return slots, available
+}
+
+func TestParseAllocationPolicy(t *testing.T) {
+	for _, name := range []string{"", "pack", "spread"} {
+		policy, err := parseAllocationPolicy(name)
+		assert.Nil(t, err)
+		assert.Equal(t, allocationPolicy(name), policy)
+	}
+	_, err := parseAllocationPolicy("random")
+	assert.NotNil(t, err)
+}
+
+func TestPreferredDevices(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy allocationPolicy
+		pool   map[string][]int
+		must   []string
+		size   int
+		want   []string
+	}{
+		{
+			name:   "none keeps must devices only",
+			policy: policyNone,
+			pool:   map[string][]int{"a": {2}},
+			must:   []string{"a0-1"},
+			size:   2,
+			want:   []string{"a0-1"},
+		},
+		{
+			name:   "pack on the largest server",
+			policy: policyPack,
+			pool:   map[string][]int{"a": {2}, "b": {2, 3}},
+			size:   4,
+			want:   []string{"b1-0", "b1-1", "b1-2", "b0-0"},
+		},
+		{
+			name:   "pack fills one GPU before the next",
+			policy: policyPack,
+			pool:   map[string][]int{"a": {2, 2}},
+			size:   3,
+			want:   []string{"a0-0", "a0-1", "a1-0"},
+		},
+		{
+			name:   "pack next to must devices",
+			policy: policyPack,
+			pool:   map[string][]int{"a": {3}, "b": {1, 5}},
+			must:   []string{"a0-0"},
+			size:   3,
+			want:   []string{"a0-0", "a0-1", "a0-2"},
+		},
+		{
+			name:   "pack overflows to the next server",
+			policy: policyPack,
+			pool:   map[string][]int{"a": {1}, "b": {2}},
+			size:   3,
+			want:   []string{"b0-0", "b0-1", "a0-0"},
+		},
+		{
+			name:   "spread over servers",
+			policy: policySpread,
+			pool:   map[string][]int{"a": {2}, "b": {2}, "c": {2}},
+			size:   3,
+			want:   []string{"a0-0", "b0-0", "c0-0"},
+		},
+		{
+			name:   "spread from the server with most devices left",
+			policy: policySpread,
+			pool:   map[string][]int{"a": {1}, "b": {2, 2}},
+			size:   4,
+			want:   []string{"b0-0", "b1-0", "b0-1", "a0-0"},
+		},
+		{
+			name:   "spread with must devices",
+			policy: policySpread,
+			pool:   map[string][]int{"a": {2}, "b": {2}},
+			must:   []string{"a0-0"},
+			size:   2,
+			want:   []string{"a0-0", "b0-0"},
+		},
+		{
+			name:   "not enough devices",
+			policy: policySpread,
+			pool:   map[string][]int{"a": {1}},
+			size:   2,
+			want:   []string{"a0-0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slots, available := testPool(tt.pool)
+			got := preferredDevices(tt.policy, slots, available, tt.must, tt.size)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGetPreferredAllocation(t *testing.T) {
+	bfs, _ := NewbfsManager(staticCapacity{nums: 10}, alwaysHealthy{}, time.Second)
+	options, _ := bfs.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	assert.False(t, options.GetPreferredAllocationAvailable)
+
+	bfs.policy = policyPack
+	bfs.slots, _ = testPool(map[string][]int{"a": {2}, "b": {3}})
+	options, _ = bfs.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	assert.True(t, options.GetPreferredAllocationAvailable)
+
+	resp, err := bfs.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs: []string{"a0-0", "a0-1", "b0-0", "b0-1", "b0-2"},
+			AllocationSize:     2,
+		}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b0-0", "b0-1"}, resp.ContainerResponses[0].DeviceIDs)
+}
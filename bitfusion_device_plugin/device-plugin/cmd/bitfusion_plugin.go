@@ -7,57 +7,243 @@
 package main
 
 import (
-	"strconv"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 // Bitfusion Manager
 type bfsManager struct {
-	devices map[string]*pluginapi.Device
+	mu       sync.Mutex
+	devices  map[string]*pluginapi.Device
+	slots    map[string]deviceSlot
+	capacity capacitySource
+	health   healthChecker
+	interval time.Duration
+	// client is injected into allocated containers if set
+	client *bfsClient
+	policy allocationPolicy
+	// preStart is run before every container start if set
+	preStart *preStartCheck
+	// cdi writes a CDI spec of the devices and Allocate returns CDI devices if set
+	cdi *cdiSpecWriter
+	// cdiDevices are the device IDs of the last CDI spec written
+	cdiDevices []string
+	// ledger records the allocations if set
+	ledger *allocationLedger
+	// resourceName labels the metrics of the manager
+	resourceName string
+	// streams is the number of ListAndWatch streams opened by kubelet
+	streams int
+	// streamsDone is closed to end the open ListAndWatch streams
+	streamsDone chan struct{}
+	// updated is closed to rediscover the devices of the open ListAndWatch streams at once
+	updated chan struct{}
+	// sendErr is the result of the last ListAndWatch send
+	sendErr error
 }
 
+// errNotSent is the ListAndWatch state until the devices are sent to kubelet the first time
+var errNotSent = errors.New("no devices sent to kubelet yet")
+
 // discoverResources is discover resources
 func (bfs *bfsManager) discoverResources() bool {
 	found := false
-	bfs.devices = make(map[string]*pluginapi.Device)
 	glog.Info("Discover")
-	nums, err := strconv.Atoi(resourceNums)
+	capacity, checker := bfs.sources()
+	slots, err := capacity.Slots()
 	if err != nil {
 		glog.Error(err)
 	}
-	// Unlimited resources
-	for i := 0; i < nums; i += 1 {
-		dev := pluginapi.Device{ID: strconv.Itoa(i), Health: pluginapi.Healthy}
-		bfs.devices[strconv.Itoa(i)] = &dev
+	health := pluginapi.Healthy
+	if !checker.Healthy() {
+		glog.Warning("Bitfusion server pool is down, devices are unhealthy")
+		health = pluginapi.Unhealthy
+	}
+
+	bfs.mu.Lock()
+	bfs.devices = make(map[string]*pluginapi.Device)
+	bfs.slots = make(map[string]deviceSlot)
+	for i, id := range deviceIDs(slots) {
+		dev := pluginapi.Device{ID: id, Health: health}
+		bfs.devices[dev.ID] = &dev
+		bfs.slots[dev.ID] = slots[i]
 		found = true
 	}
+	advertisedDevices.WithLabelValues(bfs.resourceName).Set(float64(len(slots)))
+	if health == pluginapi.Healthy {
+		healthyDevices.WithLabelValues(bfs.resourceName).Set(float64(len(slots)))
+	} else {
+		healthyDevices.WithLabelValues(bfs.resourceName).Set(0)
+	}
+	bfs.mu.Unlock()
+
+	if bfs.cdi != nil {
+		bfs.writeCDISpec()
+	}
 	glog.Info("Discover Resources over")
 
 	return found
 }
 
+// sources returns the capacity source and health checker of the manager
+func (bfs *bfsManager) sources() (capacitySource, healthChecker) {
+	bfs.mu.Lock()
+	defer bfs.mu.Unlock()
+	return bfs.capacity, bfs.health
+}
+
+// update takes over the capacity source, health checker and interval of next,
+// the open ListAndWatch streams send the devices discovered with them at once
+func (bfs *bfsManager) update(next *bfsManager) {
+	bfs.mu.Lock()
+	defer bfs.mu.Unlock()
+	bfs.capacity = next.capacity
+	bfs.health = next.health
+	bfs.interval = next.interval
+	close(bfs.updated)
+	bfs.updated = make(chan struct{})
+}
+
+// deviceList returns the discovered devices sorted by ID
+func (bfs *bfsManager) deviceList() []*pluginapi.Device {
+	bfs.mu.Lock()
+	defer bfs.mu.Unlock()
+	devices := make([]*pluginapi.Device, 0, len(bfs.devices))
+	for _, dev := range bfs.devices {
+		devices = append(devices, &pluginapi.Device{ID: dev.ID, Health: dev.Health})
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// writeCDISpec rewrites the CDI spec when the device IDs changed since it was last written
+func (bfs *bfsManager) writeCDISpec() {
+	devices := bfs.deviceList()
+	ids := make([]string, len(devices))
+	for i, dev := range devices {
+		ids[i] = dev.ID
+	}
+	bfs.mu.Lock()
+	slots := bfs.slots
+	changed := bfs.cdiDevices == nil || strings.Join(bfs.cdiDevices, ",") != strings.Join(ids, ",")
+	bfs.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	if err := bfs.cdi.write(devices, slots); err != nil {
+		glog.Errorf("Can't write CDI spec of %s: %v", bfs.resourceName, err)
+		return
+	}
+	glog.Infof("Wrote CDI spec %s with %d devices", bfs.cdi.specFile(), len(ids))
+	bfs.mu.Lock()
+	bfs.cdiDevices = ids
+	bfs.mu.Unlock()
+}
+
+// deviceSlots returns the Bitfusion GPUs of the devices, nil if none is known.
+// Devices no longer discovered are found from their ID
+func (bfs *bfsManager) deviceSlots(ids []string) []deviceSlot {
+	bfs.mu.Lock()
+	defer bfs.mu.Unlock()
+	var slots []deviceSlot
+	for _, id := range sortedIDs(ids) {
+		slot, ok := bfs.slots[id]
+		if !ok {
+			slot, ok = parseDeviceID(id)
+		}
+		if ok && slot.Server != "" {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// devicesChanged reports whether two sorted device lists differ in IDs or health
+func devicesChanged(old, new []*pluginapi.Device) bool {
+	if old == nil || len(old) != len(new) {
+		return true
+	}
+	for i := range old {
+		if old[i].ID != new[i].ID || old[i].Health != new[i].Health {
+			return true
+		}
+	}
+	return false
+}
+
 // ListAndWatch returns a stream of List of Devices .
 // Whenever a Device state change or a Device disappears.
 // ListAndWatch returns the new list
 func (bfs *bfsManager) ListAndWatch(emtpy *pluginapi.Empty, stream pluginapi.DevicePlugin_ListAndWatchServer) error {
 	glog.Info("ListAndWatch start\n")
+	bfs.mu.Lock()
+	if bfs.streams != 0 {
+		listAndWatchReconnects.WithLabelValues(bfs.resourceName).Inc()
+	}
+	bfs.streams++
+	done := bfs.streamsDone
+	bfs.mu.Unlock()
+
+	var sent []*pluginapi.Device
 	for {
 		glog.Info("ListAndWatch Pending.............\n")
 		bfs.discoverResources()
-		resp := new(pluginapi.ListAndWatchResponse)
-		for _, dev := range bfs.devices {
-			resp.Devices = append(resp.Devices, dev)
+		devices := bfs.deviceList()
+		if devicesChanged(sent, devices) {
+			err := stream.Send(&pluginapi.ListAndWatchResponse{Devices: devices})
+			bfs.mu.Lock()
+			bfs.sendErr = err
+			bfs.mu.Unlock()
+			if err != nil {
+				glog.Errorf("Failed to send response to kubelet: %v\n", err)
+				return err
+			}
+			sent = devices
 		}
-		if err := stream.Send(resp); err != nil {
-			glog.Errorf("Failed to send response to kubelet: %v\n", err)
+
+		bfs.mu.Lock()
+		interval, updated := bfs.interval, bfs.updated
+		bfs.mu.Unlock()
+		select {
+		case <-stream.Context().Done():
+			glog.Info("ListAndWatch stopped, kubelet disconnected\n")
+			return nil
+		case <-done:
+			glog.Info("ListAndWatch stopped, device plugin is stopping\n")
+			return nil
+		case <-updated:
+			glog.Info("ListAndWatch rediscovers the devices, configuration changed\n")
+		case <-time.After(interval):
 		}
-		time.Sleep(interval * time.Second)
 	}
-	return nil
+}
+
+// sendError returns the error of the last ListAndWatch send, errNotSent if there was none
+func (bfs *bfsManager) sendError() error {
+	bfs.mu.Lock()
+	defer bfs.mu.Unlock()
+	if bfs.sendErr == nil || bfs.sendErr == errNotSent {
+		return bfs.sendErr
+	}
+	return fmt.Errorf("ListAndWatch send failed: %v ", bfs.sendErr)
+}
+
+// closeStreams ends the open ListAndWatch streams, later streams are served normally
+func (bfs *bfsManager) closeStreams() {
+	bfs.mu.Lock()
+	defer bfs.mu.Unlock()
+	close(bfs.streamsDone)
+	bfs.streamsDone = make(chan struct{})
 }
 
 // Allocate is called during container creation so that the Device .
@@ -66,11 +252,33 @@ func (bfs *bfsManager) ListAndWatch(emtpy *pluginapi.Empty, stream pluginapi.Dev
 func (bfs *bfsManager) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 
 	glog.Info("Allocate")
+	allocateRequests.WithLabelValues(bfs.resourceName).Inc()
+	timer := prometheus.NewTimer(allocateDuration.WithLabelValues(bfs.resourceName))
+	defer timer.ObserveDuration()
+
 	var response pluginapi.AllocateResponse
-	var car pluginapi.ContainerAllocateResponse
 	for _, req := range rqt.ContainerRequests {
 		glog.Infof("Allocating device IDs: %s", req.DevicesIDs)
-		response.ContainerResponses = append(response.ContainerResponses, &car)
+		car := &pluginapi.ContainerAllocateResponse{}
+		if bfs.cdi != nil {
+			car = bfs.cdi.containerResponse(req.DevicesIDs)
+		} else if bfs.client != nil {
+			car = bfs.client.containerResponse(req.DevicesIDs)
+		}
+		// Place the container on the Bitfusion servers of its devices
+		slots := bfs.deviceSlots(req.DevicesIDs)
+		for name, value := range placementEnvs(slots) {
+			if car.Envs == nil {
+				car.Envs = make(map[string]string)
+			}
+			car.Envs[name] = value
+		}
+		if bfs.ledger != nil {
+			if err := bfs.ledger.record(bfs.resourceName, req.DevicesIDs, slots); err != nil {
+				glog.Errorf("Can't record allocation of %s: %v", req.DevicesIDs, err)
+			}
+		}
+		response.ContainerResponses = append(response.ContainerResponses, car)
 	}
 
 	return &response, nil
@@ -79,24 +287,55 @@ func (bfs *bfsManager) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequ
 // PreStartContainer is called, if indicated by Device Plugin during registeration phase,
 // before each container start.
 // Device plugin can run device specific operations such as resetting the device before making devices available to the container
-func (*bfsManager) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+func (bfs *bfsManager) PreStartContainer(ctx context.Context, rqt *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	if bfs.preStart == nil {
+		return new(pluginapi.PreStartContainerResponse), nil
+	}
+	glog.Infof("PreStartContainer device IDs: %s", rqt.DevicesIDs)
+	if err := bfs.checkPreStart(rqt.DevicesIDs); err != nil {
+		glog.Errorf("Bitfusion is not ready for the container: %v", err)
+		return nil, fmt.Errorf("Bitfusion is not ready for the container: %v", err)
+	}
 	return new(pluginapi.PreStartContainerResponse), nil
 }
 
 // GetDevicePluginOptions returns options to be communicated with Device Manager
-func (*bfsManager) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{}, nil
+func (bfs *bfsManager) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                bfs.preStart != nil,
+		GetPreferredAllocationAvailable: bfs.policy != policyNone,
+	}, nil
 }
 
 // GetPreferredAllocation returns a preferred set of devices to allocate from a list of available ones.
 // The resulting preferred allocation is not guaranteed to be the allocation ultimately performed by the devicemanager.
 // It is only designed to help the device manager make a more informed allocation decision when possible.
-func (*bfsManager) GetPreferredAllocation(context.Context, *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	return &pluginapi.PreferredAllocationResponse{}, nil
+func (bfs *bfsManager) GetPreferredAllocation(ctx context.Context, rqt *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	bfs.mu.Lock()
+	slots := bfs.slots
+	bfs.mu.Unlock()
+
+	var response pluginapi.PreferredAllocationResponse
+	for _, req := range rqt.ContainerRequests {
+		ids := preferredDevices(bfs.policy, slots, req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+		glog.Infof("Preferred device IDs (%s): %s", bfs.policy, ids)
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: ids,
+		})
+	}
+	return &response, nil
 }
 
-func NewbfsManager() (*bfsManager, error) {
+func NewbfsManager(capacity capacitySource, health healthChecker, interval time.Duration) (*bfsManager, error) {
 	return &bfsManager{
-		devices: make(map[string]*pluginapi.Device),
+		devices:  make(map[string]*pluginapi.Device),
+		slots:    make(map[string]deviceSlot),
+		capacity: capacity,
+		health:   health,
+		interval: interval,
+
+		streamsDone: make(chan struct{}),
+		updated:     make(chan struct{}),
+		sendErr:     errNotSent,
 	}, nil
 }
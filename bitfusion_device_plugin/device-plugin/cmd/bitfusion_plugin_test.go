@@ -0,0 +1,220 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeHealth is a healthChecker whose state is set by the test
+type fakeHealth struct {
+	down int32
+}
+
+func (h *fakeHealth) Healthy() bool {
+	return atomic.LoadInt32(&h.down) == 0
+}
+
+func (h *fakeHealth) set(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&h.down, 0)
+	} else {
+		atomic.StoreInt32(&h.down, 1)
+	}
+}
+
+// fakeListAndWatchStream records the responses sent by ListAndWatch
+type fakeListAndWatchStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses chan *pluginapi.ListAndWatchResponse
+}
+
+func newFakeListAndWatchStream(ctx context.Context) *fakeListAndWatchStream {
+	return &fakeListAndWatchStream{
+		ctx:       ctx,
+		responses: make(chan *pluginapi.ListAndWatchResponse, 10),
+	}
+}
+
+func (s *fakeListAndWatchStream) Send(resp *pluginapi.ListAndWatchResponse) error {
+	s.responses <- resp
+	return nil
+}
+
+func (s *fakeListAndWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeListAndWatchStream) next(t *testing.T) *pluginapi.ListAndWatchResponse {
+	select {
+	case resp := <-s.responses:
+		return resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListAndWatch did not send devices")
+	}
+	return nil
+}
+
+func assertDevicesHealth(t *testing.T, resp *pluginapi.ListAndWatchResponse, count int, health string) {
+	assert.Equal(t, count, len(resp.Devices))
+	for _, dev := range resp.Devices {
+		assert.Equal(t, health, dev.Health)
+	}
+}
+
+func TestDiscoverResources(t *testing.T) {
+	bfs, _ := NewbfsManager(staticCapacity{nums: 10}, alwaysHealthy{}, time.Second)
+	assert.True(t, bfs.discoverResources())
+	assert.Equal(t, 10, len(bfs.devices))
+
+	bfs, _ = NewbfsManager(staticCapacity{nums: 0}, alwaysHealthy{}, time.Second)
+	assert.False(t, bfs.discoverResources())
+}
+
+func TestListAndWatch(t *testing.T) {
+	health := &fakeHealth{}
+	bfs, _ := NewbfsManager(staticCapacity{nums: 5}, health, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newFakeListAndWatchStream(ctx)
+	done := make(chan error)
+	go func() { done <- bfs.ListAndWatch(&pluginapi.Empty{}, stream) }()
+
+	assertDevicesHealth(t, stream.next(t), 5, pluginapi.Healthy)
+
+	// Nothing is sent while the devices don't change
+	select {
+	case <-stream.responses:
+		t.Fatal("ListAndWatch sent unchanged devices")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	health.set(false)
+	assertDevicesHealth(t, stream.next(t), 5, pluginapi.Unhealthy)
+	health.set(true)
+	assertDevicesHealth(t, stream.next(t), 5, pluginapi.Healthy)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListAndWatch did not stop")
+	}
+}
+
+func TestPoolHealth(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := lis.Addr().String()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := closed.Addr().String()
+	closed.Close()
+
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+
+	health := newPoolHealth(serverPool{serversConf: writeServersConf(t, dir, down, up)})
+	assert.True(t, health.Healthy())
+
+	lis.Close()
+	assert.False(t, health.Healthy())
+
+	// A broken servers.conf makes the devices unhealthy
+	broken := path.Join(dir, "broken.conf")
+	ioutil.WriteFile(broken, []byte("servers: ["), 0644)
+	health = newPoolHealth(serverPool{serversConf: broken})
+	assert.False(t, health.Healthy())
+}
+
+func TestPoolHealthMissingServersConf(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+
+	// The optional servers.conf secret isn't mounted, the health is unknown and the devices stay healthy
+	conf := path.Join(dir, "servers.conf")
+	health := newPoolHealth(serverPool{serversConf: conf})
+	assert.True(t, health.Healthy())
+	assert.True(t, health.Healthy())
+	assert.True(t, health.missing)
+
+	// Once the secret is mounted the servers are probed
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := closed.Addr().String()
+	closed.Close()
+	writeServersConf(t, dir, down)
+	assert.False(t, health.Healthy())
+	assert.False(t, health.missing)
+}
+
+func TestStaticCapacityHealth(t *testing.T) {
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := closed.Addr().String()
+	closed.Close()
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+
+	// The default static capacity still reports the devices unhealthy while the pool is down
+	cfg := &config{Interval: 10, CapacitySource: capacityStatic, ServersConf: writeServersConf(t, dir, down)}
+	bfs, err := newManager(cfg, resourceConfig{ResourceName: "bitfusion.io/gpu", ResourceNums: 2})
+	if !assert.Nil(t, err) {
+		return
+	}
+	bfs.discoverResources()
+	assert.Equal(t, 2, len(bfs.devices))
+	for id, dev := range bfs.devices {
+		assert.Equal(t, pluginapi.Unhealthy, dev.Health, id)
+	}
+
+	// Without servers.conf there is nothing to probe
+	bfs, _ = newManager(&config{Interval: 10, CapacitySource: capacityStatic}, resourceConfig{ResourceName: "bitfusion.io/gpu", ResourceNums: 2})
+	assert.Equal(t, alwaysHealthy{}, bfs.health)
+}
+
+func TestAllocate(t *testing.T) {
+	bfs, _ := NewbfsManager(staticCapacity{nums: 10}, alwaysHealthy{}, time.Second)
+	req := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"0", "1"}},
+		{DevicesIDs: []string{"2"}},
+	}}
+
+	resp, err := bfs.Allocate(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resp.ContainerResponses))
+	assert.Equal(t, 0, len(resp.ContainerResponses[0].Mounts))
+
+	bfs.client = &bfsClient{
+		DistroPath:   "/opt/bitfusion-client",
+		LibraryPath:  "/bitfusion/bitfusion-client-ubuntu1804_4.5.0-4_amd64.deb/opt/bitfusion/lib/x86_64-linux-gnu/bitfusion/lib/",
+		ClientConfig: "/etc/bitfusion/client.yaml",
+		ServersConf:  "/etc/bitfusion/servers.conf",
+	}
+	resp, err = bfs.Allocate(context.Background(), req)
+	assert.Nil(t, err)
+	car := resp.ContainerResponses[0]
+	assert.Equal(t, bfs.client.LibraryPath, car.Envs["LD_LIBRARY_PATH"])
+	assert.Equal(t, "0,1", car.Annotations[deviceIDsAnnotation])
+	assert.Equal(t, "2", resp.ContainerResponses[1].Annotations[deviceIDsAnnotation])
+	assert.Equal(t, []*pluginapi.Mount{
+		{ContainerPath: containerDistroPath, HostPath: "/opt/bitfusion-client", ReadOnly: true},
+		{ContainerPath: containerClientYaml, HostPath: "/etc/bitfusion/client.yaml", ReadOnly: true},
+		{ContainerPath: containerServersConf, HostPath: "/etc/bitfusion/servers.conf", ReadOnly: true},
+	}, car.Mounts)
+}
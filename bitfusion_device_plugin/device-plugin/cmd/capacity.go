@@ -0,0 +1,376 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// deviceSlot is one advertised device, a share of a Bitfusion GPU in the unit of the resource
+type deviceSlot struct {
+	// Server is the Bitfusion server address, empty if unknown
+	Server string `json:"server"`
+	// GPU is the GPU index on the server, -1 if unknown
+	GPU int `json:"gpu"`
+}
+
+// capacitySource returns the devices the plugin should advertise
+type capacitySource interface {
+	Slots() ([]deviceSlot, error)
+}
+
+// staticCapacity advertises a fixed number of devices not tied to any server
+type staticCapacity struct {
+	nums int
+}
+
+func (c staticCapacity) Slots() ([]deviceSlot, error) {
+	slots := make([]deviceSlot, c.nums)
+	for i := range slots {
+		slots[i] = deviceSlot{GPU: -1}
+	}
+	return slots, nil
+}
+
+// serversConf is the Bitfusion client servers.conf file
+type serversConf struct {
+	Servers []struct {
+		Reachable string   `yaml:"reachable"`
+		Addresses []string `yaml:"addresses"`
+	} `yaml:"servers"`
+}
+
+// loadServers returns the reachable host:port of the servers listed in a servers.conf file.
+// The addresses of a server are its networks, such as 10.117.32.0/24, so servers without reachable are skipped
+func loadServers(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var conf serversConf
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v ", file, err)
+	}
+
+	var addresses []string
+	for _, server := range conf.Servers {
+		if server.Reachable == "" {
+			glog.Warningf("Skip Bitfusion server of %s with addresses %v, it has no reachable address", file, server.Addresses)
+			continue
+		}
+		addresses = append(addresses, server.Reachable)
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no server with a reachable address found in %s ", file)
+	}
+	return addresses, nil
+}
+
+// serverPool is the Bitfusion servers of a servers.conf file, optionally limited to some of them
+type serverPool struct {
+	serversConf string
+	// only lists the addresses of the pool, empty means all servers
+	only []string
+}
+
+// addresses returns the addresses of the servers in the pool
+func (p serverPool) addresses() ([]string, error) {
+	addresses, err := loadServers(p.serversConf)
+	if err != nil || len(p.only) == 0 {
+		return addresses, err
+	}
+
+	var filtered []string
+	for _, address := range addresses {
+		for _, only := range p.only {
+			if address == only {
+				filtered = append(filtered, address)
+				break
+			}
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("none of the servers %v found in %s ", p.only, p.serversConf)
+	}
+	return filtered, nil
+}
+
+// capacityUnit is the amount of a Bitfusion GPU one device stands for
+type capacityUnit string
+
+const (
+	// unitPercent devices are 1% of a GPU
+	unitPercent capacityUnit = "percent"
+	// unitMemoryMB devices are a chunk of GPU memory counted in MB
+	unitMemoryMB capacityUnit = "memory-mb"
+
+	// defaultMemoryChunkMB is the GPU memory of one device of unitMemoryMB. One device per MB would list hundreds
+	// of thousands of devices for a few large GPUs, more than a ListAndWatch message to kubelet can carry
+	defaultMemoryChunkMB = 256
+)
+
+// gpuStatus is the state of one GPU reported by a Bitfusion server
+type gpuStatus struct {
+	Index         int   `json:"index"`
+	FreePercent   int   `json:"freePercent"`
+	MemoryTotalMB int64 `json:"memoryTotalMB"`
+	MemoryFreeMB  int64 `json:"memoryFreeMB"`
+}
+
+// serverStatus is the state of a Bitfusion server
+type serverStatus struct {
+	GPUs []gpuStatus `json:"gpus"`
+}
+
+// serverStatusClient queries the status of a Bitfusion server
+type serverStatusClient interface {
+	Status(address string) (*serverStatus, error)
+}
+
+// httpStatusClient queries the status endpoint of Bitfusion servers over HTTP(S).
+// The endpoint is not part of the Bitfusion server API, it is served by a status service next to each server
+// as described in section 7.4 of the README
+type httpStatusClient struct {
+	client *http.Client
+	// urlFormat builds the status URL from a server address
+	urlFormat string
+}
+
+// newHTTPStatusClient creates a status client trusting caFile, an empty caFile uses the system roots
+func newHTTPStatusClient(caFile string) (*httpStatusClient, error) {
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s ", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &httpStatusClient{
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		urlFormat: "https://%s/status",
+	}, nil
+}
+
+func (c *httpStatusClient) Status(address string) (*serverStatus, error) {
+	resp, err := c.client.Get(fmt.Sprintf(c.urlFormat, address))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server %s returned %s ", address, resp.Status)
+	}
+
+	var status serverStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("can't decode status of server %s: %v ", address, err)
+	}
+	return &status, nil
+}
+
+// poolCapacity advertises the free capacity of the Bitfusion server pool
+type poolCapacity struct {
+	pool serverPool
+	unit capacityUnit
+	// memoryChunkMB is the GPU memory of one device of unitMemoryMB, 1 MB if not set
+	memoryChunkMB int
+	client        serverStatusClient
+	// fallback is used when the pool can't be reached
+	fallback capacitySource
+}
+
+func newPoolCapacity(pool serverPool, unit capacityUnit, client serverStatusClient, fallback capacitySource) *poolCapacity {
+	return &poolCapacity{
+		pool:     pool,
+		unit:     unit,
+		client:   client,
+		fallback: fallback,
+	}
+}
+
+func (c *poolCapacity) Slots() ([]deviceSlot, error) {
+	addresses, err := c.pool.addresses()
+	if err != nil {
+		glog.Errorf("Can't load Bitfusion servers, use static capacity: %v", err)
+		return c.fallback.Slots()
+	}
+
+	statuses := c.statuses(addresses)
+	reached := false
+	var slots []deviceSlot
+	for i, status := range statuses {
+		if status == nil {
+			continue
+		}
+		reached = true
+		gpus := status.GPUs
+		sort.Slice(gpus, func(a, b int) bool { return gpus[a].Index < gpus[b].Index })
+		for _, gpu := range gpus {
+			for n := 0; n < gpu.free(c.unit, c.chunkMB()); n++ {
+				slots = append(slots, deviceSlot{Server: addresses[i], GPU: gpu.Index})
+			}
+		}
+	}
+	if !reached {
+		glog.Error("No Bitfusion server reachable, use static capacity")
+		return c.fallback.Slots()
+	}
+	return slots, nil
+}
+
+// Total returns the number of devices the GPUs of the pool hold when idle
+func (c *poolCapacity) Total() (int, error) {
+	addresses, err := c.pool.addresses()
+	if err != nil {
+		return 0, err
+	}
+
+	reached := false
+	total := 0
+	for _, status := range c.statuses(addresses) {
+		if status == nil {
+			continue
+		}
+		reached = true
+		for _, gpu := range status.GPUs {
+			total += gpu.total(c.unit, c.chunkMB())
+		}
+	}
+	if !reached {
+		return 0, fmt.Errorf("no Bitfusion server of %v reachable ", addresses)
+	}
+	return total, nil
+}
+
+// chunkMB returns the GPU memory of one device of unitMemoryMB
+func (c *poolCapacity) chunkMB() int {
+	if c.memoryChunkMB < 1 {
+		return 1
+	}
+	return c.memoryChunkMB
+}
+
+// statuses queries the servers in parallel, the status of an unreachable server is nil
+func (c *poolCapacity) statuses(addresses []string) []*serverStatus {
+	statuses := make([]*serverStatus, len(addresses))
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			status, err := c.client.Status(address)
+			if err != nil {
+				glog.Errorf("Can't query Bitfusion server %s: %v", address, err)
+				return
+			}
+			statuses[i] = status
+		}(i, address)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// free returns the number of free devices of the GPU in unit, a device of unitMemoryMB is chunkMB of memory
+func (g gpuStatus) free(unit capacityUnit, chunkMB int) int {
+	if unit == unitMemoryMB {
+		return g.freeMemoryMB() / chunkMB
+	}
+	return g.freeShares()
+}
+
+// total returns the number of devices of the GPU in unit when it is idle
+func (g gpuStatus) total(unit capacityUnit, chunkMB int) int {
+	if unit == unitMemoryMB {
+		return int(g.MemoryTotalMB) / chunkMB
+	}
+	return 100
+}
+
+// freeMemoryMB returns the free memory of the GPU, limited by its free percent
+func (g gpuStatus) freeMemoryMB() int {
+	memory := g.MemoryFreeMB
+	if byPercent := int64(g.FreePercent) * g.MemoryTotalMB / 100; byPercent < memory {
+		memory = byPercent
+	}
+	if memory < 0 {
+		return 0
+	}
+	return int(memory)
+}
+
+// freeShares returns the free percent of the GPU, limited by its free memory
+func (g gpuStatus) freeShares() int {
+	shares := g.FreePercent
+	if g.MemoryTotalMB > 0 {
+		if byMemory := int(g.MemoryFreeMB * 100 / g.MemoryTotalMB); byMemory < shares {
+			shares = byMemory
+		}
+	}
+	if shares < 0 {
+		return 0
+	}
+	if shares > 100 {
+		return 100
+	}
+	return shares
+}
+
+// assignedCapacity limits the devices of a capacity source to the number the capacity controller
+// assigned to the node. The assignment is a YAML map from resource name to devices in file
+type assignedCapacity struct {
+	capacity     capacitySource
+	file         string
+	resourceName string
+}
+
+func (c *assignedCapacity) Slots() ([]deviceSlot, error) {
+	slots, err := c.capacity.Slots()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		glog.Warningf("No capacity assigned to the node, advertise %d devices of %s: %v", len(slots), c.resourceName, err)
+		return slots, nil
+	}
+	var assignment map[string]int
+	if err := yaml.Unmarshal(data, &assignment); err != nil {
+		return nil, fmt.Errorf("can't parse capacity assignment %s: %v ", c.file, err)
+	}
+	nums, ok := assignment[c.resourceName]
+	if !ok {
+		glog.Warningf("No capacity of %s assigned to the node, advertise %d devices", c.resourceName, len(slots))
+		return slots, nil
+	}
+	if nums < 0 {
+		nums = 0
+	}
+	if nums < len(slots) {
+		slots = slots[:nums]
+	}
+	return slots, nil
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// startFakeBitfusionServer serves status on a local HTTP server and returns its address
+func startFakeBitfusionServer(t *testing.T, status serverStatus) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	}))
+}
+
+func writeServersConf(t *testing.T, dir string, addresses ...string) string {
+	conf := "servers:\n"
+	for _, address := range addresses {
+		conf += fmt.Sprintf("- reachable: %s\n  addresses:\n  - %s\n", address, address)
+	}
+	file := path.Join(dir, "servers.conf")
+	if err := ioutil.WriteFile(file, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func testStatusClient() *httpStatusClient {
+	client, _ := newHTTPStatusClient("")
+	client.urlFormat = "http://%s/status"
+	return client
+}
+
+func TestLoadServers(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "servers.conf")
+	ioutil.WriteFile(file, []byte("servers:\n- addresses:\n  - 10.0.0.0/24\n- reachable: 10.0.0.2:56001\n  addresses:\n  - 10.0.0.0/24\n"), 0644)
+
+	// The server without reachable only has a network, it is skipped
+	addresses, err := loadServers(file)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.2:56001"}, addresses)
+
+	ioutil.WriteFile(file, []byte("servers:\n- addresses:\n  - 10.0.0.0/24\n"), 0644)
+	_, err = loadServers(file)
+	assert.NotNil(t, err)
+
+	_, err = loadServers(path.Join(dir, "missing.conf"))
+	assert.NotNil(t, err)
+}
+
+func TestPoolCapacity(t *testing.T) {
+	server1 := startFakeBitfusionServer(t, serverStatus{GPUs: []gpuStatus{
+		{Index: 1, FreePercent: 100, MemoryTotalMB: 16000, MemoryFreeMB: 4000},
+		{Index: 0, FreePercent: 30, MemoryTotalMB: 16000, MemoryFreeMB: 16000},
+	}})
+	defer server1.Close()
+	server2 := startFakeBitfusionServer(t, serverStatus{GPUs: []gpuStatus{
+		{Index: 0, FreePercent: 50},
+	}})
+	defer server2.Close()
+	address1 := strings.TrimPrefix(server1.URL, "http://")
+	address2 := strings.TrimPrefix(server2.URL, "http://")
+
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	conf := writeServersConf(t, dir, address1, address2)
+
+	capacity := newPoolCapacity(serverPool{serversConf: conf}, unitPercent, testStatusClient(), staticCapacity{nums: 1000})
+	slots, err := capacity.Slots()
+	assert.Nil(t, err)
+	// 30% of GPU 0 and 25% (limited by memory) of GPU 1 on server 1, 50% of GPU 0 on server 2
+	assert.Equal(t, 105, len(slots))
+	assert.Equal(t, deviceSlot{Server: address1, GPU: 0}, slots[0])
+	assert.Equal(t, deviceSlot{Server: address1, GPU: 1}, slots[30])
+	assert.Equal(t, deviceSlot{Server: address2, GPU: 0}, slots[55])
+
+	// Memory devices of the servers in the pool
+	pool := serverPool{serversConf: conf, only: []string{address1}}
+	capacity = newPoolCapacity(pool, unitMemoryMB, testStatusClient(), staticCapacity{nums: 1000})
+	slots, err = capacity.Slots()
+	assert.Nil(t, err)
+	// 4800M (limited by percent) of GPU 0 and 4000M of GPU 1
+	assert.Equal(t, 8800, len(slots))
+	assert.Equal(t, deviceSlot{Server: address1, GPU: 1}, slots[4800])
+
+	// 256M chunks, the partial chunks of each GPU are left out
+	capacity.memoryChunkMB = defaultMemoryChunkMB
+	slots, err = capacity.Slots()
+	assert.Nil(t, err)
+	assert.Equal(t, 18+15, len(slots))
+	assert.Equal(t, deviceSlot{Server: address1, GPU: 1}, slots[18])
+}
+
+// fakeStatusClient answers the same status for every server
+type fakeStatusClient serverStatus
+
+func (c fakeStatusClient) Status(address string) (*serverStatus, error) {
+	status := serverStatus(c)
+	return &status, nil
+}
+
+func TestPoolCapacityListAndWatchSize(t *testing.T) {
+	// 16 servers of 8 idle 80G GPUs
+	var gpus []gpuStatus
+	for i := 0; i < 8; i++ {
+		gpus = append(gpus, gpuStatus{Index: i, FreePercent: 100, MemoryTotalMB: 81920, MemoryFreeMB: 81920})
+	}
+	var addresses []string
+	for i := 0; i < 16; i++ {
+		addresses = append(addresses, fmt.Sprintf("10.117.32.%d:56001", 100+i))
+	}
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	conf := writeServersConf(t, dir, addresses...)
+
+	capacity := newPoolCapacity(serverPool{serversConf: conf}, unitMemoryMB, fakeStatusClient{GPUs: gpus}, nil)
+	capacity.memoryChunkMB = defaultMemoryChunkMB
+	slots, err := capacity.Slots()
+	assert.Nil(t, err)
+	assert.Equal(t, 16*8*320, len(slots))
+
+	resp := &pluginapi.ListAndWatchResponse{}
+	for _, id := range deviceIDs(slots) {
+		resp.Devices = append(resp.Devices, &pluginapi.Device{ID: id, Health: pluginapi.Healthy})
+	}
+	// The default gRPC message size limit of kubelet
+	assert.True(t, resp.Size() < 4*1024*1024, "ListAndWatch message of %d bytes", resp.Size())
+}
+
+func TestServerPool(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	conf := writeServersConf(t, dir, "10.0.0.1:56001", "10.0.0.2:56001")
+
+	addresses, err := serverPool{serversConf: conf}.addresses()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1:56001", "10.0.0.2:56001"}, addresses)
+
+	addresses, err = serverPool{serversConf: conf, only: []string{"10.0.0.2:56001"}}.addresses()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.2:56001"}, addresses)
+
+	_, err = serverPool{serversConf: conf, only: []string{"10.0.0.3:56001"}}.addresses()
+	assert.NotNil(t, err)
+}
+
+func TestPoolCapacityFallback(t *testing.T) {
+	server := startFakeBitfusionServer(t, serverStatus{})
+	address := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	conf := writeServersConf(t, dir, address)
+
+	capacity := newPoolCapacity(serverPool{serversConf: conf}, unitPercent, testStatusClient(), staticCapacity{nums: 10})
+	slots, err := capacity.Slots()
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(slots))
+
+	capacity = newPoolCapacity(serverPool{serversConf: path.Join(dir, "missing.conf")}, unitPercent, testStatusClient(), staticCapacity{nums: 10})
+	slots, err = capacity.Slots()
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(slots))
+}
+
+func TestAssignedCapacity(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "node-a")
+	capacity := &assignedCapacity{capacity: staticCapacity{nums: 100}, file: file, resourceName: "bitfusion.io/gpu"}
+
+	// Nothing assigned yet
+	slots, err := capacity.Slots()
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(slots))
+
+	ioutil.WriteFile(file, []byte("bitfusion.io/gpu: 30\nbitfusion.io/gpu-memory-mb: 4096\n"), 0644)
+	slots, err = capacity.Slots()
+	assert.Nil(t, err)
+	assert.Equal(t, 30, len(slots))
+
+	// The assignment never adds devices
+	ioutil.WriteFile(file, []byte("bitfusion.io/gpu: 300\n"), 0644)
+	slots, _ = capacity.Slots()
+	assert.Equal(t, 100, len(slots))
+
+	ioutil.WriteFile(file, []byte("bitfusion.io/gpu-memory-mb: 4096\n"), 0644)
+	slots, _ = capacity.Slots()
+	assert.Equal(t, 100, len(slots))
+
+	ioutil.WriteFile(file, []byte("bitfusion.io/gpu: [30]\n"), 0644)
+	_, err = capacity.Slots()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// cdiVersion is the version of the Container Device Interface spec written
+	cdiVersion = "0.5.0"
+	// cdiAnnotationPrefix is the prefix of the annotations listing CDI devices for runtimes without CDIDevices support
+	cdiAnnotationPrefix = "cdi.k8s.io/bitfusion-device-plugin_"
+)
+
+// cdiInvalidChars matches the characters not allowed in CDI device names
+var cdiInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_.:-]`)
+
+// cdiSpec is a Container Device Interface spec, see
+// https://github.com/container-orchestrated-devices/container-device-interface/blob/main/SPEC.md
+type cdiSpec struct {
+	Version        string            `yaml:"cdiVersion"`
+	Kind           string            `yaml:"kind"`
+	Devices        []cdiDevice       `yaml:"devices"`
+	ContainerEdits cdiContainerEdits `yaml:"containerEdits,omitempty"`
+}
+
+type cdiDevice struct {
+	Name           string            `yaml:"name"`
+	ContainerEdits cdiContainerEdits `yaml:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	Env    []string   `yaml:"env,omitempty"`
+	Mounts []cdiMount `yaml:"mounts,omitempty"`
+}
+
+type cdiMount struct {
+	HostPath      string   `yaml:"hostPath"`
+	ContainerPath string   `yaml:"containerPath"`
+	Options       []string `yaml:"options,omitempty"`
+}
+
+// cdiSpecWriter maintains the CDI spec of the devices of one resource
+type cdiSpecWriter struct {
+	dir string
+	// kind is the CDI kind of the devices, the resource name
+	kind   string
+	client *bfsClient
+}
+
+// cdiDeviceName returns the CDI name of a device ID, with the characters CDI doesn't allow replaced
+func cdiDeviceName(id string) string {
+	return cdiInvalidChars.ReplaceAllString(id, "_")
+}
+
+// cdiDeviceEnv returns the environment variable naming the Bitfusion GPU of a device in the container,
+// a CDI device needs at least one edit
+func cdiDeviceEnv(name string) string {
+	return "BITFUSION_DEVICE_" + strings.ToUpper(strings.NewReplacer(".", "_", ":", "_", "-", "_").Replace(name))
+}
+
+// qualifiedName returns the fully qualified CDI name of a device ID, such as bitfusion.io/gpu=0
+func (w *cdiSpecWriter) qualifiedName(id string) string {
+	return w.kind + "=" + cdiDeviceName(id)
+}
+
+// specFile returns the path of the spec, named after the kind
+func (w *cdiSpecWriter) specFile() string {
+	return path.Join(w.dir, strings.Replace(w.kind, "/", "-", -1)+".yaml")
+}
+
+// annotation returns the annotation key listing the CDI devices of the resource
+func (w *cdiSpecWriter) annotation() string {
+	return cdiAnnotationPrefix + strings.Replace(w.kind, "/", "_", -1)
+}
+
+// spec returns the CDI spec of the devices.
+// The client mounts and env are common to all devices, every device names its Bitfusion GPU in its env
+func (w *cdiSpecWriter) spec(devices []*pluginapi.Device, slots map[string]deviceSlot) *cdiSpec {
+	spec := &cdiSpec{
+		Version:        cdiVersion,
+		Kind:           w.kind,
+		Devices:        make([]cdiDevice, 0, len(devices)),
+		ContainerEdits: cdiClientEdits(w.client),
+	}
+
+	for _, dev := range devices {
+		gpu := "any"
+		if slot, ok := slots[dev.ID]; ok && slot.Server != "" {
+			gpu = slot.Server + "/" + strconv.Itoa(slot.GPU)
+		}
+		name := cdiDeviceName(dev.ID)
+		spec.Devices = append(spec.Devices, cdiDevice{
+			Name: name,
+			ContainerEdits: cdiContainerEdits{
+				Env: []string{cdiDeviceEnv(name) + "=" + gpu},
+			},
+		})
+	}
+	return spec
+}
+
+// write replaces the spec file of the devices
+func (w *cdiSpecWriter) write(devices []*pluginapi.Device, slots map[string]deviceSlot) error {
+	return writeCDISpec(w.specFile(), w.spec(devices, slots))
+}
+
+// cdiClientEdits returns the read-only mounts and the env of the Bitfusion client
+func cdiClientEdits(client *bfsClient) cdiContainerEdits {
+	var edits cdiContainerEdits
+	for name, value := range client.envs() {
+		edits.Env = append(edits.Env, name+"="+value)
+	}
+	sort.Strings(edits.Env)
+	for _, m := range client.mounts() {
+		edits.Mounts = append(edits.Mounts, cdiMount{
+			HostPath:      m.HostPath,
+			ContainerPath: m.ContainerPath,
+			Options:       []string{"ro", "nosuid", "nodev", "bind"},
+		})
+	}
+	return edits
+}
+
+// writeCDISpec replaces a spec file atomically, so the container runtime never reads a partial spec
+func writeCDISpec(file string, spec *cdiSpec) error {
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("can't write CDI spec %s: %v ", tmp, err)
+	}
+	return os.Rename(tmp, file)
+}
+
+// containerResponse returns the CDI devices of a container, the runtime applies their edits from the spec
+func (w *cdiSpecWriter) containerResponse(ids []string) *pluginapi.ContainerAllocateResponse {
+	car := &pluginapi.ContainerAllocateResponse{
+		Annotations: w.client.annotations(ids),
+	}
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = w.qualifiedName(id)
+		car.CDIDevices = append(car.CDIDevices, &pluginapi.CDIDevice{Name: names[i]})
+	}
+	car.Annotations[w.annotation()] = strings.Join(names, ",")
+	return car
+}
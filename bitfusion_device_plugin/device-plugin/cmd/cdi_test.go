@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	yaml "gopkg.in/yaml.v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func readCDISpec(t *testing.T, file string) *cdiSpec {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec cdiSpec
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return &spec
+}
+
+func TestCDIDeviceName(t *testing.T) {
+	assert.Equal(t, "12", cdiDeviceName("12"))
+	assert.Equal(t, "10.0.0.1_56001_0", cdiDeviceName("10.0.0.1/56001/0"))
+	assert.Equal(t, "BITFUSION_DEVICE_10_0_0_1_56001_0", cdiDeviceEnv("10.0.0.1_56001_0"))
+}
+
+func TestCDISpec(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	capacity := staticCapacity{nums: 3}
+	bfs, _ := NewbfsManager(capacity, alwaysHealthy{}, time.Hour)
+	bfs.resourceName = "bitfusion.io/gpu"
+	bfs.client = &bfsClient{
+		DistroPath:  "/opt/bitfusion-client",
+		LibraryPath: "/bitfusion/lib",
+		ServersConf: "/etc/bitfusion/servers.conf",
+	}
+	bfs.cdi = &cdiSpecWriter{dir: path.Join(dir, "cdi"), kind: "bitfusion.io/gpu", client: bfs.client}
+	bfs.discoverResources()
+
+	file := path.Join(dir, "cdi", "bitfusion.io-gpu.yaml")
+	spec := readCDISpec(t, file)
+	assert.Equal(t, cdiVersion, spec.Version)
+	assert.Equal(t, "bitfusion.io/gpu", spec.Kind)
+	assert.Equal(t, []string{"LD_LIBRARY_PATH=/bitfusion/lib"}, spec.ContainerEdits.Env)
+	assert.Equal(t, []cdiMount{
+		{HostPath: "/opt/bitfusion-client", ContainerPath: containerDistroPath, Options: []string{"ro", "nosuid", "nodev", "bind"}},
+		{HostPath: "/etc/bitfusion/servers.conf", ContainerPath: containerServersConf, Options: []string{"ro", "nosuid", "nodev", "bind"}},
+	}, spec.ContainerEdits.Mounts)
+	if assert.Equal(t, 3, len(spec.Devices)) {
+		assert.Equal(t, "0", spec.Devices[0].Name)
+		assert.Equal(t, []string{"BITFUSION_DEVICE_0=any"}, spec.Devices[0].ContainerEdits.Env)
+	}
+
+	// The spec is only rewritten when the devices change
+	ioutil.WriteFile(file, []byte("cdiVersion: 0.5.0\nkind: bitfusion.io/gpu\ndevices: []\n"), 0644)
+	bfs.discoverResources()
+	assert.Empty(t, readCDISpec(t, file).Devices)
+	bfs.capacity = staticCapacity{nums: 5}
+	bfs.discoverResources()
+	assert.Equal(t, 5, len(readCDISpec(t, file).Devices))
+
+	resp, err := bfs.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"0", "3"}}},
+	})
+	assert.Nil(t, err)
+	car := resp.ContainerResponses[0]
+	assert.Equal(t, []*pluginapi.CDIDevice{{Name: "bitfusion.io/gpu=0"}, {Name: "bitfusion.io/gpu=3"}}, car.CDIDevices)
+	assert.Equal(t, "bitfusion.io/gpu=0,bitfusion.io/gpu=3", car.Annotations["cdi.k8s.io/bitfusion-device-plugin_bitfusion.io_gpu"])
+	assert.Equal(t, "0,3", car.Annotations[deviceIDsAnnotation])
+	// The runtime applies the edits of the spec
+	assert.Empty(t, car.Mounts)
+	assert.Empty(t, car.Envs)
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Paths of the Bitfusion client files inside the container, the same as the webhook injects
+const (
+	containerDistroPath  = "/bitfusion"
+	containerOptPath     = "/opt/bitfusion"
+	containerClientYaml  = "/root/.bitfusion/client.yaml"
+	containerServersConf = "/etc/bitfusion/servers.conf"
+	containerCACert      = "/etc/bitfusion/tls/ca.crt"
+
+	// Annotations passed to the container runtime
+	deviceIDsAnnotation    = "bitfusion.io/device-ids"
+	clientDistroAnnotation = "bitfusion.io/client-distro"
+)
+
+// bfsClient is a Bitfusion client installed on the host.
+// Allocate injects it into the containers so no mutating webhook is needed
+type bfsClient struct {
+	// DistroPath is the host directory of the Bitfusion client distros, mounted at /bitfusion
+	DistroPath string `yaml:"distroPath"`
+	// OptPath is the host directory mounted at /opt/bitfusion, optional
+	OptPath string `yaml:"optPath"`
+	// LibraryPath is the LD_LIBRARY_PATH of the client inside the container
+	LibraryPath string `yaml:"libraryPath"`
+	// ClientConfig, ServersConf and CACert are the host paths of the Baremetal token files
+	ClientConfig string `yaml:"clientConfig"`
+	ServersConf  string `yaml:"serversConf"`
+	CACert       string `yaml:"caCert"`
+}
+
+// containerResponse returns the envs, mounts and annotations giving a container access to the client
+func (c *bfsClient) containerResponse(ids []string) *pluginapi.ContainerAllocateResponse {
+	return &pluginapi.ContainerAllocateResponse{
+		Envs:        c.envs(),
+		Mounts:      c.mounts(),
+		Annotations: c.annotations(ids),
+	}
+}
+
+// annotations returns the annotations describing the devices of a container to the container runtime
+func (c *bfsClient) annotations(ids []string) map[string]string {
+	return map[string]string{
+		deviceIDsAnnotation:    strings.Join(ids, ","),
+		clientDistroAnnotation: c.DistroPath,
+	}
+}
+
+// envs returns the environment variables the client needs in the container
+func (c *bfsClient) envs() map[string]string {
+	envs := map[string]string{}
+	if c.LibraryPath != "" {
+		envs["LD_LIBRARY_PATH"] = c.LibraryPath
+	}
+	return envs
+}
+
+// mounts returns the read-only mounts of the client files which are set
+func (c *bfsClient) mounts() []*pluginapi.Mount {
+	var mounts []*pluginapi.Mount
+	for _, m := range []struct {
+		hostPath      string
+		containerPath string
+	}{
+		{c.DistroPath, containerDistroPath},
+		{c.OptPath, containerOptPath},
+		{c.ClientConfig, containerClientYaml},
+		{c.ServersConf, containerServersConf},
+		{c.CACert, containerCACert},
+	} {
+		if m.hostPath == "" {
+			continue
+		}
+		mounts = append(mounts, &pluginapi.Mount{
+			ContainerPath: m.containerPath,
+			HostPath:      m.hostPath,
+			ReadOnly:      true,
+		})
+	}
+	return mounts
+}
@@ -0,0 +1,487 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Capacity sources of the device plugin
+const (
+	capacityStatic = "static"
+	capacityPool   = "pool"
+)
+
+// Modes of the process
+const (
+	// modePlugin runs the device plugin on a node
+	modePlugin = "plugin"
+	// modeController runs the capacity controller assigning the devices advertised by every node
+	modeController = "controller"
+	// modeSimulate runs the device plugin against an in-process kubelet, without a cluster
+	modeSimulate = "simulate"
+)
+
+// resourceNameRegexp matches an extended resource name such as bitfusion.io/gpu
+var resourceNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?/[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+
+// resourceConfig is one extended resource advertised by the device plugin on its own socket
+type resourceConfig struct {
+	ResourceName string `yaml:"resourceName"`
+	SocketName   string `yaml:"socketName"`
+	// Unit is the amount of a GPU one device stands for, percent or memory-mb
+	Unit capacityUnit `yaml:"unit"`
+	// MemoryChunkMB is the GPU memory of one device of the memory-mb unit
+	MemoryChunkMB int `yaml:"memoryChunkMB"`
+	// Servers limits the pool capacity source to these Bitfusion servers
+	Servers []string `yaml:"servers"`
+	// ResourceNums is the number of devices advertised by the static capacity source
+	ResourceNums int `yaml:"resourceNums"`
+}
+
+// config of the device plugin.
+// Values are taken from the defaults, the config file, the environment and the flags, the later ones win
+type config struct {
+	// SocketName is the name of the device plugin socket in DevicePluginDir
+	SocketName   string `yaml:"socketName"`
+	ResourceName string `yaml:"resourceName"`
+	// Interval is the number of seconds between two device discoveries
+	Interval int `yaml:"interval"`
+	// ResourceNums is the number of devices advertised by the static capacity source
+	ResourceNums int `yaml:"resourceNums"`
+	// CapacitySource is static or pool, defaults to static
+	CapacitySource string `yaml:"capacitySource"`
+	ServersConf    string `yaml:"serversConf"`
+	CACert         string `yaml:"caCert"`
+	// KubeletRoot is the kubelet root directory on the host, detected if empty
+	KubeletRoot string `yaml:"kubeletRoot"`
+	// HostRoot is where the host file system is mounted, the kubelet root is looked up below it
+	HostRoot string `yaml:"hostRoot"`
+	// DevicePluginDir is the kubelet directory of the device plugin sockets, defaults to device-plugins in the kubelet root
+	DevicePluginDir  string     `yaml:"devicePluginDir"`
+	AllocationPolicy string     `yaml:"allocationPolicy"`
+	Client           *bfsClient `yaml:"client"`
+	// CDISpecDir is the directory the container runtime reads CDI specs from, empty disables CDI
+	CDISpecDir string `yaml:"cdiSpecDir"`
+	// DRA serves claims of Bitfusion GPUs with Dynamic Resource Allocation besides the device plugin resources
+	DRA bool `yaml:"dra"`
+	// DRADriverName is the name of the DRA driver the ResourceClasses refer to
+	DRADriverName string `yaml:"draDriverName"`
+	// PreStartCheck verifies the Bitfusion servers and token before every container start
+	PreStartCheck bool `yaml:"preStartCheck"`
+	// CheckpointFile records the allocations of the node, empty disables it
+	CheckpointFile string `yaml:"checkpointFile"`
+	// PodResourcesSocket is the kubelet pod resources socket the allocations are reconciled with,
+	// defaults to pod-resources/kubelet.sock in the kubelet root
+	PodResourcesSocket string `yaml:"podResourcesSocket"`
+	// Mode is plugin, controller or simulate
+	Mode string `yaml:"mode"`
+	// NodeName is the node the device plugin runs on
+	NodeName string `yaml:"nodeName"`
+	// AssignmentDir is the mounted ConfigMap of the capacity assigned to each node by the controller
+	AssignmentDir string `yaml:"assignmentDir"`
+	// AssignmentConfigMap is the namespace/name of the ConfigMap the controller writes
+	AssignmentConfigMap string `yaml:"assignmentConfigMap"`
+	// MetricsAddress is the listen address of the /metrics endpoint, empty disables it
+	MetricsAddress string `yaml:"metricsAddress"`
+	// AllocationsAddress is the listen address of the /allocations endpoint, empty disables it
+	AllocationsAddress string `yaml:"allocationsAddress"`
+	// NodeLabels publishes the Bitfusion features of the node as node labels and annotations
+	NodeLabels bool `yaml:"nodeLabels"`
+	// FeatureFile is the Node Feature Discovery feature file the features are written to, empty disables it
+	FeatureFile string `yaml:"featureFile"`
+	// Resources advertised by the device plugin, defaults to the single resource above
+	Resources []resourceConfig `yaml:"resources"`
+
+	// file is the config file the config was read from, empty if none
+	file string
+}
+
+func defaultConfig() *config {
+	return &config{
+		SocketName:          "bitfusion.io",
+		ResourceName:        "bitfusion.io/gpu",
+		Interval:            10,
+		ResourceNums:        1000,
+		CheckpointFile:      "/var/lib/bitfusion/device-plugin/allocations.json",
+		Mode:                modePlugin,
+		AssignmentConfigMap: "kube-system/bitfusion-device-plugin-capacity",
+		MetricsAddress:      ":9310",
+		AllocationsAddress:  "127.0.0.1:9311",
+		DRADriverName:       draDriverName,
+	}
+}
+
+// kubeletSocket returns the path of the kubelet registration socket
+func (c *config) kubeletSocket() string {
+	return path.Join(c.DevicePluginDir, kubeletSocketName)
+}
+
+// resources returns the resources to advertise with their defaults filled in
+func (c *config) resources() []resourceConfig {
+	if len(c.Resources) == 0 {
+		return []resourceConfig{{
+			ResourceName: c.ResourceName,
+			SocketName:   c.SocketName,
+			Unit:         unitPercent,
+			ResourceNums: c.ResourceNums,
+		}}
+	}
+
+	resources := make([]resourceConfig, len(c.Resources))
+	for i, res := range c.Resources {
+		if res.Unit == "" {
+			res.Unit = unitPercent
+		}
+		if res.ResourceNums == 0 {
+			res.ResourceNums = c.ResourceNums
+		}
+		if res.Unit == unitMemoryMB && res.MemoryChunkMB == 0 {
+			res.MemoryChunkMB = defaultMemoryChunkMB
+		}
+		resources[i] = res
+	}
+	return resources
+}
+
+// assignmentConfigMap returns the namespace and name of the capacity assignment ConfigMap
+func (c *config) assignmentConfigMap() (string, string, error) {
+	parts := strings.Split(c.AssignmentConfigMap, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("assignment configmap %q must be namespace/name ", c.AssignmentConfigMap)
+	}
+	return parts[0], parts[1], nil
+}
+
+// bindFlags defines the flags of the config in fs
+func (c *config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.SocketName, "socket-name", c.SocketName, "Name of the device plugin socket.")
+	fs.StringVar(&c.ResourceName, "resource-name", c.ResourceName, "Extended resource advertised to kubelet.")
+	fs.IntVar(&c.Interval, "interval", c.Interval, "Seconds between two device discoveries.")
+	fs.IntVar(&c.ResourceNums, "resource-nums", c.ResourceNums, "Number of devices advertised by the static capacity source.")
+	fs.StringVar(&c.CapacitySource, "capacity-source", c.CapacitySource,
+		"Capacity source, static or pool. The pool source queries the status of the Bitfusion servers of -servers-conf.")
+	fs.StringVar(&c.ServersConf, "servers-conf", c.ServersConf, "Bitfusion servers.conf file.")
+	fs.StringVar(&c.CACert, "ca-cert", c.CACert, "CA certificate of the Bitfusion servers.")
+	fs.StringVar(&c.KubeletRoot, "kubelet-root", c.KubeletRoot,
+		"Kubelet root directory on the host. Empty detects the root of Kubernetes, microk8s, k3s or RKE2.")
+	fs.StringVar(&c.HostRoot, "host-root", c.HostRoot, "Mount point of the host file system, empty if the kubelet root is mounted as is.")
+	fs.StringVar(&c.DevicePluginDir, "device-plugin-dir", c.DevicePluginDir,
+		"Kubelet device plugin directory. Defaults to device-plugins in the kubelet root.")
+	fs.StringVar(&c.AllocationPolicy, "allocation-policy", c.AllocationPolicy,
+		"Preferred allocation policy, pack or spread. Empty disables preferred allocation.")
+	fs.StringVar(&c.CDISpecDir, "cdi-spec-dir", c.CDISpecDir,
+		"Directory of the CDI specs, such as /var/run/cdi. Allocate returns CDI devices instead of mounts if set. Empty disables CDI.")
+	fs.BoolVar(&c.DRA, "dra", c.DRA,
+		"Serve ResourceClaims of Bitfusion GPUs with Dynamic Resource Allocation, the kubelet plugin in plugin mode and the allocation instead of the capacity assignment in controller mode.")
+	fs.StringVar(&c.DRADriverName, "dra-driver-name", c.DRADriverName, "Name of the DRA driver the ResourceClasses refer to.")
+	fs.BoolVar(&c.PreStartCheck, "prestart-check", c.PreStartCheck,
+		"Check the Bitfusion servers, token and capacity before every container start.")
+	fs.StringVar(&c.CheckpointFile, "checkpoint-file", c.CheckpointFile, "File recording the allocations of the node. Empty disables it.")
+	fs.StringVar(&c.PodResourcesSocket, "pod-resources-socket", c.PodResourcesSocket,
+		"Kubelet pod resources socket the allocations are reconciled with. Defaults to pod-resources/kubelet.sock in the kubelet root.")
+	fs.StringVar(&c.Mode, "mode", c.Mode, "Run the device plugin, the capacity controller or the device plugin against a simulated kubelet, plugin, controller or simulate.")
+	fs.StringVar(&c.NodeName, "node-name", c.NodeName, "Node the device plugin runs on.")
+	fs.StringVar(&c.AssignmentDir, "assignment-dir", c.AssignmentDir,
+		"Mounted ConfigMap of the capacity assigned to each node by the controller. Empty advertises the capacity unassigned.")
+	fs.StringVar(&c.AssignmentConfigMap, "assignment-configmap", c.AssignmentConfigMap,
+		"Namespace/name of the ConfigMap the capacity controller writes.")
+	fs.StringVar(&c.MetricsAddress, "metrics-address", c.MetricsAddress, "Listen address of the /metrics endpoint. Empty disables it.")
+	fs.StringVar(&c.AllocationsAddress, "allocations-address", c.AllocationsAddress,
+		"Listen address of the /allocations endpoint, localhost only by default. Empty disables it.")
+	fs.BoolVar(&c.NodeLabels, "node-labels", c.NodeLabels,
+		"Label the node with the reachability of the Bitfusion servers and the installed Bitfusion clients.")
+	fs.StringVar(&c.FeatureFile, "feature-file", c.FeatureFile,
+		"Node Feature Discovery feature file the Bitfusion features of the node are written to. Empty disables it.")
+}
+
+// loadFile reads the YAML config file
+func (c *config) loadFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("can't parse config file %s: %v ", file, err)
+	}
+	return nil
+}
+
+// loadEnv reads the environment variables set by the DaemonSet
+func (c *config) loadEnv(getenv func(string) string) error {
+	strs := map[string]*string{
+		"SOCKET_NAME":          &c.SocketName,
+		"RESOURCE_NAME":        &c.ResourceName,
+		"CAPACITY_SOURCE":      &c.CapacitySource,
+		"SERVERS_CONF":         &c.ServersConf,
+		"BITFUSION_CA":         &c.CACert,
+		"DEVICE_PLUGIN_DIR":    &c.DevicePluginDir,
+		"KUBELET_ROOT":         &c.KubeletRoot,
+		"HOST_ROOT":            &c.HostRoot,
+		"ALLOCATION_POLICY":    &c.AllocationPolicy,
+		"CDI_SPEC_DIR":         &c.CDISpecDir,
+		"DRA_DRIVER_NAME":      &c.DRADriverName,
+		"METRICS_ADDRESS":      &c.MetricsAddress,
+		"ALLOCATIONS_ADDRESS":  &c.AllocationsAddress,
+		"CHECKPOINT_FILE":      &c.CheckpointFile,
+		"POD_RESOURCES_SOCKET": &c.PodResourcesSocket,
+		"MODE":                 &c.Mode,
+		"NODE_NAME":            &c.NodeName,
+		"ASSIGNMENT_DIR":       &c.AssignmentDir,
+		"ASSIGNMENT_CONFIGMAP": &c.AssignmentConfigMap,
+		"FEATURE_FILE":         &c.FeatureFile,
+	}
+	for env, value := range strs {
+		if v := getenv(env); v != "" {
+			*value = v
+		}
+	}
+
+	ints := map[string]*int{
+		"INTERVAL":      &c.Interval,
+		"RESOURCE_NUMS": &c.ResourceNums,
+	}
+	for env, value := range ints {
+		v := getenv(env)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s=%q is not a number ", env, v)
+		}
+		*value = n
+	}
+
+	bools := map[string]*bool{
+		"PRESTART_CHECK": &c.PreStartCheck,
+		"DRA":            &c.DRA,
+		"NODE_LABELS":    &c.NodeLabels,
+	}
+	for env, value := range bools {
+		v := getenv(env)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s=%q is not a boolean ", env, v)
+		}
+		*value = b
+	}
+
+	if distroPath := getenv("CLIENT_DISTRO_PATH"); distroPath != "" {
+		c.Client = &bfsClient{
+			DistroPath:   distroPath,
+			OptPath:      getenv("CLIENT_OPT_PATH"),
+			LibraryPath:  getenv("CLIENT_LIBRARY_PATH"),
+			ClientConfig: getenv("CLIENT_CONFIG_PATH"),
+			ServersConf:  getenv("CLIENT_SERVERS_CONF"),
+			CACert:       getenv("CLIENT_CA_CERT"),
+		}
+	}
+	return nil
+}
+
+// loadLegacyArgs reads the positional arguments "interval socket-name resource-name resource-nums"
+// of earlier versions, and returns the remaining arguments
+func (c *config) loadLegacyArgs(args []string) ([]string, error) {
+	if len(args) < 4 {
+		return nil, fmt.Errorf("unexpected arguments %q, use flags instead ", args)
+	}
+	interval, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("interval %q is not a number ", args[0])
+	}
+	nums, err := strconv.Atoi(args[3])
+	if err != nil {
+		return nil, fmt.Errorf("resource nums %q is not a number ", args[3])
+	}
+	c.Interval = interval
+	c.SocketName = args[1]
+	c.ResourceName = args[2]
+	c.ResourceNums = nums
+	return args[4:], nil
+}
+
+// validate checks the config and fills in the derived defaults
+func (c *config) validate() error {
+	// Setting servers.conf alone keeps the static capacity, the pool is only queried when asked for
+	if c.CapacitySource == "" {
+		c.CapacitySource = capacityStatic
+	}
+
+	var errs []string
+	names := make(map[string]bool)
+	sockets := make(map[string]bool)
+	for _, res := range c.resources() {
+		if res.SocketName == "" || strings.Contains(res.SocketName, "/") {
+			errs = append(errs, fmt.Sprintf("socket name %q must be a non-empty file name", res.SocketName))
+		} else if sockets[res.SocketName] {
+			errs = append(errs, fmt.Sprintf("socket name %q is used by two resources", res.SocketName))
+		}
+		if !resourceNameRegexp.MatchString(res.ResourceName) {
+			errs = append(errs, fmt.Sprintf("resource name %q must look like bitfusion.io/gpu", res.ResourceName))
+		} else if names[res.ResourceName] {
+			errs = append(errs, fmt.Sprintf("resource name %q is advertised twice", res.ResourceName))
+		}
+		if res.Unit != unitPercent && res.Unit != unitMemoryMB {
+			errs = append(errs, fmt.Sprintf("unit %q of %s must be %s or %s", res.Unit, res.ResourceName, unitPercent, unitMemoryMB))
+		}
+		if res.MemoryChunkMB < 0 {
+			errs = append(errs, fmt.Sprintf("memory chunk %d MB of %s must be positive", res.MemoryChunkMB, res.ResourceName))
+		}
+		if c.CapacitySource == capacityStatic && res.ResourceNums <= 0 {
+			errs = append(errs, fmt.Sprintf("resource nums %d of %s must be positive", res.ResourceNums, res.ResourceName))
+		}
+		names[res.ResourceName] = true
+		sockets[res.SocketName] = true
+	}
+	if c.Interval <= 0 {
+		errs = append(errs, fmt.Sprintf("interval %d must be a positive number of seconds", c.Interval))
+	}
+
+	switch c.CapacitySource {
+	case capacityStatic:
+	case capacityPool:
+		if c.ServersConf == "" {
+			errs = append(errs, "servers conf must be set for the pool capacity source")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("capacity source %q must be %s or %s", c.CapacitySource, capacityStatic, capacityPool))
+	}
+
+	switch c.Mode {
+	case modePlugin:
+		c.resolveKubeletPaths()
+		if info, err := os.Stat(c.DevicePluginDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Sprintf("device plugin dir %q must be an existing directory", c.DevicePluginDir))
+		}
+		if c.AssignmentDir != "" && c.NodeName == "" {
+			errs = append(errs, "node name must be set to read the assigned capacity")
+		}
+		if c.DRA && c.CDISpecDir == "" {
+			errs = append(errs, "CDI spec dir must be set to prepare DRA claims")
+		}
+		// The DRA controller allocates the Bitfusion pool to claims, the devices can't be advertised from it as well
+		if c.DRA && (c.CapacitySource == capacityPool || c.AssignmentDir != "") {
+			errs = append(errs, "DRA claims and the pool or assigned capacity of the device plugin can't share the Bitfusion servers")
+		}
+		if c.NodeLabels && c.NodeName == "" {
+			errs = append(errs, "node name must be set to label the node")
+		}
+	case modeController:
+		if _, _, err := c.assignmentConfigMap(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	case modeSimulate:
+		// The simulated kubelet serves in the device plugin dir, a temporary one if empty
+		if c.DevicePluginDir != "" {
+			if info, err := os.Stat(c.DevicePluginDir); err != nil || !info.IsDir() {
+				errs = append(errs, fmt.Sprintf("device plugin dir %q must be an existing directory", c.DevicePluginDir))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("mode %q must be %s, %s or %s", c.Mode, modePlugin, modeController, modeSimulate))
+	}
+	if _, err := parseAllocationPolicy(c.AllocationPolicy); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if c.Client != nil && c.Client.DistroPath == "" {
+		errs = append(errs, "client distro path must be set to inject the Bitfusion client")
+	}
+	if c.DRA && (c.DRADriverName == "" || strings.Contains(c.DRADriverName, "/")) {
+		errs = append(errs, fmt.Sprintf("DRA driver name %q must be a domain name such as %s", c.DRADriverName, draDriverName))
+	}
+	if c.CDISpecDir != "" && c.Client == nil {
+		errs = append(errs, "client must be set to generate a CDI spec")
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("invalid configuration: %s ", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// loadConfig builds the config from the command line arguments and the environment.
+// Flags in fs other than the config's own, such as the glog flags, are parsed too
+func loadConfig(fs *flag.FlagSet, args []string, getenv func(string) string) (*config, error) {
+	// The first pass only finds the config file, the flags are applied again on top of it
+	var file string
+	first := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	first.SetOutput(ioutil.Discard)
+	first.StringVar(&file, "config", "", "")
+	defaultConfig().bindFlags(first)
+	fs.VisitAll(func(f *flag.Flag) {
+		first.Var(f.Value, f.Name, f.Usage)
+	})
+	if err := first.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+	if file != "" {
+		if err := cfg.loadFile(file); err != nil {
+			return nil, err
+		}
+		cfg.file = file
+	}
+	if err := cfg.loadEnv(getenv); err != nil {
+		return nil, err
+	}
+	// The positional arguments of earlier versions are applied before the flags, so the flags override them
+	var rest []string
+	if first.NArg() != 0 {
+		var err error
+		if rest, err = cfg.loadLegacyArgs(first.Args()); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.String("config", "", "YAML config file of the device plugin.")
+	cfg.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	// The flags after the positional arguments
+	if fs.NArg() != 0 {
+		if err := fs.Parse(rest); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// reloadConfig builds the config again from the arguments and the environment, reading the config file anew.
+// The other flags of flag.CommandLine, such as the glog flags, are accepted as in loadConfig
+func reloadConfig(args []string, getenv func(string) string) (*config, error) {
+	own := flag.NewFlagSet("", flag.ContinueOnError)
+	own.String("config", "", "")
+	defaultConfig().bindFlags(own)
+
+	fs := flag.NewFlagSet(flag.CommandLine.Name(), flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if own.Lookup(f.Name) == nil {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	return loadConfig(fs, args, getenv)
+}
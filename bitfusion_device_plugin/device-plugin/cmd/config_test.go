@@ -0,0 +1,192 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEnv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func testLoadConfig(args []string, env map[string]string) (*config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Bool("logtostderr", false, "")
+	return loadConfig(fs, args, testEnv(env))
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "config.yaml")
+	ioutil.WriteFile(file, []byte(`
+socketName: file.sock
+resourceName: bitfusion.io/file
+interval: 20
+resourceNums: 200
+devicePluginDir: `+dir+`
+client:
+  distroPath: /opt/bitfusion-client
+`), 0644)
+
+	cfg, err := testLoadConfig([]string{"-config", file}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "file.sock", cfg.SocketName)
+	assert.Equal(t, "bitfusion.io/file", cfg.ResourceName)
+	assert.Equal(t, 20, cfg.Interval)
+	assert.Equal(t, 200, cfg.ResourceNums)
+	assert.Equal(t, capacityStatic, cfg.CapacitySource)
+	assert.Equal(t, "/opt/bitfusion-client", cfg.Client.DistroPath)
+	assert.Equal(t, path.Join(dir, "kubelet.sock"), cfg.kubeletSocket())
+
+	// Environment overrides the file, flags override both
+	cfg, err = testLoadConfig([]string{"-config", file, "-interval=5", "-logtostderr=true"},
+		map[string]string{"INTERVAL": "15", "RESOURCE_NUMS": "150", "SERVERS_CONF": "/etc/bitfusion/servers.conf"})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, cfg.Interval)
+	assert.Equal(t, 150, cfg.ResourceNums)
+	// servers.conf alone keeps the static capacity of an existing install
+	assert.Equal(t, capacityStatic, cfg.CapacitySource)
+
+	cfg, err = testLoadConfig([]string{"-config", file},
+		map[string]string{"CAPACITY_SOURCE": "pool", "SERVERS_CONF": "/etc/bitfusion/servers.conf"})
+	assert.Nil(t, err)
+	assert.Equal(t, capacityPool, cfg.CapacitySource)
+}
+
+func TestLoadConfigLegacyArgs(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := testLoadConfig([]string{"-device-plugin-dir", dir, "10", "bitfusion.io", "bitfusion.io/gpu", "1000", "-logtostderr=true"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, cfg.Interval)
+	assert.Equal(t, "bitfusion.io", cfg.SocketName)
+	assert.Equal(t, "bitfusion.io/gpu", cfg.ResourceName)
+	assert.Equal(t, 1000, cfg.ResourceNums)
+
+	// Flags override the positional arguments, before or after them
+	cfg, err = testLoadConfig([]string{"-device-plugin-dir", dir, "-resource-nums=500", "10", "bitfusion.io", "bitfusion.io/gpu", "1000", "-interval=3"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, cfg.ResourceNums)
+	assert.Equal(t, 3, cfg.Interval)
+	assert.Equal(t, "bitfusion.io/gpu", cfg.ResourceName)
+
+	_, err = testLoadConfig([]string{"-device-plugin-dir", dir, "ten", "bitfusion.io", "bitfusion.io/gpu", "1000"}, nil)
+	assert.NotNil(t, err)
+	_, err = testLoadConfig([]string{"-device-plugin-dir", dir, "10"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigResources(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := testLoadConfig([]string{"-device-plugin-dir", dir, "-resource-nums=500"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []resourceConfig{
+		{ResourceName: "bitfusion.io/gpu", SocketName: "bitfusion.io", Unit: unitPercent, ResourceNums: 500},
+	}, cfg.resources())
+
+	file := path.Join(dir, "config.yaml")
+	ioutil.WriteFile(file, []byte(`
+resources:
+- resourceName: bitfusion.io/gpu
+  socketName: gpu.sock
+- resourceName: bitfusion.io/gpu-memory-mb
+  socketName: gpu-memory-mb.sock
+  unit: memory-mb
+  resourceNums: 16384
+- resourceName: bitfusion.io/gpu-memory-gb
+  socketName: gpu-memory-gb.sock
+  unit: memory-mb
+  memoryChunkMB: 1024
+- resourceName: bitfusion.io/pool-a-gpu
+  socketName: pool-a-gpu.sock
+  servers: [10.0.0.1:56001]
+`), 0644)
+	cfg, err = testLoadConfig([]string{"-device-plugin-dir", dir, "-config", file, "-resource-nums=500"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []resourceConfig{
+		{ResourceName: "bitfusion.io/gpu", SocketName: "gpu.sock", Unit: unitPercent, ResourceNums: 500},
+		{ResourceName: "bitfusion.io/gpu-memory-mb", SocketName: "gpu-memory-mb.sock", Unit: unitMemoryMB,
+			MemoryChunkMB: defaultMemoryChunkMB, ResourceNums: 16384},
+		{ResourceName: "bitfusion.io/gpu-memory-gb", SocketName: "gpu-memory-gb.sock", Unit: unitMemoryMB,
+			MemoryChunkMB: 1024, ResourceNums: 500},
+		{ResourceName: "bitfusion.io/pool-a-gpu", SocketName: "pool-a-gpu.sock", Unit: unitPercent,
+			Servers: []string{"10.0.0.1:56001"}, ResourceNums: 500},
+	}, cfg.resources())
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"bad interval env", nil, map[string]string{"INTERVAL": "ten"}, "INTERVAL"},
+		{"zero interval", []string{"-interval=0"}, nil, "interval 0"},
+		{"bad resource name", []string{"-resource-name=gpu"}, nil, "resource name"},
+		{"bad socket name", []string{"-socket-name=a/b"}, nil, "socket name"},
+		{"no devices", []string{"-resource-nums=0"}, nil, "resource nums"},
+		{"pool without servers", []string{"-capacity-source=pool"}, nil, "servers conf"},
+		{"unknown capacity source", []string{"-capacity-source=magic"}, nil, "capacity source"},
+		{"bad policy", []string{"-allocation-policy=random"}, nil, "allocation policy"},
+		{"missing dir", []string{"-device-plugin-dir=" + path.Join(dir, "missing")}, nil, "device plugin dir"},
+		{"unknown config field", []string{"-config=" + path.Join(dir, "bad.yaml")}, nil, "can't parse"},
+		{"unknown mode", []string{"-mode=agent"}, nil, "mode \"agent\""},
+		{"assignment without node", []string{"-assignment-dir=" + dir}, nil, "node name"},
+		{"bad assignment configmap", []string{"-mode=controller", "-assignment-configmap=capacity"}, nil, "namespace/name"},
+		{"duplicate resource", []string{"-config=" + path.Join(dir, "duplicate.yaml")}, nil, "advertised twice"},
+		{"duplicate socket", []string{"-config=" + path.Join(dir, "duplicate.yaml")}, nil, "used by two resources"},
+		{"dra without cdi", []string{"-dra"}, nil, "prepare DRA claims"},
+		{"dra with pool capacity", []string{"-dra", "-capacity-source=pool", "-servers-conf=/etc/bitfusion/servers.conf"}, nil, "can't share"},
+		{"dra with assigned capacity", []string{"-dra", "-node-name=node1", "-assignment-dir=" + dir}, nil, "can't share"},
+		{"bad dra env", nil, map[string]string{"DRA": "maybe"}, "DRA"},
+		{"cdi without client", []string{"-cdi-spec-dir=" + dir}, nil, "CDI spec"},
+		{"unknown unit", []string{"-config=" + path.Join(dir, "unit.yaml")}, nil, "unit \"cores\""},
+		{"node labels without node", nil, map[string]string{"NODE_LABELS": "true"}, "label the node"},
+	}
+	ioutil.WriteFile(path.Join(dir, "bad.yaml"), []byte("resourceNum: 10\n"), 0644)
+	ioutil.WriteFile(path.Join(dir, "duplicate.yaml"), []byte(`
+resources:
+- resourceName: bitfusion.io/gpu
+  socketName: gpu.sock
+- resourceName: bitfusion.io/gpu
+  socketName: gpu.sock
+`), 0644)
+	ioutil.WriteFile(path.Join(dir, "unit.yaml"), []byte(`
+resources:
+- resourceName: bitfusion.io/gpu
+  socketName: gpu.sock
+  unit: cores
+`), 0644)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-device-plugin-dir=" + dir}, tt.args...)
+			_, err := testLoadConfig(args, tt.env)
+			if assert.NotNil(t, err) {
+				assert.True(t, strings.Contains(err.Error(), tt.want), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	yaml "gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// capacityTotal returns the number of devices of a resource the Bitfusion servers provide to the cluster
+type capacityTotal interface {
+	Total() (int, error)
+}
+
+// Total of a static capacity is the configured number of devices
+func (c staticCapacity) Total() (int, error) {
+	return c.nums, nil
+}
+
+// nodeUsage is the devices used on a node running the device plugin
+type nodeUsage struct {
+	// used is the devices requested by the pods of the node per resource
+	used map[string]int
+	// schedulable nodes get a share of the free devices
+	schedulable bool
+}
+
+// capacityController assigns every node a number of devices to advertise,
+// so the devices advertised in the cluster add up to the capacity of the Bitfusion servers.
+// The assignment is stored in a ConfigMap mounted into the device plugin pods
+type capacityController struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	// resources are the resource names in the order of the config
+	resources []string
+	totals    map[string]capacityTotal
+	interval  time.Duration
+}
+
+func newCapacityController(cfg *config, client kubernetes.Interface) (*capacityController, error) {
+	namespace, name, err := cfg.assignmentConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	c := &capacityController{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		totals:    make(map[string]capacityTotal),
+		interval:  time.Duration(cfg.Interval) * time.Second,
+	}
+
+	var status serverStatusClient
+	if cfg.CapacitySource == capacityPool {
+		if status, err = newHTTPStatusClient(cfg.CACert); err != nil {
+			return nil, fmt.Errorf("can't load Bitfusion CA: %v ", err)
+		}
+	}
+	for _, res := range cfg.resources() {
+		c.resources = append(c.resources, res.ResourceName)
+		if status == nil {
+			c.totals[res.ResourceName] = staticCapacity{nums: res.ResourceNums}
+			continue
+		}
+		pool := serverPool{serversConf: cfg.ServersConf, only: res.Servers}
+		total := newPoolCapacity(pool, res.Unit, status, nil)
+		total.memoryChunkMB = res.MemoryChunkMB
+		c.totals[res.ResourceName] = total
+	}
+	return c, nil
+}
+
+// podDevices returns the devices of resource a pod holds while it runs
+func podDevices(pod *v1.Pod, resource v1.ResourceName) int {
+	devices := 0
+	for _, container := range pod.Spec.Containers {
+		devices += int(containerDevices(container, resource))
+	}
+	// Init containers run one by one before the containers
+	for _, container := range pod.Spec.InitContainers {
+		if n := int(containerDevices(container, resource)); n > devices {
+			devices = n
+		}
+	}
+	return devices
+}
+
+// containerDevices returns the devices of resource requested by a container, extended resources are set in the limits
+func containerDevices(container v1.Container, resource v1.ResourceName) int64 {
+	if q, ok := container.Resources.Limits[resource]; ok {
+		return q.Value()
+	}
+	q := container.Resources.Requests[resource]
+	return q.Value()
+}
+
+// usage returns the nodes advertising any of the resources with the devices their pods use
+func (c *capacityController) usage(ctx context.Context) (map[string]*nodeUsage, error) {
+	nodes, err := c.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("can't list nodes: %v ", err)
+	}
+	usage := make(map[string]*nodeUsage)
+	for _, node := range nodes.Items {
+		for _, resource := range c.resources {
+			if _, ok := node.Status.Capacity[v1.ResourceName(resource)]; ok {
+				usage[node.Name] = &nodeUsage{
+					used:        make(map[string]int),
+					schedulable: !node.Spec.Unschedulable && nodeReady(&node),
+				}
+				break
+			}
+		}
+	}
+
+	pods, err := c.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase!=" + string(v1.PodSucceeded) + ",status.phase!=" + string(v1.PodFailed),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't list pods: %v ", err)
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		node, ok := usage[pod.Spec.NodeName]
+		if !ok {
+			continue
+		}
+		for _, resource := range c.resources {
+			node.used[resource] += podDevices(pod, v1.ResourceName(resource))
+		}
+	}
+	return usage, nil
+}
+
+// nodeReady reports whether the Ready condition of the node is true
+func nodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// distribute splits total devices of resource among the nodes.
+// Every node keeps the devices its pods use, the free devices are evenly spread over the schedulable nodes
+func distribute(total int, nodes map[string]*nodeUsage, resource string) map[string]int {
+	names := make([]string, 0, len(nodes))
+	free := total
+	for name, node := range nodes {
+		free -= node.used[resource]
+		if node.schedulable {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	assigned := make(map[string]int)
+	for name, node := range nodes {
+		assigned[name] = node.used[resource]
+	}
+	if free <= 0 || len(names) == 0 {
+		return assigned
+	}
+	for i, name := range names {
+		assigned[name] += free / len(names)
+		if i < free%len(names) {
+			assigned[name]++
+		}
+	}
+	return assigned
+}
+
+// assign returns the devices of every resource assigned to every node
+func (c *capacityController) assign(ctx context.Context) (map[string]map[string]int, error) {
+	usage, err := c.usage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	assignment := make(map[string]map[string]int)
+	for name := range usage {
+		assignment[name] = make(map[string]int)
+	}
+	for _, resource := range c.resources {
+		total, err := c.totals[resource].Total()
+		if err != nil {
+			return nil, fmt.Errorf("can't get the capacity of %s: %v ", resource, err)
+		}
+		for name, devices := range distribute(total, usage, resource) {
+			assignment[name][resource] = devices
+		}
+	}
+	return assignment, nil
+}
+
+// update stores the current assignment in the ConfigMap, one key per node
+func (c *capacityController) update(ctx context.Context) error {
+	assignment, err := c.assign(ctx)
+	if err != nil {
+		return err
+	}
+	data := make(map[string]string)
+	for name, devices := range assignment {
+		value, err := yaml.Marshal(devices)
+		if err != nil {
+			return err
+		}
+		data[name] = string(value)
+	}
+
+	configMaps := c.client.CoreV1().ConfigMaps(c.namespace)
+	cm, err := configMaps.Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: c.name, Namespace: c.namespace},
+			Data:       data,
+		}
+		_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	cm.Data = data
+	_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// sync updates the assignment and records the outcome in the metrics, a failed update keeps the previous assignment
+func (c *capacityController) sync(ctx context.Context) {
+	if err := c.update(ctx); err != nil {
+		assignmentFailures.Inc()
+		glog.Errorf("Can't update the capacity assignment %s/%s, keep the previous one: %v", c.namespace, c.name, err)
+		return
+	}
+	assignmentTimestamp.SetToCurrentTime()
+}
+
+// Run updates the assignment every interval until stop is closed
+func (c *capacityController) Run(stop <-chan struct{}) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		c.sync(ctx)
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// newInClusterClient returns a client of the API server with the service account of the pod
+func newInClusterClient() (kubernetes.Interface, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("can't load in-cluster config: %v ", err)
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// runController runs the capacity controller in the cluster until stop is closed
+func runController(cfg *config, stop <-chan struct{}) error {
+	client, err := newInClusterClient()
+	if err != nil {
+		return err
+	}
+	// The Bitfusion pool is accounted by one controller, the DRA controller replaces the capacity controller
+	if cfg.DRA {
+		dra, err := newDRAController(cfg, client)
+		if err != nil {
+			return err
+		}
+		glog.Infof("DRA controller allocates the claims of %s", dra.driverName)
+		dra.Run(stop)
+		return nil
+	}
+	controller, err := newCapacityController(cfg, client)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Capacity controller assigns %v to the nodes in %s", controller.resources, cfg.AssignmentConfigMap)
+	controller.Run(stop)
+	return nil
+}
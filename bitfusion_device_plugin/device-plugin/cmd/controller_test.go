@@ -0,0 +1,199 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	yaml "gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testNode(name string, ready, unschedulable bool, resources ...string) *v1.Node {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{Unschedulable: unschedulable},
+		Status: v1.NodeStatus{
+			Capacity:   v1.ResourceList{},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}},
+		},
+	}
+	if ready {
+		node.Status.Conditions[0].Status = v1.ConditionTrue
+	}
+	for _, r := range resources {
+		node.Status.Capacity[v1.ResourceName(r)] = resource.MustParse("100")
+	}
+	return node
+}
+
+func testGPUPod(name, node string, phase v1.PodPhase, gpus ...int64) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: node},
+		Status:     v1.PodStatus{Phase: phase},
+	}
+	for _, n := range gpus {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{
+			Resources: v1.ResourceRequirements{
+				Limits: v1.ResourceList{"bitfusion.io/gpu": *resource.NewQuantity(n, resource.DecimalSI)},
+			},
+		})
+	}
+	return pod
+}
+
+func TestDistribute(t *testing.T) {
+	tests := []struct {
+		name  string
+		total int
+		nodes map[string]*nodeUsage
+		want  map[string]int
+	}{
+		{"even", 300, map[string]*nodeUsage{
+			"a": {used: map[string]int{}, schedulable: true},
+			"b": {used: map[string]int{}, schedulable: true},
+			"c": {used: map[string]int{}, schedulable: true},
+		}, map[string]int{"a": 100, "b": 100, "c": 100}},
+		{"used devices stay", 200, map[string]*nodeUsage{
+			"a": {used: map[string]int{"gpu": 50}, schedulable: true},
+			"b": {used: map[string]int{"gpu": 30}, schedulable: false},
+			"c": {used: map[string]int{}, schedulable: true},
+		}, map[string]int{"a": 110, "b": 30, "c": 60}},
+		{"remainder", 5, map[string]*nodeUsage{
+			"a": {used: map[string]int{}, schedulable: true},
+			"b": {used: map[string]int{}, schedulable: true},
+		}, map[string]int{"a": 3, "b": 2}},
+		{"over-committed", 50, map[string]*nodeUsage{
+			"a": {used: map[string]int{"gpu": 40}, schedulable: true},
+			"b": {used: map[string]int{"gpu": 30}, schedulable: true},
+		}, map[string]int{"a": 40, "b": 30}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, distribute(tt.total, tt.nodes, "gpu"))
+		})
+	}
+}
+
+func TestCapacityControllerUpdate(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testNode("node-a", true, false, "bitfusion.io/gpu"),
+		testNode("node-b", true, false, "bitfusion.io/gpu"),
+		testNode("node-c", false, false, "bitfusion.io/gpu"),
+		testNode("cpu-only", true, false),
+		testGPUPod("train", "node-a", v1.PodRunning, 50, 20),
+		testGPUPod("done", "node-b", v1.PodSucceeded, 100),
+		testGPUPod("stuck", "node-c", v1.PodRunning, 10),
+	)
+	controller := &capacityController{
+		client:    client,
+		namespace: "kube-system",
+		name:      "bitfusion-device-plugin-capacity",
+		resources: []string{"bitfusion.io/gpu"},
+		totals:    map[string]capacityTotal{"bitfusion.io/gpu": staticCapacity{nums: 400}},
+	}
+
+	// The fake clientset doesn't filter by field, drop the finished pod like the API server would
+	client.CoreV1().Pods("default").Delete(context.Background(), "done", metav1.DeleteOptions{})
+	assert.Nil(t, controller.update(context.Background()))
+	cm, err := client.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "bitfusion-device-plugin-capacity", metav1.GetOptions{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 3, len(cm.Data))
+	total := 0
+	want := map[string]int{"node-a": 230, "node-b": 160, "node-c": 10}
+	for node, devices := range want {
+		var assignment map[string]int
+		assert.Nil(t, yaml.Unmarshal([]byte(cm.Data[node]), &assignment))
+		assert.Equal(t, devices, assignment["bitfusion.io/gpu"], node)
+		total += assignment["bitfusion.io/gpu"]
+	}
+	assert.Equal(t, 400, total)
+
+	// The existing ConfigMap is updated when the pool grows
+	controller.totals["bitfusion.io/gpu"] = staticCapacity{nums: 600}
+	assert.Nil(t, controller.update(context.Background()))
+	cm, _ = client.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "bitfusion-device-plugin-capacity", metav1.GetOptions{})
+	assert.Equal(t, "bitfusion.io/gpu: 330\n", cm.Data["node-a"])
+}
+
+// failingTotal is a capacityTotal whose Bitfusion servers can't be reached
+type failingTotal struct{}
+
+func (failingTotal) Total() (int, error) {
+	return 0, fmt.Errorf("no Bitfusion server reachable ")
+}
+
+func TestCapacityControllerTotalError(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testNode("node-a", true, false, "bitfusion.io/gpu"),
+		testNode("node-b", true, false, "bitfusion.io/gpu"),
+	)
+	controller := &capacityController{
+		client:    client,
+		namespace: "kube-system",
+		name:      "bitfusion-device-plugin-capacity",
+		resources: []string{"bitfusion.io/gpu"},
+		totals:    map[string]capacityTotal{"bitfusion.io/gpu": staticCapacity{nums: 200}},
+	}
+	controller.sync(context.Background())
+	updated := testutil.ToFloat64(assignmentTimestamp)
+	assert.NotEqual(t, 0.0, updated)
+	before, err := client.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "bitfusion-device-plugin-capacity", metav1.GetOptions{})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// The assignment is left as is and the failure is counted
+	controller.totals["bitfusion.io/gpu"] = failingTotal{}
+	_, err = controller.assign(context.Background())
+	assert.NotNil(t, err)
+	failures := testutil.ToFloat64(assignmentFailures)
+	controller.sync(context.Background())
+	assert.Equal(t, failures+1, testutil.ToFloat64(assignmentFailures))
+	assert.Equal(t, updated, testutil.ToFloat64(assignmentTimestamp))
+	after, _ := client.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "bitfusion-device-plugin-capacity", metav1.GetOptions{})
+	assert.Equal(t, before.Data, after.Data)
+	assert.Equal(t, "bitfusion.io/gpu: 100\n", after.Data["node-a"])
+}
+
+func TestCapacityControllerPoolTotal(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	server := startFakeBitfusionServer(t, serverStatus{GPUs: []gpuStatus{
+		{Index: 0, FreePercent: 20, MemoryTotalMB: 16384, MemoryFreeMB: 4096},
+		{Index: 1, FreePercent: 100, MemoryTotalMB: 16384, MemoryFreeMB: 16384},
+	}})
+	defer server.Close()
+	conf := writeServersConf(t, dir, server.Listener.Addr().String(), "127.0.0.1:1")
+
+	// The total counts the busy shares too, they are held by pods of some node
+	capacity := newPoolCapacity(serverPool{serversConf: conf}, unitPercent, testStatusClient(), nil)
+	total, err := capacity.Total()
+	assert.Nil(t, err)
+	assert.Equal(t, 200, total)
+	capacity.unit = unitMemoryMB
+	total, _ = capacity.Total()
+	assert.Equal(t, 32768, total)
+	capacity.memoryChunkMB = defaultMemoryChunkMB
+	total, _ = capacity.Total()
+	assert.Equal(t, 128, total)
+
+	capacity = newPoolCapacity(serverPool{serversConf: writeServersConf(t, dir, "127.0.0.1:1")}, unitPercent, testStatusClient(), nil)
+	_, err = capacity.Total()
+	assert.NotNil(t, err)
+}
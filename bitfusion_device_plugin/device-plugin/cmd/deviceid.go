@@ -0,0 +1,77 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// serverListEnv lists the Bitfusion servers of the devices allocated to a container
+	serverListEnv = "BITFUSION_SERVER_LIST"
+	// runArgsEnv holds the extra arguments of "bitfusion run" placing the container on its devices,
+	// the command of the webhook includes it
+	runArgsEnv = "BITFUSION_RUN_ARGS"
+)
+
+// deviceIDs returns the device IDs of the slots.
+// A share of a known GPU is <server>/<gpu-index>/<slice>, numbered per GPU so the IDs of a GPU don't move
+// when the capacity of another one changes. Devices not tied to a server are numbered by their index
+func deviceIDs(slots []deviceSlot) []string {
+	ids := make([]string, len(slots))
+	slices := make(map[deviceSlot]int)
+	for i, slot := range slots {
+		if slot.Server == "" {
+			ids[i] = strconv.Itoa(i)
+			continue
+		}
+		ids[i] = fmt.Sprintf("%s/%d/%d", slot.Server, slot.GPU, slices[slot])
+		slices[slot]++
+	}
+	return ids
+}
+
+// parseDeviceID returns the Bitfusion GPU of a device ID, false if the ID isn't tied to a server
+func parseDeviceID(id string) (deviceSlot, bool) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 3 || parts[0] == "" {
+		return deviceSlot{}, false
+	}
+	gpu, err := strconv.Atoi(parts[1])
+	if err != nil || gpu < 0 {
+		return deviceSlot{}, false
+	}
+	if _, err := strconv.Atoi(parts[2]); err != nil {
+		return deviceSlot{}, false
+	}
+	return deviceSlot{Server: parts[0], GPU: gpu}, true
+}
+
+// placementEnvs returns the env making "bitfusion run" use the servers of the allocated devices,
+// nil if no device is tied to a server
+func placementEnvs(slots []deviceSlot) map[string]string {
+	seen := make(map[string]bool)
+	var servers []string
+	for _, slot := range slots {
+		if slot.Server != "" && !seen[slot.Server] {
+			seen[slot.Server] = true
+			servers = append(servers, slot.Server)
+		}
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	sort.Strings(servers)
+	list := strings.Join(servers, ",")
+	return map[string]string{
+		serverListEnv: list,
+		runArgsEnv:    "--server_list " + list,
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fixedCapacity advertises the slots set by the test
+type fixedCapacity []deviceSlot
+
+func (c fixedCapacity) Slots() ([]deviceSlot, error) {
+	return c, nil
+}
+
+func TestDeviceIDs(t *testing.T) {
+	slots := []deviceSlot{
+		{Server: "10.0.0.1:56001", GPU: 0},
+		{Server: "10.0.0.1:56001", GPU: 0},
+		{Server: "10.0.0.1:56001", GPU: 1},
+		{Server: "10.0.0.2:56001", GPU: 0},
+		{GPU: -1},
+	}
+	ids := deviceIDs(slots)
+	assert.Equal(t, []string{
+		"10.0.0.1:56001/0/0",
+		"10.0.0.1:56001/0/1",
+		"10.0.0.1:56001/1/0",
+		"10.0.0.2:56001/0/0",
+		"4",
+	}, ids)
+	for i, id := range ids[:4] {
+		slot, ok := parseDeviceID(id)
+		assert.True(t, ok)
+		assert.Equal(t, slots[i], slot)
+	}
+
+	for _, id := range []string{"4", "10.0.0.1:56001/x/0", "/0/0", "10.0.0.1:56001/0", "10.0.0.1:56001/-1/0"} {
+		_, ok := parseDeviceID(id)
+		assert.False(t, ok, id)
+	}
+}
+
+func TestAllocatePlacement(t *testing.T) {
+	bfs, _ := NewbfsManager(fixedCapacity{
+		{Server: "10.0.0.2:56001", GPU: 0},
+		{Server: "10.0.0.1:56001", GPU: 1},
+		{Server: "10.0.0.1:56001", GPU: 1},
+	}, alwaysHealthy{}, time.Hour)
+	bfs.discoverResources()
+
+	resp, err := bfs.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"10.0.0.1:56001/1/0", "10.0.0.1:56001/1/1"}},
+			{DevicesIDs: []string{"10.0.0.2:56001/0/0", "10.0.0.1:56001/1/1"}},
+			// Devices of an earlier discovery are placed by their ID
+			{DevicesIDs: []string{"10.0.0.3:56001/0/7"}},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		serverListEnv: "10.0.0.1:56001",
+		runArgsEnv:    "--server_list 10.0.0.1:56001",
+	}, resp.ContainerResponses[0].Envs)
+	assert.Equal(t, "10.0.0.1:56001,10.0.0.2:56001", resp.ContainerResponses[1].Envs[serverListEnv])
+	assert.Equal(t, "10.0.0.3:56001", resp.ContainerResponses[2].Envs[serverListEnv])
+
+	// Devices not tied to a server leave the placement to Bitfusion
+	assert.Nil(t, placementEnvs([]deviceSlot{{GPU: -1}}))
+}
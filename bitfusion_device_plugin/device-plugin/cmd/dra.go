@@ -0,0 +1,132 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// draDriverName is the default name of the Dynamic Resource Allocation driver of Bitfusion GPUs
+	draDriverName = "gpu.bitfusion.io"
+
+	// Keys of the ConfigMap a ResourceClaim refers to with its parameters
+	claimAmountKey  = "amount"
+	claimPercentKey = "percent"
+	claimMemoryKey  = "memory"
+	claimFilterKey  = "filter"
+)
+
+// claimParameters are the Bitfusion GPUs requested by a ResourceClaim.
+// They are the resource handle of the allocated claim too
+type claimParameters struct {
+	// Amount is the number of GPUs
+	Amount int `json:"amount"`
+	// Percent of every GPU, 0 if MemoryMB is set
+	Percent int `json:"percent,omitempty"`
+	// MemoryMB of every GPU, 0 if Percent is set
+	MemoryMB int `json:"memoryMB,omitempty"`
+	// Filter selects the Bitfusion servers, such as server.hostname=bf-server
+	Filter []string `json:"filter,omitempty"`
+}
+
+// parseClaimParameters reads the parameters from the data of a ConfigMap.
+// The amount defaults to 1 and the percent to 100, the memory is a quantity such as 8000M like bitfusion.io/gpu-memory
+func parseClaimParameters(data map[string]string) (*claimParameters, error) {
+	params := &claimParameters{Amount: 1}
+	for key := range data {
+		switch key {
+		case claimAmountKey, claimPercentKey, claimMemoryKey, claimFilterKey:
+		default:
+			return nil, fmt.Errorf("unknown claim parameter %q ", key)
+		}
+	}
+
+	var err error
+	if v, ok := data[claimAmountKey]; ok {
+		if params.Amount, err = strconv.Atoi(v); err != nil || params.Amount <= 0 {
+			return nil, fmt.Errorf("amount %q must be a positive number ", v)
+		}
+	}
+	if v, ok := data[claimPercentKey]; ok {
+		if params.Percent, err = strconv.Atoi(v); err != nil || params.Percent <= 0 || params.Percent > 100 {
+			return nil, fmt.Errorf("percent %q must be a number from 1 to 100 ", v)
+		}
+	}
+	if v, ok := data[claimMemoryKey]; ok {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("memory %q is not a quantity: %v ", v, err)
+		}
+		if params.MemoryMB = int(q.Value() / 1000000); params.MemoryMB <= 0 {
+			return nil, fmt.Errorf("memory %q must be at least 1M ", v)
+		}
+	}
+	if params.Percent != 0 && params.MemoryMB != 0 {
+		return nil, fmt.Errorf("percent and memory can't be both set ")
+	}
+	if params.Percent == 0 && params.MemoryMB == 0 {
+		params.Percent = 100
+	}
+	if filter := strings.Fields(data[claimFilterKey]); len(filter) != 0 {
+		params.Filter = filter
+	}
+	return params, nil
+}
+
+// parseResourceHandle reads the parameters the controller stored in the allocation of a claim
+func parseResourceHandle(handle string) (*claimParameters, error) {
+	var params claimParameters
+	if err := json.Unmarshal([]byte(handle), &params); err != nil {
+		return nil, fmt.Errorf("can't parse resource handle %q: %v ", handle, err)
+	}
+	if params.Amount <= 0 || (params.Percent == 0 && params.MemoryMB == 0) {
+		return nil, fmt.Errorf("resource handle %q requests no GPU ", handle)
+	}
+	return &params, nil
+}
+
+// resourceHandle returns the parameters as resource handle data
+func (p *claimParameters) resourceHandle() (string, error) {
+	data, err := json.Marshal(p)
+	return string(data), err
+}
+
+// usage returns the capacity units of unit the claim takes from the pool
+func (p *claimParameters) usage(unit capacityUnit) int {
+	if unit == unitMemoryMB {
+		return p.Amount * p.MemoryMB
+	}
+	return p.Amount * p.Percent
+}
+
+// unit returns the capacity unit the claim is counted in
+func (p *claimParameters) unit() capacityUnit {
+	if p.MemoryMB != 0 {
+		return unitMemoryMB
+	}
+	return unitPercent
+}
+
+// runArgs returns the arguments of "bitfusion run" requesting the GPUs, the same the webhook builds
+func (p *claimParameters) runArgs() string {
+	args := "-n " + strconv.Itoa(p.Amount)
+	if p.MemoryMB != 0 {
+		args += " -m " + strconv.Itoa(p.MemoryMB)
+	} else {
+		args += " -p " + strconv.FormatFloat(float64(p.Percent)/100, 'f', -1, 64)
+	}
+	for _, f := range p.Filter {
+		args += " --filter " + f
+	}
+	return args
+}
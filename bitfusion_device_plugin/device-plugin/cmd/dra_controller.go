@@ -0,0 +1,329 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	resourcev1alpha2 "k8s.io/api/resource/v1alpha2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// draController allocates the ResourceClaims of the ResourceClasses of the DRA driver.
+// Bitfusion GPUs are reached over the network, so a claim is usable on every node,
+// the controller only makes sure the allocated claims fit into the capacity of the Bitfusion servers
+type draController struct {
+	client     kubernetes.Interface
+	driverName string
+	// totals limit the allocated claims counted in each unit, claims of a unit without total are not limited
+	totals   map[capacityUnit]capacityTotal
+	interval time.Duration
+}
+
+func newDRAController(cfg *config, client kubernetes.Interface) (*draController, error) {
+	c := &draController{
+		client:     client,
+		driverName: cfg.DRADriverName,
+		totals:     make(map[capacityUnit]capacityTotal),
+		interval:   time.Duration(cfg.Interval) * time.Second,
+	}
+	if cfg.CapacitySource == capacityPool {
+		status, err := newHTTPStatusClient(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("can't load Bitfusion CA: %v ", err)
+		}
+		for _, unit := range []capacityUnit{unitPercent, unitMemoryMB} {
+			c.totals[unit] = newPoolCapacity(serverPool{serversConf: cfg.ServersConf}, unit, status, nil)
+		}
+	}
+	return c, nil
+}
+
+// finalizer keeps an allocated claim until the controller deallocated it
+func (c *draController) finalizer() string {
+	return c.driverName + "/deletion-protection"
+}
+
+// classes returns the names of the ResourceClasses of the driver
+func (c *draController) classes(ctx context.Context) (map[string]bool, error) {
+	list, err := c.client.ResourceV1alpha2().ResourceClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("can't list resource classes: %v ", err)
+	}
+	classes := make(map[string]bool)
+	for _, class := range list.Items {
+		if class.DriverName == c.driverName {
+			classes[class.Name] = true
+		}
+	}
+	return classes, nil
+}
+
+// claimParameters reads the parameters of a claim from the ConfigMap it refers to
+func (c *draController) claimParameters(ctx context.Context, claim *resourcev1alpha2.ResourceClaim) (*claimParameters, error) {
+	ref := claim.Spec.ParametersRef
+	if ref == nil {
+		return parseClaimParameters(nil)
+	}
+	if ref.APIGroup != "" || ref.Kind != "ConfigMap" {
+		return nil, fmt.Errorf("parameters %s %s must be a ConfigMap ", ref.Kind, ref.Name)
+	}
+	cm, err := c.client.CoreV1().ConfigMaps(claim.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("can't get parameters %s: %v ", ref.Name, err)
+	}
+	return parseClaimParameters(cm.Data)
+}
+
+// allocation returns the parameters the controller stored in an allocated claim, nil if it is not allocated by the driver
+func (c *draController) allocation(claim *resourcev1alpha2.ResourceClaim) (*claimParameters, error) {
+	if claim.Status.Allocation == nil {
+		return nil, nil
+	}
+	for _, handle := range claim.Status.Allocation.ResourceHandles {
+		if handle.DriverName == c.driverName {
+			return parseResourceHandle(handle.Data)
+		}
+	}
+	return nil, fmt.Errorf("claim has no resource handle of %s ", c.driverName)
+}
+
+// podClaimName returns the name of the ResourceClaim of a pod claim, empty if it isn't created yet
+func podClaimName(pod *v1.Pod, podClaim v1.PodResourceClaim) string {
+	if podClaim.Source.ResourceClaimName != nil {
+		return *podClaim.Source.ResourceClaimName
+	}
+	for _, status := range pod.Status.ResourceClaimStatuses {
+		if status.Name == podClaim.Name && status.ResourceClaimName != nil {
+			return *status.ResourceClaimName
+		}
+	}
+	return ""
+}
+
+// scheduleClaims takes part in the delayed allocation of the scheduler for the pending claims of the driver,
+// by their namespace/name. Every node can reach the Bitfusion servers, so it reports no unsuitable node for them
+// in the scheduling context of their pod. It returns the claims of the pods the scheduler selected a node for,
+// claims allocated WaitForFirstConsumer are allocated once their pod is about to be bound
+func (c *draController) scheduleClaims(ctx context.Context, pending map[string]bool) (map[string]bool, error) {
+	contexts, err := c.client.ResourceV1alpha2().PodSchedulingContexts(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("can't list pod scheduling contexts: %v ", err)
+	}
+	selected := make(map[string]bool)
+	for i := range contexts.Items {
+		sc := &contexts.Items[i]
+		// The scheduling context has the name of its pod
+		pod, err := c.client.CoreV1().Pods(sc.Namespace).Get(ctx, sc.Name, metav1.GetOptions{})
+		if err != nil {
+			glog.Warningf("Can't get pod %s/%s of its scheduling context: %v", sc.Namespace, sc.Name, err)
+			continue
+		}
+		var missing []resourcev1alpha2.ResourceClaimSchedulingStatus
+		for _, podClaim := range pod.Spec.ResourceClaims {
+			key := pod.Namespace + "/" + podClaimName(pod, podClaim)
+			if !pending[key] {
+				continue
+			}
+			if sc.Spec.SelectedNode != "" {
+				selected[key] = true
+			}
+			if !hasSchedulingStatus(sc, podClaim.Name) {
+				missing = append(missing, resourcev1alpha2.ResourceClaimSchedulingStatus{Name: podClaim.Name})
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		sc = sc.DeepCopy()
+		sc.Status.ResourceClaims = append(sc.Status.ResourceClaims, missing...)
+		if _, err := c.client.ResourceV1alpha2().PodSchedulingContexts(sc.Namespace).UpdateStatus(ctx, sc, metav1.UpdateOptions{}); err != nil {
+			glog.Errorf("Can't report the suitable nodes of pod %s/%s: %v", sc.Namespace, sc.Name, err)
+		}
+	}
+	return selected, nil
+}
+
+// hasSchedulingStatus reports whether the driver reported the unsuitable nodes of a pod claim
+func hasSchedulingStatus(sc *resourcev1alpha2.PodSchedulingContext, podClaim string) bool {
+	for _, status := range sc.Status.ResourceClaims {
+		if status.Name == podClaim {
+			return true
+		}
+	}
+	return false
+}
+
+// allocate stores the parameters as resource handle of the claim, protected by the finalizer
+func (c *draController) allocate(ctx context.Context, claim *resourcev1alpha2.ResourceClaim, params *claimParameters) error {
+	handle, err := params.resourceHandle()
+	if err != nil {
+		return err
+	}
+	claims := c.client.ResourceV1alpha2().ResourceClaims(claim.Namespace)
+	if !hasFinalizer(claim, c.finalizer()) {
+		claim = claim.DeepCopy()
+		claim.Finalizers = append(claim.Finalizers, c.finalizer())
+		if claim, err = claims.Update(ctx, claim, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	claim.Status.DriverName = c.driverName
+	claim.Status.Allocation = &resourcev1alpha2.AllocationResult{
+		ResourceHandles: []resourcev1alpha2.ResourceHandle{{DriverName: c.driverName, Data: handle}},
+	}
+	_, err = claims.UpdateStatus(ctx, claim, metav1.UpdateOptions{})
+	return err
+}
+
+// deallocate clears the allocation of a claim no pod uses anymore and removes the finalizer
+func (c *draController) deallocate(ctx context.Context, claim *resourcev1alpha2.ResourceClaim) error {
+	claims := c.client.ResourceV1alpha2().ResourceClaims(claim.Namespace)
+	var err error
+	if claim.Status.Allocation != nil || claim.Status.DeallocationRequested {
+		claim = claim.DeepCopy()
+		claim.Status.Allocation = nil
+		claim.Status.DriverName = ""
+		claim.Status.DeallocationRequested = false
+		if claim, err = claims.UpdateStatus(ctx, claim, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	if !hasFinalizer(claim, c.finalizer()) {
+		return nil
+	}
+	claim = claim.DeepCopy()
+	finalizers := claim.Finalizers[:0]
+	for _, f := range claim.Finalizers {
+		if f != c.finalizer() {
+			finalizers = append(finalizers, f)
+		}
+	}
+	claim.Finalizers = finalizers
+	_, err = claims.Update(ctx, claim, metav1.UpdateOptions{})
+	return err
+}
+
+func hasFinalizer(claim *resourcev1alpha2.ResourceClaim, finalizer string) bool {
+	for _, f := range claim.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// sync deallocates the released claims and allocates the pending claims which fit into the capacity,
+// the oldest claims first
+func (c *draController) sync(ctx context.Context) error {
+	classes, err := c.classes(ctx)
+	if err != nil {
+		return err
+	}
+	list, err := c.client.ResourceV1alpha2().ResourceClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("can't list resource claims: %v ", err)
+	}
+
+	used := make(map[capacityUnit]int)
+	var pending []*resourcev1alpha2.ResourceClaim
+	for i := range list.Items {
+		claim := &list.Items[i]
+		if !classes[claim.Spec.ResourceClassName] {
+			continue
+		}
+		released := claim.DeletionTimestamp != nil || claim.Status.DeallocationRequested
+		if released && len(claim.Status.ReservedFor) == 0 {
+			if err := c.deallocate(ctx, claim); err != nil {
+				glog.Errorf("Can't deallocate claim %s/%s: %v", claim.Namespace, claim.Name, err)
+			} else {
+				glog.Infof("Deallocated claim %s/%s", claim.Namespace, claim.Name)
+			}
+			continue
+		}
+		params, err := c.allocation(claim)
+		if err != nil {
+			glog.Errorf("Claim %s/%s: %v", claim.Namespace, claim.Name, err)
+			continue
+		}
+		if params != nil {
+			used[params.unit()] += params.usage(params.unit())
+		} else if !released {
+			pending = append(pending, claim)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	keys := make(map[string]bool)
+	for _, claim := range pending {
+		keys[claim.Namespace+"/"+claim.Name] = true
+	}
+	selected, err := c.scheduleClaims(ctx, keys)
+	if err != nil {
+		return err
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if !pending[i].CreationTimestamp.Equal(&pending[j].CreationTimestamp) {
+			return pending[i].CreationTimestamp.Before(&pending[j].CreationTimestamp)
+		}
+		return pending[i].Namespace+"/"+pending[i].Name < pending[j].Namespace+"/"+pending[j].Name
+	})
+	for _, claim := range pending {
+		key := claim.Namespace + "/" + claim.Name
+		if claim.Spec.AllocationMode != resourcev1alpha2.AllocationModeImmediate && !selected[key] {
+			continue
+		}
+		params, err := c.claimParameters(ctx, claim)
+		if err != nil {
+			glog.Errorf("Can't allocate claim %s: %v", key, err)
+			continue
+		}
+		unit := params.unit()
+		if total, ok := c.totals[unit]; ok {
+			n, err := total.Total()
+			if err != nil {
+				return fmt.Errorf("can't get the capacity of the Bitfusion servers: %v ", err)
+			}
+			if used[unit]+params.usage(unit) > n {
+				glog.Warningf("Claim %s needs %d %s, only %d of %d are free", key, params.usage(unit), unit, n-used[unit], n)
+				continue
+			}
+		}
+		if err := c.allocate(ctx, claim, params); err != nil {
+			glog.Errorf("Can't allocate claim %s: %v", key, err)
+			continue
+		}
+		used[unit] += params.usage(unit)
+		glog.Infof("Allocated claim %s: bitfusion run %s", key, params.runArgs())
+	}
+	return nil
+}
+
+// Run syncs the claims every interval until stop is closed
+func (c *draController) Run(stop <-chan struct{}) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := c.sync(ctx); err != nil {
+			glog.Errorf("Can't sync the claims of %s: %v", c.driverName, err)
+		}
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.interval):
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	resourcev1alpha2 "k8s.io/api/resource/v1alpha2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testClaim is a claim of the bitfusion ResourceClass created age ago
+func testClaim(name, params string, mode resourcev1alpha2.AllocationMode, age time.Duration) *resourcev1alpha2.ResourceClaim {
+	claim := &resourcev1alpha2.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		},
+		Spec: resourcev1alpha2.ResourceClaimSpec{ResourceClassName: "bitfusion", AllocationMode: mode},
+	}
+	if params != "" {
+		claim.Spec.ParametersRef = &resourcev1alpha2.ResourceClaimParametersReference{Kind: "ConfigMap", Name: params}
+	}
+	return claim
+}
+
+func testClaimParameters(name string, data map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}, Data: data}
+}
+
+func getClaim(t *testing.T, client *fake.Clientset, name string) *resourcev1alpha2.ResourceClaim {
+	claim, err := client.ResourceV1alpha2().ResourceClaims("default").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claim
+}
+
+func TestDRAControllerSync(t *testing.T) {
+	claimName := "gpu-train"
+	client := fake.NewSimpleClientset(
+		&resourcev1alpha2.ResourceClass{ObjectMeta: metav1.ObjectMeta{Name: "bitfusion"}, DriverName: "gpu.bitfusion.io"},
+		&resourcev1alpha2.ResourceClass{ObjectMeta: metav1.ObjectMeta{Name: "other"}, DriverName: "gpu.example.com"},
+		testClaimParameters("half", map[string]string{"amount": "2", "percent": "50"}),
+		testClaimParameters("most", map[string]string{"percent": "80"}),
+		testClaimParameters("broken", map[string]string{"percent": "200"}),
+		testClaim("first", "half", resourcev1alpha2.AllocationModeImmediate, 3*time.Minute),
+		testClaim("second", "most", resourcev1alpha2.AllocationModeImmediate, 2*time.Minute),
+		testClaim("small", "", resourcev1alpha2.AllocationModeImmediate, time.Minute),
+		testClaim("bad", "broken", resourcev1alpha2.AllocationModeImmediate, time.Minute),
+		testClaim("gpu-train", "most", resourcev1alpha2.AllocationModeWaitForFirstConsumer, time.Minute),
+		&resourcev1alpha2.PodSchedulingContext{
+			ObjectMeta: metav1.ObjectMeta{Name: "train", Namespace: "default"},
+			Spec:       resourcev1alpha2.PodSchedulingContextSpec{SelectedNode: "node-a"},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "train", Namespace: "default"},
+			Spec:       v1.PodSpec{ResourceClaims: []v1.PodResourceClaim{{Name: "gpu"}}},
+			Status: v1.PodStatus{ResourceClaimStatuses: []v1.PodResourceClaimStatus{
+				{Name: "gpu", ResourceClaimName: &claimName},
+			}},
+		},
+	)
+	controller := &draController{
+		client:     client,
+		driverName: "gpu.bitfusion.io",
+		// Two GPUs
+		totals: map[capacityUnit]capacityTotal{unitPercent: staticCapacity{nums: 200}},
+	}
+	assert.Nil(t, controller.sync(context.Background()))
+
+	// The oldest claims are allocated first, until the pool is full
+	first := getClaim(t, client, "first")
+	if assert.NotNil(t, first.Status.Allocation) {
+		assert.Equal(t, "gpu.bitfusion.io", first.Status.DriverName)
+		assert.Equal(t, []string{"gpu.bitfusion.io/deletion-protection"}, first.Finalizers)
+		params, err := controller.allocation(first)
+		assert.Nil(t, err)
+		assert.Equal(t, &claimParameters{Amount: 2, Percent: 50}, params)
+	}
+	assert.NotNil(t, getClaim(t, client, "second").Status.Allocation)
+	assert.Nil(t, getClaim(t, client, "small").Status.Allocation)
+	assert.Nil(t, getClaim(t, client, "bad").Status.Allocation)
+	assert.Nil(t, getClaim(t, client, "gpu-train").Status.Allocation)
+
+	// A claim no pod reserves is deallocated when deleted, freeing its share
+	now := metav1.Now()
+	first.DeletionTimestamp = &now
+	client.ResourceV1alpha2().ResourceClaims("default").Update(context.Background(), first, metav1.UpdateOptions{})
+	controller.totals[unitPercent] = staticCapacity{nums: 300}
+	assert.Nil(t, controller.sync(context.Background()))
+	first = getClaim(t, client, "first")
+	assert.Nil(t, first.Status.Allocation)
+	assert.Empty(t, first.Finalizers)
+	// The claim of the pod with a selected node is allocated
+	assert.NotNil(t, getClaim(t, client, "gpu-train").Status.Allocation)
+	assert.NotNil(t, getClaim(t, client, "small").Status.Allocation)
+}
+
+func TestDRAControllerDelayedAllocation(t *testing.T) {
+	claimName := "train-gpu"
+	client := fake.NewSimpleClientset(
+		&resourcev1alpha2.ResourceClass{ObjectMeta: metav1.ObjectMeta{Name: "bitfusion"}, DriverName: "gpu.bitfusion.io"},
+		testClaimParameters("half", map[string]string{"percent": "50"}),
+		testClaim(claimName, "half", resourcev1alpha2.AllocationModeWaitForFirstConsumer, time.Minute),
+		&resourcev1alpha2.PodSchedulingContext{
+			ObjectMeta: metav1.ObjectMeta{Name: "train", Namespace: "default"},
+			Spec:       resourcev1alpha2.PodSchedulingContextSpec{PotentialNodes: []string{"node-a", "node-b"}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "train", Namespace: "default"},
+			Spec: v1.PodSpec{ResourceClaims: []v1.PodResourceClaim{
+				{Name: "gpu"},
+				// Claims of other drivers and claims not created yet are left to others
+				{Name: "other"},
+			}},
+			Status: v1.PodStatus{ResourceClaimStatuses: []v1.PodResourceClaimStatus{
+				{Name: "gpu", ResourceClaimName: &claimName},
+			}},
+		},
+	)
+	controller := &draController{
+		client:     client,
+		driverName: "gpu.bitfusion.io",
+		totals:     map[capacityUnit]capacityTotal{unitPercent: staticCapacity{nums: 100}},
+	}
+	getSchedulingContext := func() *resourcev1alpha2.PodSchedulingContext {
+		sc, err := client.ResourceV1alpha2().PodSchedulingContexts("default").Get(context.Background(), "train", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sc
+	}
+
+	// Pending: the scheduler proposed nodes, every one of them is suitable
+	assert.Nil(t, controller.sync(context.Background()))
+	assert.Nil(t, getClaim(t, client, claimName).Status.Allocation)
+	sc := getSchedulingContext()
+	assert.Equal(t, []resourcev1alpha2.ResourceClaimSchedulingStatus{{Name: "gpu"}}, sc.Status.ResourceClaims)
+
+	// The status is reported once
+	assert.Nil(t, controller.sync(context.Background()))
+	assert.Equal(t, 1, len(getSchedulingContext().Status.ResourceClaims))
+
+	// Allocated: the scheduler selected one of the nodes
+	sc.Spec.SelectedNode = "node-b"
+	client.ResourceV1alpha2().PodSchedulingContexts("default").Update(context.Background(), sc, metav1.UpdateOptions{})
+	assert.Nil(t, controller.sync(context.Background()))
+	claim := getClaim(t, client, claimName)
+	if assert.NotNil(t, claim.Status.Allocation) {
+		params, err := controller.allocation(claim)
+		assert.Nil(t, err)
+		assert.Equal(t, &claimParameters{Amount: 1, Percent: 50}, params)
+		// The Bitfusion servers are reachable from every node
+		assert.Nil(t, claim.Status.Allocation.AvailableOnNodes)
+	}
+}
+
+func TestPodClaimName(t *testing.T) {
+	name := "shared"
+	generated := "train-gpu-x7k2p"
+	pod := &v1.Pod{
+		Spec: v1.PodSpec{ResourceClaims: []v1.PodResourceClaim{
+			{Name: "shared", Source: v1.ClaimSource{ResourceClaimName: &name}},
+			{Name: "gpu"},
+			{Name: "pending"},
+		}},
+		Status: v1.PodStatus{ResourceClaimStatuses: []v1.PodResourceClaimStatus{{Name: "gpu", ResourceClaimName: &generated}}},
+	}
+	assert.Equal(t, "shared", podClaimName(pod, pod.Spec.ResourceClaims[0]))
+	assert.Equal(t, generated, podClaimName(pod, pod.Spec.ResourceClaims[1]))
+	assert.Equal(t, "", podClaimName(pod, pod.Spec.ResourceClaims[2]))
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+const (
+	// draPluginVersion is the version of the kubelet plugin API served
+	draPluginVersion = "1.0.0"
+	// draClaimKind is the CDI kind of the prepared claims below the driver name
+	draClaimKind = "claim"
+)
+
+// draPlugin is the kubelet plugin of the Dynamic Resource Allocation driver.
+// It prepares the claims allocated by the DRA controller with a CDI spec giving the container
+// the Bitfusion client and the arguments of "bitfusion run"
+type draPlugin struct {
+	drapb.UnimplementedNodeServer
+	registerapi.UnimplementedRegistrationServer
+
+	driverName string
+	// pluginSocket serves the kubelet plugin API, registrationSocket is found by kubelet in its plugins_registry.
+	// Both are below the host root, endpoint is the plugin socket on the host kubelet dials
+	pluginSocket       string
+	registrationSocket string
+	endpoint           string
+	cdiDir             string
+	client             *bfsClient
+
+	servers []*grpc.Server
+}
+
+func newDRAPlugin(cfg *config) *draPlugin {
+	return &draPlugin{
+		driverName:         cfg.DRADriverName,
+		pluginSocket:       path.Join(cfg.kubeletDir(kubeletPluginsDir), cfg.DRADriverName, "plugin.sock"),
+		registrationSocket: path.Join(cfg.kubeletDir(kubeletPluginsRegistryDir), cfg.DRADriverName+".sock"),
+		endpoint:           path.Join(cfg.KubeletRoot, kubeletPluginsDir, cfg.DRADriverName, "plugin.sock"),
+		cdiDir:             cfg.CDISpecDir,
+		client:             cfg.Client,
+	}
+}
+
+// cdiKind returns the CDI kind of the claims, such as gpu.bitfusion.io/claim
+func (p *draPlugin) cdiKind() string {
+	return p.driverName + "/" + draClaimKind
+}
+
+// specFile returns the path of the CDI spec of a claim
+func (p *draPlugin) specFile(uid string) string {
+	return path.Join(p.cdiDir, strings.Replace(p.cdiKind(), "/", "-", -1)+"_"+cdiDeviceName(uid)+".yaml")
+}
+
+// GetInfo tells kubelet the plugin type, name and endpoint
+func (p *draPlugin) GetInfo(ctx context.Context, req *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DRAPlugin,
+		Name:              p.driverName,
+		Endpoint:          p.endpoint,
+		SupportedVersions: []string{draPluginVersion},
+	}, nil
+}
+
+// NotifyRegistrationStatus is called by kubelet with the result of the registration
+func (p *draPlugin) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	if !status.PluginRegistered {
+		glog.Errorf("DRA plugin %s registration failed: %s", p.driverName, status.Error)
+	} else {
+		glog.Infof("DRA plugin %s registered", p.driverName)
+	}
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
+
+// prepare writes the CDI spec of a claim and returns its CDI device
+func (p *draPlugin) prepare(claim *drapb.Claim) (string, error) {
+	params, err := parseResourceHandle(claim.ResourceHandle)
+	if err != nil {
+		return "", err
+	}
+	name := cdiDeviceName(claim.Uid)
+	spec := &cdiSpec{
+		Version: cdiVersion,
+		Kind:    p.cdiKind(),
+		Devices: []cdiDevice{{
+			Name: name,
+			ContainerEdits: cdiContainerEdits{Env: []string{
+				"BITFUSION_CLAIM=" + claim.Namespace + "/" + claim.Name,
+				runArgsEnv + "=" + params.runArgs(),
+			}},
+		}},
+		ContainerEdits: cdiClientEdits(p.client),
+	}
+	if err := writeCDISpec(p.specFile(claim.Uid), spec); err != nil {
+		return "", err
+	}
+	return p.cdiKind() + "=" + name, nil
+}
+
+// NodePrepareResources prepares the claims of a pod before its containers are created
+func (p *draPlugin) NodePrepareResources(ctx context.Context, req *drapb.NodePrepareResourcesRequest) (*drapb.NodePrepareResourcesResponse, error) {
+	resp := &drapb.NodePrepareResourcesResponse{Claims: make(map[string]*drapb.NodePrepareResourceResponse)}
+	for _, claim := range req.Claims {
+		device, err := p.prepare(claim)
+		if err != nil {
+			glog.Errorf("Can't prepare claim %s/%s: %v", claim.Namespace, claim.Name, err)
+			resp.Claims[claim.Uid] = &drapb.NodePrepareResourceResponse{Error: err.Error()}
+			continue
+		}
+		glog.Infof("Prepared claim %s/%s as %s", claim.Namespace, claim.Name, device)
+		resp.Claims[claim.Uid] = &drapb.NodePrepareResourceResponse{CDIDevices: []string{device}}
+	}
+	return resp, nil
+}
+
+// NodeUnprepareResources removes the CDI specs of the claims when their pod is gone
+func (p *draPlugin) NodeUnprepareResources(ctx context.Context, req *drapb.NodeUnprepareResourcesRequest) (*drapb.NodeUnprepareResourcesResponse, error) {
+	resp := &drapb.NodeUnprepareResourcesResponse{Claims: make(map[string]*drapb.NodeUnprepareResourceResponse)}
+	for _, claim := range req.Claims {
+		resp.Claims[claim.Uid] = &drapb.NodeUnprepareResourceResponse{}
+		if err := os.Remove(p.specFile(claim.Uid)); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Can't unprepare claim %s/%s: %v", claim.Namespace, claim.Name, err)
+			resp.Claims[claim.Uid].Error = err.Error()
+			continue
+		}
+		glog.Infof("Unprepared claim %s/%s", claim.Namespace, claim.Name)
+	}
+	return resp, nil
+}
+
+// serve starts a gRPC server on a fresh socket
+func (p *draPlugin) serve(sock string, register func(*grpc.Server)) error {
+	if err := os.MkdirAll(path.Dir(sock), 0750); err != nil {
+		return err
+	}
+	if err := removeSocket(sock); err != nil {
+		return err
+	}
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		return fmt.Errorf("can't listen on %s: %v ", sock, err)
+	}
+	server := grpc.NewServer()
+	register(server)
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			glog.Errorf("DRA plugin server at %s stopped: %v", sock, err)
+		}
+	}()
+	p.servers = append(p.servers, server)
+	return nil
+}
+
+// Start serves the plugin API, then the registration API kubelet discovers
+func (p *draPlugin) Start() error {
+	if err := p.serve(p.pluginSocket, func(s *grpc.Server) { drapb.RegisterNodeServer(s, p) }); err != nil {
+		return err
+	}
+	if err := p.serve(p.registrationSocket, func(s *grpc.Server) { registerapi.RegisterRegistrationServer(s, p) }); err != nil {
+		p.Stop()
+		return err
+	}
+	glog.Infof("DRA plugin %s serving at %s", p.driverName, p.pluginSocket)
+	return nil
+}
+
+// Stop stops the servers and removes their sockets, kubelet unregisters the plugin when the socket is gone
+func (p *draPlugin) Stop() {
+	for _, server := range p.servers {
+		server.Stop()
+	}
+	p.servers = nil
+	for _, sock := range []string{p.registrationSocket, p.pluginSocket} {
+		if err := removeSocket(sock); err != nil {
+			glog.Error(err)
+		}
+	}
+}
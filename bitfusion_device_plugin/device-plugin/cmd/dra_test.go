@@ -0,0 +1,155 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+func TestParseClaimParameters(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want *claimParameters
+		args string
+	}{
+		{"defaults", nil, &claimParameters{Amount: 1, Percent: 100}, "-n 1 -p 1"},
+		{"percent", map[string]string{"amount": "2", "percent": "50"}, &claimParameters{Amount: 2, Percent: 50}, "-n 2 -p 0.5"},
+		{"memory", map[string]string{"memory": "8000M", "filter": "server.hostname=bf-server  server.addr=192.168.1.1"},
+			&claimParameters{Amount: 1, MemoryMB: 8000, Filter: []string{"server.hostname=bf-server", "server.addr=192.168.1.1"}},
+			"-n 1 -m 8000 --filter server.hostname=bf-server --filter server.addr=192.168.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := parseClaimParameters(tt.data)
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Equal(t, tt.want, params)
+			assert.Equal(t, tt.args, params.runArgs())
+
+			// The handle stored in the claim gives back the parameters
+			handle, err := params.resourceHandle()
+			assert.Nil(t, err)
+			parsed, err := parseResourceHandle(handle)
+			assert.Nil(t, err)
+			assert.Equal(t, params, parsed)
+		})
+	}
+
+	for _, data := range []map[string]string{
+		{"amount": "0"},
+		{"percent": "101"},
+		{"percent": "half"},
+		{"memory": "100k"},
+		{"memory": "8000M", "percent": "50"},
+		{"cores": "2"},
+	} {
+		_, err := parseClaimParameters(data)
+		assert.NotNil(t, err, "%v", data)
+	}
+	_, err := parseResourceHandle(`{"amount": 1}`)
+	assert.NotNil(t, err)
+}
+
+func TestDRAPlugin(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	cfg := defaultConfig()
+	cfg.KubeletRoot = dir
+	cfg.CDISpecDir = path.Join(dir, "cdi")
+	cfg.Client = &bfsClient{DistroPath: "/opt/bitfusion-client"}
+	plugin := newDRAPlugin(cfg)
+	if !assert.Nil(t, plugin.Start()) {
+		return
+	}
+	defer plugin.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Kubelet finds the plugin in its plugins_registry directory
+	conn, err := grpc.DialContext(ctx, "unix://"+path.Join(dir, "plugins_registry", "gpu.bitfusion.io.sock"), grpc.WithInsecure(), grpc.WithBlock())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	info, err := registerapi.NewRegistrationClient(conn).GetInfo(ctx, &registerapi.InfoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, registerapi.DRAPlugin, info.Type)
+	assert.Equal(t, "gpu.bitfusion.io", info.Name)
+	assert.Equal(t, path.Join(dir, "plugins", "gpu.bitfusion.io", "plugin.sock"), info.Endpoint)
+
+	pluginConn, err := grpc.DialContext(ctx, "unix://"+info.Endpoint, grpc.WithInsecure(), grpc.WithBlock())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer pluginConn.Close()
+	node := drapb.NewNodeClient(pluginConn)
+	claims := []*drapb.Claim{
+		{Namespace: "default", Name: "train", Uid: "uid-1", ResourceHandle: `{"amount": 2, "percent": 50}`},
+		{Namespace: "default", Name: "broken", Uid: "uid-2", ResourceHandle: "{"},
+	}
+	prepared, err := node.NodePrepareResources(ctx, &drapb.NodePrepareResourcesRequest{Claims: claims})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"gpu.bitfusion.io/claim=uid-1"}, prepared.Claims["uid-1"].CDIDevices)
+	assert.NotEmpty(t, prepared.Claims["uid-2"].Error)
+
+	spec := readCDISpec(t, path.Join(dir, "cdi", "gpu.bitfusion.io-claim_uid-1.yaml"))
+	assert.Equal(t, "gpu.bitfusion.io/claim", spec.Kind)
+	assert.Equal(t, []string{"BITFUSION_CLAIM=default/train", "BITFUSION_RUN_ARGS=-n 2 -p 0.5"}, spec.Devices[0].ContainerEdits.Env)
+	assert.Equal(t, containerDistroPath, spec.ContainerEdits.Mounts[0].ContainerPath)
+
+	unprepared, err := node.NodeUnprepareResources(ctx, &drapb.NodeUnprepareResourcesRequest{Claims: claims})
+	assert.Nil(t, err)
+	assert.Empty(t, unprepared.Claims["uid-1"].Error)
+	_, err = os.Stat(path.Join(dir, "cdi", "gpu.bitfusion.io-claim_uid-1.yaml"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDRAPluginHostRoot(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	// The host file system is mounted at dir, kubelet runs in /var/lib/kubelet of the host
+	cfg := defaultConfig()
+	cfg.HostRoot = dir
+	cfg.KubeletRoot = "/var/lib/kubelet"
+	cfg.CDISpecDir = path.Join(dir, "cdi")
+	cfg.Client = &bfsClient{DistroPath: "/opt/bitfusion-client"}
+	plugin := newDRAPlugin(cfg)
+	if !assert.Nil(t, plugin.Start()) {
+		return
+	}
+	defer plugin.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "unix://"+path.Join(dir, "var/lib/kubelet/plugins_registry/gpu.bitfusion.io.sock"),
+		grpc.WithInsecure(), grpc.WithBlock())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	info, err := registerapi.NewRegistrationClient(conn).GetInfo(ctx, &registerapi.InfoRequest{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	// Kubelet dials the socket on the host, the plugin listens on it below the host root
+	assert.Equal(t, "/var/lib/kubelet/plugins/gpu.bitfusion.io/plugin.sock", info.Endpoint)
+	_, err = os.Stat(path.Join(dir, info.Endpoint))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// healthChecker reports whether the Bitfusion server pool can serve workloads
+type healthChecker interface {
+	Healthy() bool
+}
+
+// alwaysHealthy is used when no Bitfusion servers are configured
+type alwaysHealthy struct{}
+
+func (alwaysHealthy) Healthy() bool {
+	return true
+}
+
+// poolHealth probes whether any Bitfusion server of the pool is reachable
+type poolHealth struct {
+	pool    serverPool
+	timeout time.Duration
+
+	mu sync.Mutex
+	// missing is set while servers.conf doesn't exist, so it is logged once
+	missing bool
+}
+
+func newPoolHealth(pool serverPool) *poolHealth {
+	return &poolHealth{
+		pool:    pool,
+		timeout: 5 * time.Second,
+	}
+}
+
+func (h *poolHealth) Healthy() bool {
+	addresses, err := h.pool.addresses()
+	// The servers.conf secret is optional, without it the health is unknown and the devices stay healthy
+	if os.IsNotExist(err) {
+		h.mu.Lock()
+		if !h.missing {
+			glog.Warningf("Bitfusion servers.conf not found, the health of the devices is unknown: %v", err)
+		}
+		h.missing = true
+		h.mu.Unlock()
+		return true
+	}
+	h.mu.Lock()
+	h.missing = false
+	h.mu.Unlock()
+	if err != nil {
+		glog.Errorf("Can't load Bitfusion servers: %v", err)
+		return false
+	}
+
+	return len(dialServers(addresses, h.timeout)) != 0
+}
+
+// dialServers returns the TCP connect time of every reachable server by address
+func dialServers(addresses []string, timeout time.Duration) map[string]time.Duration {
+	var mu sync.Mutex
+	rtts := make(map[string]time.Duration)
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", address, timeout)
+			if err != nil {
+				glog.Errorf("Bitfusion server %s unreachable: %v", address, err)
+				return
+			}
+			rtt := time.Since(start)
+			conn.Close()
+			mu.Lock()
+			rtts[address] = rtt
+			mu.Unlock()
+		}(address)
+	}
+	wg.Wait()
+	return rtts
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"os"
+	"path"
+
+	"github.com/golang/glog"
+)
+
+// Paths relative to the kubelet root directory
+const (
+	devicePluginsDir   = "device-plugins"
+	kubeletSocketName  = "kubelet.sock"
+	podResourcesSocket = "pod-resources/kubelet.sock"
+
+	kubeletPluginsDir         = "plugins"
+	kubeletPluginsRegistryDir = "plugins_registry"
+)
+
+// kubeletRoots are the kubelet root directories of common distributions, in the order they are probed
+var kubeletRoots = []struct {
+	distro string
+	dir    string
+}{
+	{"kubernetes", "/var/lib/kubelet"},
+	{"microk8s", "/var/snap/microk8s/common/var/lib/kubelet"},
+	{"k3s", "/var/lib/rancher/k3s/agent/kubelet"},
+	{"rke2", "/var/lib/rancher/rke2/agent/kubelet"},
+}
+
+// detectKubeletRoot returns the kubelet root directory of the host mounted at hostRoot and its distribution.
+// A root with a kubelet registration socket wins over a root with only the device plugin directory,
+// the Kubernetes default is returned if none is found
+func detectKubeletRoot(hostRoot string) (string, string) {
+	for _, root := range kubeletRoots {
+		if _, err := os.Stat(path.Join(hostRoot, root.dir, devicePluginsDir, kubeletSocketName)); err == nil {
+			return root.dir, root.distro
+		}
+	}
+	for _, root := range kubeletRoots {
+		if info, err := os.Stat(path.Join(hostRoot, root.dir, devicePluginsDir)); err == nil && info.IsDir() {
+			return root.dir, root.distro
+		}
+	}
+	return kubeletRoots[0].dir, ""
+}
+
+// resolveKubeletPaths fills in the kubelet root, the device plugin directory and the pod resources socket
+// which are not set, detecting the kubelet root if needed
+func (c *config) resolveKubeletPaths() {
+	if c.KubeletRoot == "" {
+		root, distro := detectKubeletRoot(c.HostRoot)
+		if distro == "" {
+			glog.Warningf("No kubelet root directory found under %q, use %s", c.HostRoot, root)
+		} else {
+			glog.Infof("Detected %s kubelet root directory %s", distro, root)
+		}
+		c.KubeletRoot = root
+	}
+
+	if c.DevicePluginDir == "" {
+		c.DevicePluginDir = c.kubeletDir(devicePluginsDir)
+	}
+	if c.PodResourcesSocket == "" {
+		c.PodResourcesSocket = c.kubeletDir(podResourcesSocket)
+	}
+	glog.Infof("Use kubelet root %s, device plugin dir %s, pod resources socket %s",
+		c.KubeletRoot, c.DevicePluginDir, c.PodResourcesSocket)
+}
+
+// kubeletDir returns the path of a file or directory in the kubelet root
+func (c *config) kubeletDir(name string) string {
+	return path.Join(c.HostRoot, c.KubeletRoot, name)
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makeKubeletRoot creates the device plugin directory of a kubelet root under host, with the registration socket if running
+func makeKubeletRoot(t *testing.T, host, root string, running bool) {
+	dir := path.Join(host, root, devicePluginsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if running {
+		ioutil.WriteFile(path.Join(dir, kubeletSocketName), nil, 0644)
+	}
+}
+
+func TestDetectKubeletRoot(t *testing.T) {
+	tests := []struct {
+		name       string
+		roots      map[string]bool
+		wantRoot   string
+		wantDistro string
+	}{
+		{"nothing", nil, "/var/lib/kubelet", ""},
+		{"kubernetes", map[string]bool{"/var/lib/kubelet": true}, "/var/lib/kubelet", "kubernetes"},
+		{"microk8s", map[string]bool{"/var/snap/microk8s/common/var/lib/kubelet": true}, "/var/snap/microk8s/common/var/lib/kubelet", "microk8s"},
+		{"k3s", map[string]bool{"/var/lib/rancher/k3s/agent/kubelet": true}, "/var/lib/rancher/k3s/agent/kubelet", "k3s"},
+		{"rke2", map[string]bool{"/var/lib/rancher/rke2/agent/kubelet": true}, "/var/lib/rancher/rke2/agent/kubelet", "rke2"},
+		{"running kubelet wins", map[string]bool{
+			"/var/lib/kubelet":                    false,
+			"/var/lib/rancher/rke2/agent/kubelet": true,
+		}, "/var/lib/rancher/rke2/agent/kubelet", "rke2"},
+		{"stale directories", map[string]bool{
+			"/var/lib/rancher/k3s/agent/kubelet":        false,
+			"/var/snap/microk8s/common/var/lib/kubelet": false,
+		}, "/var/snap/microk8s/common/var/lib/kubelet", "microk8s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := tempPluginDir(t)
+			defer os.RemoveAll(host)
+			for root, running := range tt.roots {
+				makeKubeletRoot(t, host, root, running)
+			}
+			root, distro := detectKubeletRoot(host)
+			assert.Equal(t, tt.wantRoot, root)
+			assert.Equal(t, tt.wantDistro, distro)
+		})
+	}
+}
+
+func TestLoadConfigKubeletRoot(t *testing.T) {
+	host := tempPluginDir(t)
+	defer os.RemoveAll(host)
+	makeKubeletRoot(t, host, "/var/lib/rancher/k3s/agent/kubelet", true)
+	makeKubeletRoot(t, host, "/data/kubelet", false)
+
+	cfg, err := testLoadConfig([]string{"-host-root", host}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "/var/lib/rancher/k3s/agent/kubelet", cfg.KubeletRoot)
+	assert.Equal(t, path.Join(host, "/var/lib/rancher/k3s/agent/kubelet/device-plugins"), cfg.DevicePluginDir)
+	assert.Equal(t, path.Join(host, "/var/lib/rancher/k3s/agent/kubelet/device-plugins/kubelet.sock"), cfg.kubeletSocket())
+	assert.Equal(t, path.Join(host, "/var/lib/rancher/k3s/agent/kubelet/pod-resources/kubelet.sock"), cfg.PodResourcesSocket)
+
+	// An explicit root is not detected
+	cfg, err = testLoadConfig([]string{"-host-root", host}, map[string]string{"KUBELET_ROOT": "/data/kubelet"})
+	assert.Nil(t, err)
+	assert.Equal(t, path.Join(host, "/data/kubelet/device-plugins"), cfg.DevicePluginDir)
+
+	// The directories set explicitly are kept
+	cfg, err = testLoadConfig([]string{"-host-root", host, "-device-plugin-dir", path.Join(host, "/data/kubelet/device-plugins"),
+		"-pod-resources-socket", "/run/pod-resources.sock"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "/var/lib/rancher/k3s/agent/kubelet", cfg.KubeletRoot)
+	assert.Equal(t, path.Join(host, "/data/kubelet/device-plugins"), cfg.DevicePluginDir)
+	assert.Equal(t, "/run/pod-resources.sock", cfg.PodResourcesSocket)
+
+	_, err = testLoadConfig([]string{"-host-root", host, "-kubelet-root", "/missing"}, nil)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "device plugin dir")
+	}
+}
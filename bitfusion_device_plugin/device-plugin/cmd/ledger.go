@@ -0,0 +1,229 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// allocationGracePeriod is how long an allocation may be unknown to kubelet before it is freed,
+// kubelet records the devices of a container only after Allocate returns
+const allocationGracePeriod = time.Minute
+
+// allocationReconcileInterval is the time between two reconciliations with kubelet
+const allocationReconcileInterval = time.Minute
+
+// allocationRecord is the devices allocated to one container
+type allocationRecord struct {
+	Resource  string       `json:"resource"`
+	DeviceIDs []string     `json:"deviceIDs"`
+	Slots     []deviceSlot `json:"slots,omitempty"`
+	// Namespace, Pod and Container are filled in once kubelet reports the container holding the devices
+	Namespace   string    `json:"namespace,omitempty"`
+	Pod         string    `json:"pod,omitempty"`
+	Container   string    `json:"container,omitempty"`
+	AllocatedAt time.Time `json:"allocatedAt"`
+}
+
+// key identifies the record by its resource and devices
+func (r *allocationRecord) key() string {
+	return r.Resource + "=" + strings.Join(r.DeviceIDs, ",")
+}
+
+// allocationLedger records the device allocations of the node in a checkpoint file
+type allocationLedger struct {
+	mu      sync.Mutex
+	file    string
+	records []*allocationRecord
+	now     func() time.Time
+}
+
+// checkpoint is the content of the checkpoint file
+type checkpoint struct {
+	Allocations []*allocationRecord `json:"allocations"`
+}
+
+func newLedger(file string) *allocationLedger {
+	return &allocationLedger{file: file, now: time.Now}
+}
+
+// loadLedger reads the checkpoint file, a missing file is an empty ledger
+func loadLedger(file string) (*allocationLedger, error) {
+	l := newLedger(file)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("can't parse checkpoint %s: %v ", file, err)
+	}
+	l.records = cp.Allocations
+	return l, nil
+}
+
+// save writes the records to the checkpoint file atomically, the caller holds mu
+func (l *allocationLedger) save() error {
+	data, err := json.MarshalIndent(checkpoint{Allocations: l.records}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(l.file), 0755); err != nil {
+		return err
+	}
+	tmp := l.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
+
+// record adds the devices allocated to a container, replacing an earlier record of the same devices
+func (l *allocationLedger) record(resource string, ids []string, slots []deviceSlot) error {
+	r := &allocationRecord{
+		Resource:  resource,
+		DeviceIDs: sortedIDs(ids),
+		Slots:     slots,
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.AllocatedAt = l.now()
+	for i, old := range l.records {
+		if old.key() == r.key() {
+			l.records = append(l.records[:i], l.records[i+1:]...)
+			break
+		}
+	}
+	l.records = append(l.records, r)
+	return l.save()
+}
+
+// allocations returns a copy of the records
+func (l *allocationLedger) allocations() []*allocationRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := make([]*allocationRecord, len(l.records))
+	for i, r := range l.records {
+		record := *r
+		records[i] = &record
+	}
+	return records
+}
+
+// reconcile matches the records with the containers kubelet reports for resources.
+// Records kubelet doesn't know after the grace period are freed,
+// containers holding devices the ledger doesn't know are adopted
+func (l *allocationLedger) reconcile(pods []*podresourcesapi.PodResources, resources map[string]bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	byKey := make(map[string]*allocationRecord)
+	for _, r := range l.records {
+		byKey[r.key()] = r
+	}
+	var records []*allocationRecord
+	seen := make(map[string]bool)
+	for _, pod := range pods {
+		for _, container := range pod.Containers {
+			for _, devices := range container.Devices {
+				if !resources[devices.ResourceName] {
+					continue
+				}
+				r := byKey[(&allocationRecord{Resource: devices.ResourceName, DeviceIDs: sortedIDs(devices.DeviceIds)}).key()]
+				if r == nil {
+					glog.Infof("Adopt %s %s held by %s/%s/%s", devices.ResourceName, devices.DeviceIds, pod.Namespace, pod.Name, container.Name)
+					r = &allocationRecord{
+						Resource:    devices.ResourceName,
+						DeviceIDs:   sortedIDs(devices.DeviceIds),
+						AllocatedAt: l.now(),
+					}
+				}
+				if seen[r.key()] {
+					continue
+				}
+				seen[r.key()] = true
+				r.Namespace, r.Pod, r.Container = pod.Namespace, pod.Name, container.Name
+				records = append(records, r)
+			}
+		}
+	}
+	for _, r := range l.records {
+		if seen[r.key()] {
+			continue
+		}
+		if r.Pod == "" && l.now().Sub(r.AllocatedAt) < allocationGracePeriod {
+			records = append(records, r)
+			continue
+		}
+		glog.Infof("Free stale allocation of %s %s to %s/%s/%s", r.Resource, r.DeviceIDs, r.Namespace, r.Pod, r.Container)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].AllocatedAt.Before(records[j].AllocatedAt) })
+	l.records = records
+	return l.save()
+}
+
+// sortedIDs returns a sorted copy of device IDs
+func sortedIDs(ids []string) []string {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// listPodResources returns the resources kubelet assigned to the pods of the node
+func listPodResources(socket string) ([]*podresourcesapi.PodResources, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, socket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to kubelet pod resources service: %v ", err)
+	}
+	defer conn.Close()
+
+	resp, err := podresourcesapi.NewPodResourcesListerClient(conn).List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("can't list pod resources: %v ", err)
+	}
+	return resp.PodResources, nil
+}
+
+// runReconcile reconciles the ledger with kubelet now and then every interval until stop is closed
+func (l *allocationLedger) runReconcile(socket string, resources map[string]bool, interval time.Duration, stop <-chan struct{}) {
+	for {
+		pods, err := listPodResources(socket)
+		if err != nil {
+			glog.Errorf("Can't reconcile allocations: %v", err)
+		} else if err := l.reconcile(pods, resources); err != nil {
+			glog.Errorf("Can't save allocations: %v", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
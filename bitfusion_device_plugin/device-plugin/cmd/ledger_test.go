@@ -0,0 +1,215 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// fakePodResources is a kubelet pod resources service listening on a unix socket
+type fakePodResources struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+
+	mu     sync.Mutex
+	socket string
+	server *grpc.Server
+	pods   []*podresourcesapi.PodResources
+}
+
+func (f *fakePodResources) List(context.Context, *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: f.pods}, nil
+}
+
+func (f *fakePodResources) setPods(pods ...*podresourcesapi.PodResources) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pods = pods
+}
+
+func startFakePodResources(t *testing.T, socket string) *fakePodResources {
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePodResources{socket: socket, server: grpc.NewServer()}
+	podresourcesapi.RegisterPodResourcesListerServer(f.server, f)
+	go f.server.Serve(lis)
+	return f
+}
+
+func (f *fakePodResources) stop() {
+	f.server.Stop()
+	os.Remove(f.socket)
+}
+
+// testPod is a pod with one container holding devices of resource
+func testPod(name, container, resource string, ids ...string) *podresourcesapi.PodResources {
+	return &podresourcesapi.PodResources{
+		Name:      name,
+		Namespace: "default",
+		Containers: []*podresourcesapi.ContainerResources{{
+			Name: container,
+			Devices: []*podresourcesapi.ContainerDevices{{
+				ResourceName: resource,
+				DeviceIds:    ids,
+			}},
+		}},
+	}
+}
+
+func TestLedgerCheckpoint(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "device-plugin", "allocations.json")
+
+	ledger, err := loadLedger(file)
+	assert.Nil(t, err)
+	assert.Empty(t, ledger.allocations())
+	assert.Nil(t, ledger.record("bitfusion.io/gpu", []string{"2", "1"}, []deviceSlot{{Server: "10.0.0.1:56001", GPU: 0}}))
+	assert.Nil(t, ledger.record("bitfusion.io/gpu", []string{"3"}, nil))
+	// The same devices allocated again replace the old record
+	assert.Nil(t, ledger.record("bitfusion.io/gpu", []string{"1", "2"}, nil))
+
+	loaded, err := loadLedger(file)
+	assert.Nil(t, err)
+	records := loaded.allocations()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, []string{"3"}, records[0].DeviceIDs)
+		assert.Equal(t, []string{"1", "2"}, records[1].DeviceIDs)
+		assert.Empty(t, records[1].Slots)
+	}
+
+	ioutil.WriteFile(file, []byte("{"), 0644)
+	_, err = loadLedger(file)
+	assert.NotNil(t, err)
+}
+
+func TestLedgerReconcile(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	ledger := newLedger(path.Join(dir, "allocations.json"))
+	ledger.now = func() time.Time { return now }
+	resources := map[string]bool{"bitfusion.io/gpu": true}
+
+	ledger.record("bitfusion.io/gpu", []string{"0", "1"}, nil)
+	ledger.record("bitfusion.io/gpu", []string{"2"}, nil)
+	ledger.record("bitfusion.io/gpu", []string{"3"}, nil)
+	ledger.record("bitfusion.io/pool-a-gpu", []string{"0"}, nil)
+	pods := []*podresourcesapi.PodResources{
+		testPod("train", "main", "bitfusion.io/gpu", "1", "0"),
+		testPod("infer", "main", "bitfusion.io/gpu", "7"),
+		testPod("other", "main", "nvidia.com/gpu", "GPU-0"),
+	}
+
+	// Records kubelet doesn't know yet are kept during the grace period
+	assert.Nil(t, ledger.reconcile(pods[:1], resources))
+	records := ledger.allocations()
+	assert.Equal(t, 4, len(records))
+	assert.Equal(t, "train", records[0].Pod)
+	assert.Equal(t, "main", records[0].Container)
+
+	now = now.Add(2 * allocationGracePeriod)
+	assert.Nil(t, ledger.reconcile(pods, resources))
+	records = ledger.allocations()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, []string{"0", "1"}, records[0].DeviceIDs)
+		assert.Equal(t, "default", records[0].Namespace)
+		// Containers holding devices the ledger doesn't know are adopted
+		assert.Equal(t, []string{"7"}, records[1].DeviceIDs)
+		assert.Equal(t, "infer", records[1].Pod)
+	}
+
+	// Terminated pods are freed at once
+	assert.Nil(t, ledger.reconcile(pods[1:2], resources))
+	records = ledger.allocations()
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, "infer", records[0].Pod)
+	}
+}
+
+func TestLedgerRunReconcile(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	kubelet := startFakePodResources(t, path.Join(dir, "pod-resources.sock"))
+	defer kubelet.stop()
+	kubelet.setPods(testPod("train", "main", "bitfusion.io/gpu", "4"))
+
+	// The checkpoint of an earlier run is reconciled at startup
+	file := path.Join(dir, "allocations.json")
+	ioutil.WriteFile(file, []byte(`{"allocations": [
+		{"resource": "bitfusion.io/gpu", "deviceIDs": ["4"], "allocatedAt": "2021-03-27T04:26:56Z"},
+		{"resource": "bitfusion.io/gpu", "deviceIDs": ["5"], "pod": "done", "allocatedAt": "2021-03-27T04:26:56Z"}
+	]}`), 0644)
+	ledger, err := loadLedger(file)
+	assert.Nil(t, err)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ledger.runReconcile(kubelet.socket, map[string]bool{"bitfusion.io/gpu": true}, time.Hour, stop)
+		close(done)
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(ledger.allocations()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+
+	loaded, _ := loadLedger(file)
+	records := loaded.allocations()
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, "train", records[0].Pod)
+		assert.Equal(t, []string{"4"}, records[0].DeviceIDs)
+	}
+}
+
+func TestAllocateRecordsLedger(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	bfs, _ := NewbfsManager(staticCapacity{nums: 4}, alwaysHealthy{}, time.Hour)
+	bfs.resourceName = "bitfusion.io/gpu"
+	bfs.ledger = newLedger(path.Join(dir, "allocations.json"))
+	bfs.discoverResources()
+
+	_, err := bfs.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"1", "0"}}, {DevicesIDs: []string{"3"}}},
+	})
+	assert.Nil(t, err)
+
+	server := httptest.NewServer(newAllocationsMux(bfs.ledger))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/allocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var cp checkpoint
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&cp))
+	if assert.Equal(t, 2, len(cp.Allocations)) {
+		assert.Equal(t, "bitfusion.io/gpu", cp.Allocations[0].Resource)
+		assert.Equal(t, []string{"0", "1"}, cp.Allocations[0].DeviceIDs)
+		assert.Equal(t, []string{"3"}, cp.Allocations[1].DeviceIDs)
+	}
+}
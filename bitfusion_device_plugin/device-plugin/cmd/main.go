@@ -13,32 +13,28 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
-	"strconv"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"k8s.io/client-go/kubernetes"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-var socketName string
-var resourceName string
-var interval time.Duration
-var resourceNums string
-
 // Register the device plugin
 func Register(kubeletEndpoint, pluginEndpoint, resourceName string) error {
 	conn, err := grpc.Dial(kubeletEndpoint, grpc.WithInsecure(),
 		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
 			return net.DialTimeout("unix", addr, timeout)
 		}))
-	defer conn.Close()
 	if err != nil {
 		return fmt.Errorf("can't connect to kubelet service: %v ", err)
 	}
+	defer conn.Close()
 	client := pluginapi.NewRegistrationClient(conn)
 	reqt := &pluginapi.RegisterRequest{
 		Version:      pluginapi.Version,
@@ -46,7 +42,9 @@ func Register(kubeletEndpoint, pluginEndpoint, resourceName string) error {
 		ResourceName: resourceName,
 	}
 
-	_, err = client.Register(context.Background(), reqt)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = client.Register(ctx, reqt)
 	if err != nil {
 		return fmt.Errorf("can't register to kubelet service: %v ", err)
 	}
@@ -63,63 +61,198 @@ func ExecCommand(cmdName string, arg ...string) (bytes.Buffer, error) {
 	err := cmd.Run()
 	if err != nil {
 		glog.Info("CMD--" + cmdName + ": " + fmt.Sprint(err) + ": " + stderr.String())
+		return out, fmt.Errorf("%s failed: %v: %s ", cmdName, err, stderr.String())
 	}
 
 	return out, nil
 }
 
-func main() {
-	flag.Parse()
-	glog.Info("Starting main \n")
-	glog.Infof("Args: %s ", os.Args)
-	intervalTemp, _ := strconv.ParseInt(os.Args[1], 10, 64)
-	interval = time.Duration(intervalTemp)
-	socketName = os.Args[2]
-	resourceName = os.Args[3]
-	resourceNums = os.Args[4]
-
-	err := flag.Lookup("logtostderr").Value.Set("true")
+// newManager creates the Bitfusion manager of one resource described by the config
+func newManager(cfg *config, res resourceConfig) (*bfsManager, error) {
+	var capacity capacitySource = staticCapacity{nums: res.ResourceNums}
+	var health healthChecker = alwaysHealthy{}
+	pool := serverPool{serversConf: cfg.ServersConf, only: res.Servers}
+	// The devices are unhealthy while no Bitfusion server is reachable, whatever the capacity source
+	if cfg.ServersConf != "" {
+		health = newPoolHealth(pool)
+	}
+	// Advertise the free capacity of the Bitfusion servers, RESOURCE_NUMS is the fallback
+	if cfg.CapacitySource == capacityPool {
+		client, err := newHTTPStatusClient(cfg.CACert)
+		if err != nil {
+			glog.Errorf("Can't load Bitfusion CA, use static capacity: %v", err)
+		} else {
+			pc := newPoolCapacity(pool, res.Unit, client, capacity)
+			pc.memoryChunkMB = res.MemoryChunkMB
+			capacity = pc
+		}
+	}
+	// Advertise no more than the capacity controller assigned to the node
+	if cfg.AssignmentDir != "" {
+		capacity = &assignedCapacity{
+			capacity:     capacity,
+			file:         path.Join(cfg.AssignmentDir, cfg.NodeName),
+			resourceName: res.ResourceName,
+		}
+	}
 
+	bfs, err := NewbfsManager(capacity, health, time.Duration(cfg.Interval)*time.Second)
 	if err != nil {
-		glog.Error(err)
+		return nil, err
 	}
+	bfs.resourceName = res.ResourceName
+	if bfs.policy, err = parseAllocationPolicy(cfg.AllocationPolicy); err != nil {
+		return nil, err
+	}
+	// Inject the host Bitfusion client for clusters without the mutating webhook
+	if bfs.client = cfg.Client; bfs.client != nil {
+		glog.Infof("Inject Bitfusion client %s into containers allocated %s", bfs.client.DistroPath, res.ResourceName)
+	}
+	// Let the container runtime inject the client from a CDI spec
+	if cfg.CDISpecDir != "" {
+		bfs.cdi = &cdiSpecWriter{dir: cfg.CDISpecDir, kind: res.ResourceName, client: cfg.Client}
+		glog.Infof("Write CDI spec of %s to %s", res.ResourceName, bfs.cdi.specFile())
+	}
+	// Check the Bitfusion servers and token before every container start
+	if cfg.PreStartCheck {
+		caCert, files := cfg.CACert, []string{cfg.ServersConf, cfg.CACert}
+		// The client files are on the host
+		if c := cfg.Client; c != nil {
+			for _, file := range []string{c.ClientConfig, c.ServersConf, c.CACert} {
+				if file != "" {
+					files = append(files, path.Join(cfg.HostRoot, file))
+				}
+			}
+			if caCert == "" && c.CACert != "" {
+				caCert = path.Join(cfg.HostRoot, c.CACert)
+			}
+		}
+		bfs.preStart = newPreStartCheck(caCert, files...)
+		// The secrets of servers.conf and ca.crt are optional in device_plugin.yml
+		bfs.preStart.optional = map[string]bool{cfg.ServersConf: true, cfg.CACert: true}
+	}
+	return bfs, nil
+}
+
+// newServers creates a device plugin server for every resource of the config, recording allocations in ledger if set
+func newServers(cfg *config, ledger *allocationLedger) ([]*bfsServer, error) {
+	var servers []*bfsServer
+	for _, res := range cfg.resources() {
+		bfs, err := newManager(cfg, res)
+		if err != nil {
+			return nil, err
+		}
+		bfs.ledger = ledger
+		glog.Infof("Device Plugin path %s, plugin endpoint %s for %s\n", cfg.DevicePluginDir, res.SocketName, res.ResourceName)
+		servers = append(servers, newBfsServer(bfs, cfg.DevicePluginDir, cfg.kubeletSocket(), res.SocketName, res.ResourceName))
+	}
+	return servers, nil
+}
 
-	bfs, err := NewbfsManager()
+func main() {
+	err := flag.Lookup("logtostderr").Value.Set("true")
 	if err != nil {
-		glog.Fatal(err)
+		glog.Error(err)
 	}
 
-	pluginEndpoint := socketName
-	_, err = ExecCommand("rm", "-rf", path.Join(pluginapi.DevicePluginPath, pluginEndpoint))
+	glog.Info("Starting main \n")
+	glog.Infof("Args: %s ", os.Args)
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:], os.Getenv)
 	if err != nil {
-		glog.Fatal(err)
+		glog.Exit(err)
 	}
-	var wg sync.WaitGroup
-	wg.Add(1)
-	ch := make(chan int)
-	// Starts device plugin service.
+	glog.Infof("Config: %+v", *cfg)
+
+	// Stop the servers and remove their sockets when the DaemonSet pod is terminated
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
-		defer wg.Done()
-		glog.Infof("Device Plugin path %s, plugin endpoint %s\n", pluginapi.DevicePluginPath, pluginEndpoint)
-		glog.Infof("Device Plugin start server at: %s\n", path.Join(pluginapi.DevicePluginPath, pluginEndpoint))
-		lis, err := net.Listen("unix", path.Join(pluginapi.DevicePluginPath, pluginEndpoint))
-		if err != nil {
+		sig := <-signals
+		glog.Infof("Received %s, shutting down", sig)
+		close(stop)
+	}()
+
+	if cfg.Mode == modeController {
+		serveMetrics(cfg.MetricsAddress, nil)
+		if err := runController(cfg, stop); err != nil {
 			glog.Fatal(err)
-			return
 		}
-		grpcServer := grpc.NewServer()
-		pluginapi.RegisterDevicePluginServer(grpcServer, bfs)
-		close(ch)
-		if err := grpcServer.Serve(lis); err != nil {
+		glog.Info("Capacity controller stopped")
+		glog.Flush()
+		return
+	}
+	if cfg.Mode == modeSimulate {
+		if err := runSimulation(cfg, stop); err != nil {
 			glog.Fatal(err)
 		}
+		glog.Info("Simulation stopped")
+		glog.Flush()
+		return
+	}
+
+	// A broken checkpoint only loses the allocation history, the devices are still served
+	var ledger *allocationLedger
+	if cfg.CheckpointFile != "" {
+		if ledger, err = loadLedger(cfg.CheckpointFile); err != nil {
+			glog.Errorf("Can't load allocations, start with an empty checkpoint: %v", err)
+			ledger = newLedger(cfg.CheckpointFile)
+		}
+	}
+	plugin := newPluginServers(cfg, ledger)
+	serveMetrics(cfg.MetricsAddress, plugin.servers)
+	serveAllocations(cfg.AllocationsAddress, ledger)
+	if ledger != nil {
+		resources := make(map[string]bool)
+		for _, res := range cfg.resources() {
+			resources[res.ResourceName] = true
+		}
+		go ledger.runReconcile(cfg.PodResourcesSocket, resources, allocationReconcileInterval, stop)
+	}
+
+	// The DRA kubelet plugin serves claims alongside the device plugin resources
+	if cfg.DRA {
+		dra := newDRAPlugin(cfg)
+		if err := dra.Start(); err != nil {
+			glog.Fatal(err)
+		}
+		defer dra.Stop()
+	}
+
+	// Publish the Bitfusion features of the node for the scheduler and Node Feature Discovery
+	if cfg.NodeLabels || cfg.FeatureFile != "" {
+		var client kubernetes.Interface
+		if cfg.NodeLabels {
+			if client, err = newInClusterClient(); err != nil {
+				glog.Fatal(err)
+			}
+		}
+		go newNodeLabeler(cfg, client).Run(stop)
+	}
+
+	// Apply the config again on SIGHUP or when the config file changes
+	reload := make(chan struct{}, 1)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			glog.Info("Received SIGHUP, reloading configuration")
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
 	}()
-	<-ch
-	// Register to Kubelet.
-	err = Register(pluginapi.KubeletSocket, pluginEndpoint, resourceName)
-	if err != nil {
+	if cfg.file != "" {
+		if err := watchConfigFile(cfg.file, reload, stop); err != nil {
+			glog.Errorf("Can't watch config file, reload it with SIGHUP: %v", err)
+		}
+	}
+	load := func() (*config, error) { return reloadConfig(os.Args[1:], os.Getenv) }
+
+	if err := plugin.run(load, reload, stop); err != nil {
 		glog.Fatal(err)
 	}
-	glog.Info("Device Plugin registered\n")
-	wg.Wait()
+	glog.Info("Device Plugin stopped")
+	glog.Flush()
 }
@@ -7,7 +7,10 @@
 package main
 
 import (
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -18,17 +21,28 @@ func TestExecCommand(t *testing.T) {
 	t.Log(out)
 	t.Log(err)
 	assert.Equal(t, err, nil)
+
+	_, err = ExecCommand("ls", "/nonexistent")
+	assert.NotNil(t, err)
 }
 
 func TestNewbfsManager(t *testing.T) {
-	bfs, err := NewbfsManager()
+	bfs, err := NewbfsManager(staticCapacity{nums: 10}, alwaysHealthy{}, time.Second)
 	t.Log(bfs)
 	t.Log(err)
 	assert.Equal(t, err, nil)
 }
 
 func TestRegister(t *testing.T) {
-	err := Register(pluginapi.KubeletSocket, "test", "test.io")
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	kubelet := startFakeKubelet(t, path.Join(dir, "kubelet.sock"))
+	defer kubelet.stop()
+
+	err := Register(kubelet.socket, "test", "test.io")
 	t.Log(err)
 	assert.Equal(t, err, nil)
+	r := kubelet.waitRegister(t)
+	assert.Equal(t, r.Version, pluginapi.Version)
+	assert.Equal(t, r.ResourceName, "test.io")
 }
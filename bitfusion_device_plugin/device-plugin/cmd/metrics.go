@@ -0,0 +1,167 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "bitfusion_device_plugin"
+
+// Metrics of the device plugin, labeled by the extended resource
+var (
+	advertisedDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "advertised_devices",
+		Help:      "Number of devices advertised to kubelet.",
+	}, []string{"resource"})
+	healthyDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "healthy_devices",
+		Help:      "Number of advertised devices which are healthy.",
+	}, []string{"resource"})
+	allocateRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "allocate_requests_total",
+		Help:      "Number of Allocate calls from kubelet.",
+	}, []string{"resource"})
+	allocateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "allocate_duration_seconds",
+		Help:      "Latency of Allocate calls.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"resource"})
+	registrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_total",
+		Help:      "Number of attempts to register with kubelet.",
+	}, []string{"resource"})
+	registrationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registration_failures_total",
+		Help:      "Number of failed attempts to register with kubelet.",
+	}, []string{"resource"})
+	listAndWatchReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "list_and_watch_reconnects_total",
+		Help:      "Number of ListAndWatch streams opened by kubelet after the first one.",
+	}, []string{"resource"})
+
+	// Metrics of the capacity controller, the assignment is stale while the updates fail
+	assignmentFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "capacity_assignment_failures_total",
+		Help:      "Number of failed updates of the capacity assignment, the previous assignment is kept.",
+	})
+	assignmentTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "capacity_assignment_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful update of the capacity assignment.",
+	})
+
+	// serverRTT is measured by the node labeler
+	serverRTT = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_rtt_seconds",
+		Help:      "Lowest connect time to a Bitfusion server, +Inf while no server is reachable.",
+	})
+)
+
+// metricsRegistry holds the device plugin metrics and the Go runtime and process metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		advertisedDevices,
+		healthyDevices,
+		allocateRequests,
+		allocateDuration,
+		registrations,
+		registrationFailures,
+		listAndWatchReconnects,
+		assignmentFailures,
+		assignmentTimestamp,
+		serverRTT,
+	)
+}
+
+// newMetricsMux returns the handler of the HTTP endpoints of the device plugin.
+// /healthz and /readyz probe the servers returned by servers at the time of the probe,
+// they always succeed without servers such as in controller mode
+func newMetricsMux(servers func() []*bfsServer) *http.ServeMux {
+	if servers == nil {
+		servers = func() []*bfsServer { return nil }
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", probeHandler(func() error { return serversHealthy(servers()) }))
+	mux.HandleFunc("/readyz", probeHandler(func() error { return serversReady(servers()) }))
+	return mux
+}
+
+// newAllocationsMux returns the handler of /allocations listing the allocations of ledger.
+// It tells which pod holds which Bitfusion share, so it is served apart from the metrics
+func newAllocationsMux(ledger *allocationLedger) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/allocations", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(checkpoint{Allocations: ledger.allocations()}); err != nil {
+			glog.Errorf("Can't write allocations: %v", err)
+		}
+	})
+	return mux
+}
+
+// probeHandler answers 200 ok if check succeeds, 503 with the error otherwise
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			glog.Warningf("%s failed: %v", r.URL.Path, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// serveMetrics serves the HTTP endpoints on address in the background, an empty address disables it
+func serveMetrics(address string, servers func() []*bfsServer) {
+	serveHTTP("metrics", address, newMetricsMux(servers))
+}
+
+// serveAllocations serves /allocations of ledger on address in the background,
+// an empty address or no ledger disables it
+func serveAllocations(address string, ledger *allocationLedger) {
+	if ledger == nil {
+		return
+	}
+	serveHTTP("allocations", address, newAllocationsMux(ledger))
+}
+
+// serveHTTP serves handler on address in the background, an empty address disables it
+func serveHTTP(name, address string, handler http.Handler) {
+	if address == "" {
+		return
+	}
+	glog.Infof("Serving %s at %s", name, address)
+	go func() {
+		if err := http.ListenAndServe(address, handler); err != nil {
+			glog.Errorf("The %s server at %s stopped: %v", name, address, err)
+		}
+	}()
+}
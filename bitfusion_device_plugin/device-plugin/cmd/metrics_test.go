@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestManagerMetrics(t *testing.T) {
+	resource := "bitfusion.io/metrics-test"
+	health := &fakeHealth{}
+	bfs, _ := NewbfsManager(staticCapacity{nums: 5}, health, time.Hour)
+	bfs.resourceName = resource
+
+	bfs.discoverResources()
+	assert.Equal(t, 5.0, testutil.ToFloat64(advertisedDevices.WithLabelValues(resource)))
+	assert.Equal(t, 5.0, testutil.ToFloat64(healthyDevices.WithLabelValues(resource)))
+	health.set(false)
+	bfs.discoverResources()
+	assert.Equal(t, 5.0, testutil.ToFloat64(advertisedDevices.WithLabelValues(resource)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(healthyDevices.WithLabelValues(resource)))
+
+	allocated := testutil.ToFloat64(allocateRequests.WithLabelValues(resource))
+	bfs.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"0"}}},
+	})
+	assert.Equal(t, allocated+1, testutil.ToFloat64(allocateRequests.WithLabelValues(resource)))
+
+	// Only the streams after the first one are reconnects
+	reconnects := testutil.ToFloat64(listAndWatchReconnects.WithLabelValues(resource))
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		bfs.ListAndWatch(&pluginapi.Empty{}, newFakeListAndWatchStream(ctx))
+	}
+	assert.Equal(t, reconnects+2, testutil.ToFloat64(listAndWatchReconnects.WithLabelValues(resource)))
+}
+
+func TestRegistrationMetrics(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	resource := "bitfusion.io/registration-test"
+
+	bfs, _ := NewbfsManager(staticCapacity{nums: 1}, alwaysHealthy{}, time.Hour)
+	server := newBfsServer(bfs, dir, path.Join(dir, "kubelet.sock"), "bitfusion.sock", resource)
+	server.backoffInitial = time.Millisecond
+	server.backoffMax = time.Millisecond
+	stop := make(chan struct{})
+	done := make(chan bool)
+	go func() { done <- server.register(stop) }()
+
+	// Kubelet is not running, so every attempt fails
+	failures := testutil.ToFloat64(registrationFailures.WithLabelValues(resource))
+	for testutil.ToFloat64(registrationFailures.WithLabelValues(resource)) < failures+2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	assert.False(t, <-done)
+	assert.Equal(t, testutil.ToFloat64(registrations.WithLabelValues(resource)),
+		testutil.ToFloat64(registrationFailures.WithLabelValues(resource)))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	bfs, _ := NewbfsManager(staticCapacity{nums: 3}, alwaysHealthy{}, time.Hour)
+	bfs.resourceName = "bitfusion.io/endpoint-test"
+	bfs.discoverResources()
+
+	server := httptest.NewServer(newMetricsMux(nil))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.True(t, strings.Contains(string(body),
+		`bitfusion_device_plugin_advertised_devices{resource="bitfusion.io/endpoint-test"} 3`), string(body))
+	assert.True(t, strings.Contains(string(body), "go_goroutines"))
+
+	// The allocations aren't served on the metrics port
+	resp, err = server.Client().Get(server.URL + "/allocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
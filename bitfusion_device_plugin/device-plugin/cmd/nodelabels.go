@@ -0,0 +1,296 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// reachableLabel is true if a Bitfusion server answers the node
+	reachableLabel = "bitfusion.io/reachable"
+	// clientLabelPrefix labels the Bitfusion clients installed on the node, such as bitfusion.io/client-ubuntu18-450
+	clientLabelPrefix = "bitfusion.io/client-"
+	// serverRTTAnnotation is the lowest connect time to a Bitfusion server in milliseconds, rounded up to a bucket
+	serverRTTAnnotation = "bitfusion.io/server-rtt-ms"
+	// clientVersionsAnnotation lists the Bitfusion clients installed on the node
+	clientVersionsAnnotation = "bitfusion.io/client-versions"
+)
+
+// rttBuckets are the milliseconds the RTT annotation is rounded up to, so the node is only patched when the RTT
+// changes noticeably. The exact RTT is in the feature file and the metrics
+var rttBuckets = []int64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// rttBucket returns the bucket of an RTT in milliseconds, the last bucket holds every longer RTT
+func rttBucket(rtt time.Duration) int64 {
+	ms := int64((rtt + time.Millisecond - 1) / time.Millisecond)
+	for _, bucket := range rttBuckets {
+		if ms <= bucket {
+			return bucket
+		}
+	}
+	return rttBuckets[len(rttBuckets)-1]
+}
+
+// clientDistroRegexp matches the directory of a Bitfusion client distro, such as
+// bitfusion-client-ubuntu1804_4.5.0-4_amd64.deb or bitfusion-client-centos7-4.5.0-4.x86_64.rpm
+var clientDistroRegexp = regexp.MustCompile(`^bitfusion-client-([a-z]+)([0-9]+)[-_]([0-9]+)\.([0-9]+)\.([0-9]+)`)
+
+// nodeFeatures are the Bitfusion features of a node
+type nodeFeatures struct {
+	// servers is false if no Bitfusion server is configured, the node isn't labeled reachable or not then
+	servers   bool
+	reachable bool
+	// rtt is the lowest connect time to a reachable server
+	rtt time.Duration
+	// clients are the installed Bitfusion clients as <os>-<version>, the values of the
+	// bitfusion-client/os and bitfusion-client/version annotations of the webhook
+	clients []string
+}
+
+// labels returns the node labels of the features
+func (f *nodeFeatures) labels() map[string]string {
+	labels := make(map[string]string)
+	if f.servers {
+		labels[reachableLabel] = strconv.FormatBool(f.reachable)
+	}
+	for _, client := range f.clients {
+		labels[clientLabelPrefix+client] = "true"
+	}
+	return labels
+}
+
+// annotations returns the node annotations of the features
+func (f *nodeFeatures) annotations() map[string]string {
+	annotations := make(map[string]string)
+	if f.reachable {
+		annotations[serverRTTAnnotation] = strconv.FormatInt(rttBucket(f.rtt), 10)
+	}
+	if len(f.clients) != 0 {
+		annotations[clientVersionsAnnotation] = strings.Join(f.clients, ",")
+	}
+	return annotations
+}
+
+// featureFile returns the features in the feature file format of Node Feature Discovery, one <label>=<value> per line
+func (f *nodeFeatures) featureFile() []byte {
+	labels := f.labels()
+	if f.reachable {
+		labels[serverRTTAnnotation] = strconv.FormatInt(f.rtt.Milliseconds(), 10)
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%s\n", name, labels[name])
+	}
+	return []byte(b.String())
+}
+
+// clientVersion returns the <os>-<version> of a client distro directory, such as ubuntu18-450
+func clientVersion(name string) (string, bool) {
+	m := clientDistroRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	distro, release := m[1], m[2]
+	// ubuntu1804 is ubuntu18 to the webhook
+	if distro == "ubuntu" && len(release) == 4 {
+		release = release[:2]
+	}
+	return distro + release + "-" + m[3] + m[4] + m[5], true
+}
+
+// clientVersions returns the sorted versions of the client distros in dir
+func clientVersions(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var versions []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if v, ok := clientVersion(entry.Name()); ok && !seen[v] {
+			seen[v] = true
+			versions = append(versions, v)
+		}
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// nodeLabeler publishes the features of the node as node labels and annotations, and as a feature file
+type nodeLabeler struct {
+	// client patches the node if set
+	client   kubernetes.Interface
+	nodeName string
+	// featureFile is written if set
+	featureFile string
+	// serversConf lists the Bitfusion servers, empty if none are configured
+	serversConf string
+	// clientDir holds the Bitfusion client distros, empty if no client is installed
+	clientDir string
+	timeout   time.Duration
+	interval  time.Duration
+}
+
+func newNodeLabeler(cfg *config, client kubernetes.Interface) *nodeLabeler {
+	l := &nodeLabeler{
+		client:      client,
+		nodeName:    cfg.NodeName,
+		featureFile: cfg.FeatureFile,
+		serversConf: cfg.ServersConf,
+		timeout:     5 * time.Second,
+		interval:    time.Duration(cfg.Interval) * time.Second,
+	}
+	// The client distros are on the host
+	if cfg.Client != nil {
+		l.clientDir = path.Join(cfg.HostRoot, cfg.Client.DistroPath)
+	}
+	return l
+}
+
+// features probes the Bitfusion servers and lists the installed clients
+func (l *nodeLabeler) features() *nodeFeatures {
+	f := &nodeFeatures{}
+	if l.serversConf != "" {
+		f.servers = true
+		addresses, err := serverPool{serversConf: l.serversConf}.addresses()
+		if err != nil {
+			glog.Errorf("Can't load Bitfusion servers: %v", err)
+		}
+		for _, rtt := range dialServers(addresses, l.timeout) {
+			if !f.reachable || rtt < f.rtt {
+				f.rtt = rtt
+			}
+			f.reachable = true
+		}
+	}
+	if l.clientDir != "" {
+		clients, err := clientVersions(l.clientDir)
+		if err != nil {
+			glog.Errorf("Can't list Bitfusion clients: %v", err)
+		}
+		f.clients = clients
+	}
+	return f
+}
+
+// sync publishes the current features of the node
+func (l *nodeLabeler) sync(ctx context.Context) error {
+	f := l.features()
+	if f.reachable {
+		serverRTT.Set(f.rtt.Seconds())
+	} else if f.servers {
+		serverRTT.Set(math.Inf(1))
+	}
+	if l.featureFile != "" {
+		if err := writeFeatureFile(l.featureFile, f.featureFile()); err != nil {
+			return err
+		}
+	}
+	if l.client != nil {
+		return l.patchNode(ctx, f)
+	}
+	return nil
+}
+
+// patchNode sets the labels and annotations of the features on the node and removes the stale ones
+func (l *nodeLabeler) patchNode(ctx context.Context, f *nodeFeatures) error {
+	node, err := l.client.CoreV1().Nodes().Get(ctx, l.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("can't get node %s: %v ", l.nodeName, err)
+	}
+	owned := func(key string) bool {
+		return key == reachableLabel || strings.HasPrefix(key, clientLabelPrefix) ||
+			key == serverRTTAnnotation || key == clientVersionsAnnotation
+	}
+	changes := func(current, wanted map[string]string) map[string]interface{} {
+		patch := make(map[string]interface{})
+		for key, value := range wanted {
+			if current[key] != value {
+				patch[key] = value
+			}
+		}
+		for key := range current {
+			if _, ok := wanted[key]; !ok && owned(key) {
+				patch[key] = nil
+			}
+		}
+		return patch
+	}
+	labels := changes(node.Labels, f.labels())
+	annotations := changes(node.Annotations, f.annotations())
+	if len(labels) == 0 && len(annotations) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels, "annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := l.client.CoreV1().Nodes().Patch(ctx, l.nodeName, types.MergePatchType, data, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("can't label node %s: %v ", l.nodeName, err)
+	}
+	glog.Infof("Labeled node %s: %s", l.nodeName, data)
+	return nil
+}
+
+// writeFeatureFile replaces the feature file atomically.
+// The temporary file is hidden, Node Feature Discovery ignores it
+func writeFeatureFile(file string, data []byte) error {
+	dir := path.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := path.Join(dir, "."+path.Base(file)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("can't write feature file %s: %v ", file, err)
+	}
+	return nil
+}
+
+// Run publishes the features every interval until stop is closed
+func (l *nodeLabeler) Run(stop <-chan struct{}) {
+	for {
+		if err := l.sync(context.Background()); err != nil {
+			glog.Errorf("Can't publish node features: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(l.interval):
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestClientVersion(t *testing.T) {
+	for name, want := range map[string]string{
+		"bitfusion-client-ubuntu1804_4.5.0-4_amd64.deb":  "ubuntu18-450",
+		"bitfusion-client-ubuntu2004_2.5.1-13":           "ubuntu20-251",
+		"bitfusion-client-centos7-4.0.1-5.x86_64.rpm":    "centos7-401",
+		"bitfusion-client-centos8-4.5.0-4.x86_64.rpm":    "centos8-450",
+		"bitfusion-client-ubuntu1604-2.5.0-10_amd64.deb": "ubuntu16-250",
+	} {
+		v, ok := clientVersion(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, want, v, name)
+	}
+	for _, name := range []string{"bitfusion-client", "opt", "bitfusion-client-ubuntu1804"} {
+		_, ok := clientVersion(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestNodeLabelerSync(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+
+	// The client distros are found below the host root
+	host := path.Join(dir, "host")
+	for _, distro := range []string{
+		"bitfusion-client-ubuntu1804_4.5.0-4_amd64.deb",
+		"bitfusion-client-centos7-4.5.0-4.x86_64.rpm",
+		"bitfusion-client-ubuntu1804_4.5.0-5_amd64.deb",
+	} {
+		os.MkdirAll(path.Join(host, "/opt/bitfusion-clients", distro), 0755)
+	}
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name: "node-a",
+		Labels: map[string]string{
+			"kubernetes.io/hostname":          "node-a",
+			"bitfusion.io/client-centos7-401": "true",
+		},
+		Annotations: map[string]string{"bitfusion.io/client-versions": "centos7-401"},
+	}})
+
+	cfg := defaultConfig()
+	cfg.NodeName = "node-a"
+	cfg.ServersConf = writeServersConf(t, dir, lis.Addr().String())
+	cfg.HostRoot = host
+	cfg.Client = &bfsClient{DistroPath: "/opt/bitfusion-clients"}
+	cfg.FeatureFile = path.Join(dir, "features.d", "bitfusion")
+	labeler := newNodeLabeler(cfg, client)
+	assert.Nil(t, labeler.sync(context.Background()))
+
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{
+		"kubernetes.io/hostname":           "node-a",
+		"bitfusion.io/reachable":           "true",
+		"bitfusion.io/client-centos7-450":  "true",
+		"bitfusion.io/client-ubuntu18-450": "true",
+	}, node.Labels)
+	assert.Equal(t, "centos7-450,ubuntu18-450", node.Annotations["bitfusion.io/client-versions"])
+	assert.Contains(t, node.Annotations, "bitfusion.io/server-rtt-ms")
+
+	data, err := ioutil.ReadFile(cfg.FeatureFile)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "bitfusion.io/client-centos7-450=true\nbitfusion.io/client-ubuntu18-450=true\nbitfusion.io/reachable=true\nbitfusion.io/server-rtt-ms=")
+
+	// The node is unreachable once the server is gone
+	lis.Close()
+	labeler.timeout = time.Second
+	assert.Nil(t, labeler.sync(context.Background()))
+	node, _ = client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	assert.Equal(t, "false", node.Labels["bitfusion.io/reachable"])
+	assert.NotContains(t, node.Annotations, "bitfusion.io/server-rtt-ms")
+	data, _ = ioutil.ReadFile(cfg.FeatureFile)
+	assert.Equal(t, "bitfusion.io/client-centos7-450=true\nbitfusion.io/client-ubuntu18-450=true\nbitfusion.io/reachable=false\n", string(data))
+}
+
+func TestRTTBucket(t *testing.T) {
+	for rtt, want := range map[time.Duration]int64{
+		0:                       1,
+		300 * time.Microsecond:  1,
+		1001 * time.Microsecond: 2,
+		3 * time.Millisecond:    5,
+		47 * time.Millisecond:   50,
+		1200 * time.Millisecond: 2000,
+		10 * time.Second:        5000,
+	} {
+		assert.Equal(t, want, rttBucket(rtt), rtt.String())
+	}
+}
+
+func TestPatchNodeRTTBucket(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}})
+	labeler := &nodeLabeler{client: client, nodeName: "node-a"}
+	patches := func() int {
+		n := 0
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "patch" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// An RTT changing within its bucket doesn't patch the node again
+	assert.Nil(t, labeler.patchNode(context.Background(), &nodeFeatures{servers: true, reachable: true, rtt: 3 * time.Millisecond}))
+	assert.Equal(t, 1, patches())
+	assert.Nil(t, labeler.patchNode(context.Background(), &nodeFeatures{servers: true, reachable: true, rtt: 4 * time.Millisecond}))
+	assert.Equal(t, 1, patches())
+	assert.Nil(t, labeler.patchNode(context.Background(), &nodeFeatures{servers: true, reachable: true, rtt: 30 * time.Millisecond}))
+	assert.Equal(t, 2, patches())
+	node, _ := client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	assert.Equal(t, "50", node.Annotations[serverRTTAnnotation])
+}
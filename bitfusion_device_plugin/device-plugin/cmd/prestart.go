@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// preStartCheck verifies the Bitfusion token before a container allocated Bitfusion devices starts
+type preStartCheck struct {
+	// files are the token files which must be present, empty paths are skipped
+	files []string
+	// optional are the files of secrets which may not be mounted, skipped while they are missing as poolHealth does
+	optional map[string]bool
+	// caCert is the CA certificate of the token which must not be expired, optional
+	caCert string
+	now    func() time.Time
+}
+
+func newPreStartCheck(caCert string, files ...string) *preStartCheck {
+	return &preStartCheck{
+		files:  files,
+		caCert: caCert,
+		now:    time.Now,
+	}
+}
+
+// checkToken returns an error if a token file is missing or the CA certificate is expired
+func (c *preStartCheck) checkToken() error {
+	for _, file := range c.files {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); os.IsNotExist(err) && c.optional[file] {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Bitfusion token file %s is missing, check the token secret: %v ", file, err)
+		}
+	}
+	if c.caCert == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(c.caCert)
+	if os.IsNotExist(err) && c.optional[c.caCert] {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("can't read Bitfusion CA %s: %v ", c.caCert, err)
+	}
+	found := false
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("can't parse Bitfusion CA %s: %v ", c.caCert, err)
+		}
+		found = true
+		if now := c.now(); now.After(cert.NotAfter) {
+			return fmt.Errorf("Bitfusion CA %s expired at %s, renew the token ", c.caCert, cert.NotAfter.Format(time.RFC3339))
+		} else if now.Before(cert.NotBefore) {
+			return fmt.Errorf("Bitfusion CA %s is not valid before %s ", c.caCert, cert.NotBefore.Format(time.RFC3339))
+		}
+	}
+	if !found {
+		return fmt.Errorf("no certificate found in Bitfusion CA %s ", c.caCert)
+	}
+	return nil
+}
+
+// checkDevices returns an error unless the devices are still advertised and healthy
+func (bfs *bfsManager) checkDevices(ids []string) error {
+	bfs.mu.Lock()
+	defer bfs.mu.Unlock()
+	var missing, unhealthy []string
+	for _, id := range ids {
+		dev, ok := bfs.devices[id]
+		if !ok {
+			missing = append(missing, id)
+		} else if dev.Health != pluginapi.Healthy {
+			unhealthy = append(unhealthy, id)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("devices %s are no longer available, %d devices are left in the Bitfusion server pool ",
+			strings.Join(missing, ","), len(bfs.devices))
+	}
+	if len(unhealthy) != 0 {
+		return fmt.Errorf("devices %s are unhealthy ", strings.Join(unhealthy, ","))
+	}
+	return nil
+}
+
+// checkPreStart verifies the Bitfusion servers, the token and the capacity of the allocated devices
+func (bfs *bfsManager) checkPreStart(ids []string) error {
+	if _, health := bfs.sources(); !health.Healthy() {
+		return fmt.Errorf("no Bitfusion server is reachable ")
+	}
+	if err := bfs.preStart.checkToken(); err != nil {
+		return err
+	}
+	return bfs.checkDevices(ids)
+}
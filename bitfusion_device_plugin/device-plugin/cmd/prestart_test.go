@@ -0,0 +1,159 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// writeCACert writes a self-signed certificate valid until notAfter
+func writeCACert(t *testing.T, file string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bitfusion"},
+		NotBefore:             notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func TestPreStartCheckToken(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	servers := writeServersConf(t, dir, "127.0.0.1:56001")
+	ca := path.Join(dir, "ca.crt")
+	writeCACert(t, ca, time.Now().Add(time.Hour))
+
+	assert.Nil(t, newPreStartCheck(ca, servers, ca, "").checkToken())
+	assert.Nil(t, newPreStartCheck("", servers).checkToken())
+
+	err := newPreStartCheck(ca, servers, path.Join(dir, "client.yaml")).checkToken()
+	if assert.NotNil(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "client.yaml is missing"), err.Error())
+	}
+
+	check := newPreStartCheck(ca, servers)
+	check.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	err = check.checkToken()
+	if assert.NotNil(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "expired"), err.Error())
+	}
+
+	ioutil.WriteFile(ca, []byte("not a certificate"), 0644)
+	assert.NotNil(t, newPreStartCheck(ca).checkToken())
+
+	// The optional secrets are skipped while they are not mounted
+	missingServers, missingCA := path.Join(dir, "missing", "servers.conf"), path.Join(dir, "missing", "ca.crt")
+	check = newPreStartCheck(missingCA, missingServers, missingCA)
+	assert.NotNil(t, check.checkToken())
+	check.optional = map[string]bool{missingServers: true, missingCA: true}
+	assert.Nil(t, check.checkToken())
+}
+
+func TestPreStartCheckHostRoot(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "etc/bitfusion/tls"), 0755)
+	ioutil.WriteFile(path.Join(dir, "etc/bitfusion/client.yaml"), []byte("{}"), 0644)
+	ioutil.WriteFile(path.Join(dir, "etc/bitfusion/servers.conf"), []byte("servers: []"), 0644)
+	writeCACert(t, path.Join(dir, "etc/bitfusion/tls/ca.crt"), time.Now().Add(time.Hour))
+
+	// The client files are host paths looked up below HostRoot, the optional secrets of the plugin are not mounted
+	cfg := &config{
+		Interval:      10,
+		PreStartCheck: true,
+		HostRoot:      dir,
+		ServersConf:   path.Join(dir, "secrets", "servers.conf"),
+		CACert:        path.Join(dir, "secrets", "ca.crt"),
+		Client: &bfsClient{
+			DistroPath:   "/opt/bitfusion-client",
+			ClientConfig: "/etc/bitfusion/client.yaml",
+			ServersConf:  "/etc/bitfusion/servers.conf",
+			CACert:       "/etc/bitfusion/tls/ca.crt",
+		},
+	}
+	bfs, err := newManager(cfg, resourceConfig{ResourceName: "bitfusion.io/gpu", ResourceNums: 1})
+	if assert.Nil(t, err) && assert.NotNil(t, bfs.preStart) {
+		assert.Nil(t, bfs.preStart.checkToken())
+	}
+}
+
+func TestPreStartContainer(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	ca := path.Join(dir, "ca.crt")
+	writeCACert(t, ca, time.Now().Add(time.Hour))
+
+	health := &fakeHealth{}
+	bfs, _ := NewbfsManager(staticCapacity{nums: 3}, health, time.Hour)
+	options, _ := bfs.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	assert.False(t, options.PreStartRequired)
+	// Without the check every container starts
+	_, err := bfs.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: []string{"5"}})
+	assert.Nil(t, err)
+
+	bfs.preStart = newPreStartCheck(ca, ca)
+	bfs.discoverResources()
+	options, _ = bfs.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	assert.True(t, options.PreStartRequired)
+
+	tests := []struct {
+		name    string
+		ids     []string
+		healthy bool
+		want    string
+	}{
+		{"ready", []string{"0", "2"}, true, ""},
+		{"servers down", []string{"0"}, false, "no Bitfusion server is reachable"},
+		{"capacity gone", []string{"2", "3"}, true, "devices 3 are no longer available, 3 devices are left"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health.set(tt.healthy)
+			_, err := bfs.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: tt.ids})
+			if tt.want == "" {
+				assert.Nil(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.True(t, strings.Contains(err.Error(), tt.want), err.Error())
+			}
+		})
+	}
+
+	// Devices discovered while the pool is down are unhealthy
+	health.set(false)
+	bfs.discoverResources()
+	err = bfs.checkDevices([]string{"1"})
+	if assert.NotNil(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "unhealthy"), err.Error())
+	}
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// pluginServers runs a device plugin server for every resource of the config and applies a reloaded config live.
+// Running managers take over the new capacity, health check and interval, the servers of added or removed resources
+// are started or stopped, and every server is restarted if the options kubelet reads at registration change
+type pluginServers struct {
+	mu      sync.Mutex
+	cfg     *config
+	ledger  *allocationLedger
+	running []*runningServer
+	// errs receives the error of a server which failed
+	errs chan error
+}
+
+// runningServer is the server of one resource with its own stop channel
+type runningServer struct {
+	res    resourceConfig
+	server *bfsServer
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newPluginServers(cfg *config, ledger *allocationLedger) *pluginServers {
+	return &pluginServers{cfg: cfg, ledger: ledger, errs: make(chan error, 1)}
+}
+
+// servers returns the running servers, for the probes
+func (p *pluginServers) servers() []*bfsServer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	servers := make([]*bfsServer, len(p.running))
+	for i, rs := range p.running {
+		servers[i] = rs.server
+	}
+	return servers
+}
+
+// start creates and runs the server of a resource
+func (p *pluginServers) start(cfg *config, res resourceConfig) (*runningServer, error) {
+	bfs, err := newManager(cfg, res)
+	if err != nil {
+		return nil, err
+	}
+	bfs.ledger = p.ledger
+	glog.Infof("Device Plugin path %s, plugin endpoint %s for %s\n", cfg.DevicePluginDir, res.SocketName, res.ResourceName)
+	rs := &runningServer{
+		res:    res,
+		server: newBfsServer(bfs, cfg.DevicePluginDir, cfg.kubeletSocket(), res.SocketName, res.ResourceName),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(rs.done)
+		if err := rs.server.Run(rs.stop); err != nil {
+			select {
+			case p.errs <- fmt.Errorf("%s: %v ", res.ResourceName, err):
+			default:
+			}
+		}
+	}()
+	return rs, nil
+}
+
+// stopServer stops a running server and waits until its socket is removed
+func (rs *runningServer) stopServer() {
+	close(rs.stop)
+	<-rs.done
+}
+
+// run serves the resources of the config until stop is closed, reloading the config with load on every reload.
+// It returns the first error of a server
+func (p *pluginServers) run(load func() (*config, error), reload <-chan struct{}, stop <-chan struct{}) error {
+	p.mu.Lock()
+	for _, res := range p.cfg.resources() {
+		rs, err := p.start(p.cfg, res)
+		if err != nil {
+			p.mu.Unlock()
+			p.stopAll()
+			return err
+		}
+		p.running = append(p.running, rs)
+	}
+	p.mu.Unlock()
+
+	for {
+		select {
+		case <-stop:
+			p.stopAll()
+			return nil
+		case err := <-p.errs:
+			p.stopAll()
+			return err
+		case <-reload:
+			cfg, err := load()
+			if err != nil {
+				glog.Errorf("Can't reload configuration, keep the running one: %v", err)
+				continue
+			}
+			if err := p.apply(cfg); err != nil {
+				glog.Errorf("Can't apply reloaded configuration: %v", err)
+			}
+		}
+	}
+}
+
+// stopAll stops every running server
+func (p *pluginServers) stopAll() {
+	p.mu.Lock()
+	running := p.running
+	p.running = nil
+	p.mu.Unlock()
+	for _, rs := range running {
+		rs.stopServer()
+	}
+}
+
+// apply brings the running servers to cfg
+func (p *pluginServers) apply(cfg *config) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, field := range restartFields(p.cfg, cfg) {
+		glog.Warningf("Configuration %s changed, it takes effect after a restart of the device plugin", field)
+	}
+	restart := serverFieldsChanged(p.cfg, cfg)
+
+	current := make(map[string]*runningServer)
+	for _, rs := range p.running {
+		current[rs.res.ResourceName+"|"+rs.res.SocketName] = rs
+	}
+	var running []*runningServer
+	var err error
+	for _, res := range cfg.resources() {
+		key := res.ResourceName + "|" + res.SocketName
+		rs, ok := current[key]
+		if ok && !restart {
+			next, e := newManager(cfg, res)
+			if e != nil {
+				err = e
+				running = append(running, rs)
+				delete(current, key)
+				continue
+			}
+			glog.Infof("Update capacity of %s", res.ResourceName)
+			rs.server.bfs.update(next)
+			rs.res = res
+			running = append(running, rs)
+			delete(current, key)
+			continue
+		}
+		if ok {
+			glog.Infof("Restart device plugin server of %s", res.ResourceName)
+			rs.stopServer()
+			delete(current, key)
+		} else {
+			glog.Infof("Start device plugin server of %s", res.ResourceName)
+		}
+		started, e := p.start(cfg, res)
+		if e != nil {
+			err = e
+			continue
+		}
+		running = append(running, started)
+	}
+	for _, rs := range current {
+		glog.Infof("Stop device plugin server of %s", rs.res.ResourceName)
+		rs.stopServer()
+	}
+	p.running = running
+	p.cfg = cfg
+	return err
+}
+
+// restartFields returns the settings which differ between old and new but are only read at the start of the process
+func restartFields(old, new *config) []string {
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"mode", old.Mode, new.Mode},
+		{"devicePluginDir", old.DevicePluginDir, new.DevicePluginDir},
+		{"kubeletRoot", old.KubeletRoot, new.KubeletRoot},
+		{"hostRoot", old.HostRoot, new.HostRoot},
+		{"checkpointFile", old.CheckpointFile, new.CheckpointFile},
+		{"podResourcesSocket", old.PodResourcesSocket, new.PodResourcesSocket},
+		{"metricsAddress", old.MetricsAddress, new.MetricsAddress},
+		{"allocationsAddress", old.AllocationsAddress, new.AllocationsAddress},
+		{"dra", old.DRA, new.DRA},
+		{"draDriverName", old.DRADriverName, new.DRADriverName},
+		{"nodeLabels", old.NodeLabels, new.NodeLabels},
+		{"featureFile", old.FeatureFile, new.FeatureFile},
+	}
+	var changed []string
+	for _, f := range fields {
+		if f.old != f.new {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed
+}
+
+// serverFieldsChanged reports whether the settings kubelet reads at registration or the allocations depend on changed
+func serverFieldsChanged(old, new *config) bool {
+	return old.AllocationPolicy != new.AllocationPolicy ||
+		old.PreStartCheck != new.PreStartCheck ||
+		old.CDISpecDir != new.CDISpecDir ||
+		!reflect.DeepEqual(old.Client, new.Client)
+}
+
+// watchConfigFile signals reload whenever the config file changes until stop is closed.
+// The directory is watched, so the file of a mounted ConfigMap is followed when kubelet swaps its ..data link
+func watchConfigFile(file string, reload chan<- struct{}, stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dir := path.Dir(file)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("can't watch %s: %v ", dir, err)
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			case event := <-watcher.Events:
+				if event.Name != file && path.Base(event.Name) != "..data" {
+					continue
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) == 0 {
+					continue
+				}
+				glog.Infof("Config file %s changed, reloading", file)
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			case err := <-watcher.Errors:
+				glog.Errorf("Watch %s error: %v", dir, err)
+			}
+		}
+	}()
+	return nil
+}
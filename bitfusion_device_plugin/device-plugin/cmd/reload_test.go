@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestBfsManagerUpdate(t *testing.T) {
+	bfs, _ := NewbfsManager(staticCapacity{nums: 5}, alwaysHealthy{}, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := newFakeListAndWatchStream(ctx)
+	go bfs.ListAndWatch(&pluginapi.Empty{}, stream)
+	assertDevicesHealth(t, stream.next(t), 5, pluginapi.Healthy)
+
+	// The new capacity is sent without waiting for the interval
+	health := &fakeHealth{}
+	health.set(false)
+	next, _ := NewbfsManager(staticCapacity{nums: 8}, health, time.Hour)
+	bfs.update(next)
+	assertDevicesHealth(t, stream.next(t), 8, pluginapi.Unhealthy)
+}
+
+func TestPluginServersReload(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	kubelet := startFakeKubelet(t, path.Join(dir, "kubelet.sock"))
+	defer kubelet.stop()
+
+	newConfig := func(resources ...resourceConfig) *config {
+		cfg := defaultConfig()
+		cfg.DevicePluginDir = dir
+		cfg.CapacitySource = capacityStatic
+		cfg.Resources = resources
+		return cfg
+	}
+	gpu := resourceConfig{ResourceName: "bitfusion.io/gpu", SocketName: "gpu.sock", Unit: unitPercent, ResourceNums: 10}
+	memory := resourceConfig{ResourceName: "bitfusion.io/gpu-memory-mb", SocketName: "memory.sock", Unit: unitMemoryMB, ResourceNums: 4}
+
+	configs := make(chan *config, 1)
+	load := func() (*config, error) {
+		cfg := <-configs
+		if cfg == nil {
+			return nil, errors.New("broken config file")
+		}
+		return cfg, nil
+	}
+	plugin := newPluginServers(newConfig(gpu), nil)
+	reload := make(chan struct{})
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- plugin.run(load, reload, stop) }()
+	kubelet.waitRegister(t)
+	assert.Equal(t, 10, len(kubelet.waitDevices(t, gpu.ResourceName)))
+
+	// New capacity is pushed on the open stream, a new resource gets its own server
+	gpu.ResourceNums = 20
+	configs <- newConfig(gpu, memory)
+	reload <- struct{}{}
+	assert.Equal(t, 20, len(kubelet.waitDevices(t, gpu.ResourceName)))
+	assert.Equal(t, memory.ResourceName, kubelet.waitRegister(t).ResourceName)
+	assert.Equal(t, 4, len(kubelet.waitDevices(t, memory.ResourceName)))
+	assert.Equal(t, 2, len(plugin.servers()))
+
+	// A broken config keeps the running servers
+	configs <- nil
+	reload <- struct{}{}
+	assert.Equal(t, 2, len(plugin.servers()))
+
+	// A removed resource is stopped, a new allocation policy restarts the others
+	cfg := newConfig(gpu)
+	cfg.AllocationPolicy = "spread"
+	configs <- cfg
+	reload <- struct{}{}
+	assert.Equal(t, gpu.ResourceName, kubelet.waitRegister(t).ResourceName)
+	assert.Equal(t, 1, len(plugin.servers()))
+	_, err := os.Stat(path.Join(dir, "memory.sock"))
+	assert.True(t, os.IsNotExist(err))
+
+	close(stop)
+	assert.Nil(t, <-done)
+	assert.Empty(t, plugin.servers())
+}
+
+func TestRestartFields(t *testing.T) {
+	old := defaultConfig()
+	new := defaultConfig()
+	new.ResourceNums = 5
+	new.Interval = 1
+	assert.Empty(t, restartFields(old, new))
+	assert.False(t, serverFieldsChanged(old, new))
+
+	new.MetricsAddress = ":9000"
+	new.DRA = true
+	assert.Equal(t, []string{"metricsAddress", "dra"}, restartFields(old, new))
+	new.Client = &bfsClient{DistroPath: "/opt/bitfusion"}
+	assert.True(t, serverFieldsChanged(old, new))
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "config.yaml")
+	ioutil.WriteFile(file, []byte("devicePluginDir: "+dir+"\nresourceNums: 5\n"), 0644)
+
+	args := []string{"-config", file, "-interval", "3"}
+	cfg, err := reloadConfig(args, func(string) string { return "" })
+	if assert.Nil(t, err) {
+		assert.Equal(t, file, cfg.file)
+		assert.Equal(t, 5, cfg.ResourceNums)
+		assert.Equal(t, 3, cfg.Interval)
+	}
+
+	reload := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	assert.Nil(t, watchConfigFile(file, reload, stop))
+	ioutil.WriteFile(path.Join(dir, "other.yaml"), nil, 0644)
+	ioutil.WriteFile(file, []byte("devicePluginDir: "+dir+"\nresourceNums: 7\n"), 0644)
+	select {
+	case <-reload:
+	case <-time.After(10 * time.Second):
+		t.Fatal("config file change did not reload")
+	}
+	cfg, err = reloadConfig(args, func(string) string { return "" })
+	if assert.Nil(t, err) {
+		assert.Equal(t, 7, cfg.ResourceNums)
+	}
+
+	ioutil.WriteFile(file, []byte("resourceNums: [\n"), 0644)
+	_, err = reloadConfig(args, func(string) string { return "" })
+	assert.NotNil(t, err)
+}
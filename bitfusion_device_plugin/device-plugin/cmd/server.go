@@ -0,0 +1,302 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// Registration retry backoff used when kubelet is not reachable
+	registerBackoffInitial = 1 * time.Second
+	registerBackoffMax     = 10 * time.Second
+	// stopTimeout bounds the wait for in-flight calls when the server stops
+	stopTimeout = 5 * time.Second
+)
+
+// bfsServer serves a bfsManager on a unix socket and keeps it registered with kubelet
+type bfsServer struct {
+	bfs           *bfsManager
+	pluginDir     string
+	kubeletSocket string
+	socketName    string
+	resourceName  string
+
+	backoffInitial time.Duration
+	backoffMax     time.Duration
+
+	server *grpc.Server
+	// kubelet socket the plugin registered against
+	kubelet os.FileInfo
+
+	// mu guards the state reported by the probes
+	mu         sync.Mutex
+	serving    bool
+	registered bool
+}
+
+// newBfsServer creates a server for bfs, pluginDir is the kubelet device plugin directory
+func newBfsServer(bfs *bfsManager, pluginDir, kubeletSocket, socketName, resourceName string) *bfsServer {
+	return &bfsServer{
+		bfs:            bfs,
+		pluginDir:      pluginDir,
+		kubeletSocket:  kubeletSocket,
+		socketName:     socketName,
+		resourceName:   resourceName,
+		backoffInitial: registerBackoffInitial,
+		backoffMax:     registerBackoffMax,
+	}
+}
+
+// socketPath returns the path of the device plugin socket
+func (s *bfsServer) socketPath() string {
+	return path.Join(s.pluginDir, s.socketName)
+}
+
+// Start removes the stale socket, starts the gRPC server and waits until it is serving
+func (s *bfsServer) Start() error {
+	sock := s.socketPath()
+	if err := removeSocket(sock); err != nil {
+		return err
+	}
+
+	glog.Infof("Device Plugin start server at: %s\n", sock)
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		return fmt.Errorf("can't listen on %s: %v ", sock, err)
+	}
+	server := grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(server, s.bfs)
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			glog.Errorf("Device Plugin server at %s stopped: %v", sock, err)
+		}
+	}()
+	s.server = server
+
+	// Make sure the server accepts connections before kubelet is told about it
+	conn, err := net.DialTimeout("unix", sock, 5*time.Second)
+	if err != nil {
+		s.Stop()
+		return fmt.Errorf("can't connect to device plugin server: %v ", err)
+	}
+	s.setState(true, false)
+	return conn.Close()
+}
+
+// setState records whether the gRPC server is serving and registered with kubelet
+func (s *bfsServer) setState(serving, registered bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serving = serving
+	s.registered = registered
+}
+
+// healthy reports an error if the gRPC server is not serving or its socket is gone
+func (s *bfsServer) healthy() error {
+	s.mu.Lock()
+	serving := s.serving
+	s.mu.Unlock()
+	if !serving {
+		return fmt.Errorf("%s: device plugin server is not serving ", s.resourceName)
+	}
+	if _, err := os.Stat(s.socketPath()); err != nil {
+		return fmt.Errorf("%s: device plugin socket: %v ", s.resourceName, err)
+	}
+	return nil
+}
+
+// ready reports an error if the server is unhealthy, not registered with kubelet
+// or the last devices sent to kubelet did not arrive
+func (s *bfsServer) ready() error {
+	if err := s.healthy(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	registered := s.registered
+	s.mu.Unlock()
+	if !registered {
+		return fmt.Errorf("%s: not registered with kubelet ", s.resourceName)
+	}
+	if err := s.bfs.sendError(); err != nil {
+		return fmt.Errorf("%s: %v ", s.resourceName, err)
+	}
+	return nil
+}
+
+// Stop ends the ListAndWatch streams, stops the gRPC server gracefully and removes the socket
+func (s *bfsServer) Stop() {
+	if s.server == nil {
+		return
+	}
+	s.setState(false, false)
+	s.bfs.closeStreams()
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(stopTimeout):
+		glog.Warningf("Device Plugin server at %s did not stop in %v, closing connections", s.socketPath(), stopTimeout)
+		s.server.Stop()
+	}
+	s.server = nil
+
+	if err := removeSocket(s.socketPath()); err != nil {
+		glog.Error(err)
+	}
+}
+
+// removeSocket removes a unix socket, a missing socket is not an error
+func removeSocket(sock string) error {
+	if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't remove socket %s: %v ", sock, err)
+	}
+	return nil
+}
+
+// register registers to kubelet with exponential backoff, returns false if stop is closed first
+func (s *bfsServer) register(stop <-chan struct{}) bool {
+	backoff := s.backoffInitial
+	for {
+		s.kubelet, _ = os.Stat(s.kubeletSocket)
+		registrations.WithLabelValues(s.resourceName).Inc()
+		err := Register(s.kubeletSocket, s.socketName, s.resourceName)
+		if err == nil {
+			glog.Infof("Device Plugin registered %s\n", s.resourceName)
+			s.setState(true, true)
+			return true
+		}
+		registrationFailures.WithLabelValues(s.resourceName).Inc()
+		glog.Errorf("Register %s failed, retry in %v: %v", s.resourceName, backoff, err)
+
+		select {
+		case <-stop:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.backoffMax {
+			backoff = s.backoffMax
+		}
+	}
+}
+
+// Run serves the device plugin until stop is closed.
+// The server is restarted and registered again whenever kubelet restarts,
+// which recreates the kubelet socket and removes the plugin sockets
+func (s *bfsServer) Run(stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(s.pluginDir); err != nil {
+		return fmt.Errorf("can't watch %s: %v ", s.pluginDir, err)
+	}
+
+	for {
+		if err := s.Start(); err != nil {
+			return err
+		}
+		if !s.register(stop) {
+			s.Stop()
+			return nil
+		}
+		if !s.waitRestart(watcher, stop) {
+			s.Stop()
+			return nil
+		}
+		s.Stop()
+	}
+}
+
+// waitRestart blocks until the server needs a restart, returns false if stop is closed first
+func (s *bfsServer) waitRestart(watcher *fsnotify.Watcher, stop <-chan struct{}) bool {
+	for {
+		select {
+		case <-stop:
+			return false
+		case event := <-watcher.Events:
+			if event.Name == s.kubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
+				if s.registeredKubelet() {
+					continue
+				}
+				glog.Infof("Kubelet socket %s created, restarting device plugin", event.Name)
+				return true
+			}
+			if event.Name == s.socketPath() && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// Start removes the stale socket itself, so only react if it is really gone
+				if _, err := os.Stat(event.Name); os.IsNotExist(err) {
+					glog.Infof("Device Plugin socket %s removed, restarting device plugin", event.Name)
+					return true
+				}
+			}
+		case err := <-watcher.Errors:
+			glog.Errorf("Watch %s error: %v", s.pluginDir, err)
+		}
+	}
+}
+
+// registeredKubelet reports whether the kubelet socket is still the one the plugin registered against
+func (s *bfsServer) registeredKubelet() bool {
+	info, err := os.Stat(s.kubeletSocket)
+	if err != nil || s.kubelet == nil {
+		return false
+	}
+	return os.SameFile(info, s.kubelet) && info.ModTime().Equal(s.kubelet.ModTime())
+}
+
+// runServers runs the servers until stop is closed, returns the first error of any server
+func runServers(servers []*bfsServer, stop <-chan struct{}) error {
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *bfsServer) {
+			errs <- server.Run(stop)
+		}(server)
+	}
+
+	var first error
+	for range servers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// serversHealthy reports the first unhealthy server
+func serversHealthy(servers []*bfsServer) error {
+	for _, server := range servers {
+		if err := server.healthy(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serversReady reports the first server which is not ready
+func serversReady(servers []*bfsServer) error {
+	for _, server := range servers {
+		if err := server.ready(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeKubelet is the simulated kubelet with helpers waiting for its events
+type fakeKubelet struct {
+	*simKubelet
+}
+
+func startFakeKubelet(t *testing.T, socket string) *fakeKubelet {
+	k, err := startSimKubelet(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeKubelet{k}
+}
+
+func (k *fakeKubelet) waitRegister(t *testing.T) *pluginapi.RegisterRequest {
+	select {
+	case r := <-k.requests:
+		return r
+	case <-time.After(10 * time.Second):
+		t.Fatal("device plugin did not register")
+	}
+	return nil
+}
+
+// waitDevices returns the next device list kubelet received for resource
+func (k *fakeKubelet) waitDevices(t *testing.T, resource string) []*pluginapi.Device {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case u := <-k.updates:
+			if u.resource == resource {
+				return u.devices
+			}
+		case <-timeout:
+			t.Fatalf("kubelet received no devices of %s", resource)
+		}
+	}
+}
+
+func tempPluginDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBfsServerRun(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	kubeletSocket := path.Join(dir, "kubelet.sock")
+	kubelet := startFakeKubelet(t, kubeletSocket)
+	defer kubelet.stop()
+
+	bfs, _ := NewbfsManager(staticCapacity{nums: 10}, alwaysHealthy{}, time.Second)
+	server := newBfsServer(bfs, dir, kubeletSocket, "bitfusion.sock", "bitfusion.io/gpu")
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- server.Run(stop) }()
+
+	r := kubelet.waitRegister(t)
+	assert.Equal(t, pluginapi.Version, r.Version)
+	assert.Equal(t, "bitfusion.sock", r.Endpoint)
+	assert.Equal(t, "bitfusion.io/gpu", r.ResourceName)
+
+	close(stop)
+	assert.Nil(t, <-done)
+}
+
+func TestBfsServerReregister(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	kubeletSocket := path.Join(dir, "kubelet.sock")
+
+	bfs, _ := NewbfsManager(staticCapacity{nums: 10}, alwaysHealthy{}, time.Second)
+	server := newBfsServer(bfs, dir, kubeletSocket, "bitfusion.sock", "bitfusion.io/gpu")
+	server.backoffInitial = 10 * time.Millisecond
+	server.backoffMax = 50 * time.Millisecond
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- server.Run(stop) }()
+
+	// Kubelet comes up after the plugin
+	kubelet := startFakeKubelet(t, kubeletSocket)
+	kubelet.waitRegister(t)
+
+	// Kubelet restart wipes the device plugin directory
+	kubelet.stop()
+	os.Remove(server.socketPath())
+	kubelet = startFakeKubelet(t, kubeletSocket)
+	defer kubelet.stop()
+
+	r := kubelet.waitRegister(t)
+	assert.Equal(t, "bitfusion.sock", r.Endpoint)
+	// The restarted server is served to the new kubelet
+	assert.Equal(t, 10, len(kubelet.waitDevices(t, "bitfusion.io/gpu")))
+
+	close(stop)
+	assert.Nil(t, <-done)
+}
+
+func TestRunServersMultipleResources(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	kubeletSocket := path.Join(dir, "kubelet.sock")
+	kubelet := startFakeKubelet(t, kubeletSocket)
+	defer kubelet.stop()
+
+	cfg := defaultConfig()
+	cfg.DevicePluginDir = dir
+	cfg.Resources = []resourceConfig{
+		{ResourceName: "bitfusion.io/gpu", SocketName: "gpu.sock"},
+		{ResourceName: "bitfusion.io/gpu-memory-mb", SocketName: "gpu-memory-mb.sock", Unit: unitMemoryMB, ResourceNums: 16384},
+	}
+	servers, err := newServers(cfg, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(servers))
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- runServers(servers, stop) }()
+
+	registered := map[string]string{}
+	for range servers {
+		r := kubelet.waitRegister(t)
+		registered[r.ResourceName] = r.Endpoint
+	}
+	assert.Equal(t, map[string]string{
+		"bitfusion.io/gpu":           "gpu.sock",
+		"bitfusion.io/gpu-memory-mb": "gpu-memory-mb.sock",
+	}, registered)
+
+	// Every resource tracks its own capacity
+	servers[0].bfs.discoverResources()
+	servers[1].bfs.discoverResources()
+	assert.Equal(t, 1000, len(servers[0].bfs.deviceList()))
+	assert.Equal(t, 16384, len(servers[1].bfs.deviceList()))
+
+	close(stop)
+	assert.Nil(t, <-done)
+}
+
+func TestBfsServerStopGracefully(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	kubeletSocket := path.Join(dir, "kubelet.sock")
+	kubelet := startFakeKubelet(t, kubeletSocket)
+	defer kubelet.stop()
+
+	bfs, _ := NewbfsManager(staticCapacity{nums: 10}, alwaysHealthy{}, time.Hour)
+	server := newBfsServer(bfs, dir, kubeletSocket, "bitfusion.sock", "bitfusion.io/gpu")
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- server.Run(stop) }()
+	kubelet.waitRegister(t)
+	// Kubelet keeps a ListAndWatch stream open
+	kubelet.waitDevices(t, "bitfusion.io/gpu")
+
+	// So does any other client
+	conn, err := grpc.Dial("unix://"+server.socketPath(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := pluginapi.NewDevicePluginClient(conn).ListAndWatch(context.Background(), &pluginapi.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	assert.Nil(t, err)
+
+	start := time.Now()
+	close(stop)
+	assert.Nil(t, <-done)
+	assert.True(t, time.Since(start) < stopTimeout, "stop waited for the stream to time out")
+	_, err = stream.Recv()
+	assert.NotNil(t, err)
+	_, err = os.Stat(server.socketPath())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRemoveSocket(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	sock := path.Join(dir, "bitfusion.sock")
+
+	assert.Nil(t, removeSocket(sock))
+	ioutil.WriteFile(sock, nil, 0644)
+	assert.Nil(t, removeSocket(sock))
+	_, err := os.Stat(sock)
+	assert.True(t, os.IsNotExist(err))
+
+	// A non-empty directory can't be removed
+	os.MkdirAll(path.Join(sock, "sub"), 0755)
+	assert.NotNil(t, removeSocket(sock))
+}
+
+// probe returns the status code of an HTTP endpoint of server
+func probe(t *testing.T, server *httptest.Server, endpoint string) int {
+	resp, err := server.Client().Get(server.URL + endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitProbe polls an endpoint until it returns code
+func waitProbe(t *testing.T, server *httptest.Server, endpoint string, code int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for probe(t, server, endpoint) != code {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not return %d", endpoint, code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	kubeletSocket := path.Join(dir, "kubelet.sock")
+	kubelet := startFakeKubelet(t, kubeletSocket)
+	defer kubelet.stop()
+
+	bfs, _ := NewbfsManager(staticCapacity{nums: 10}, alwaysHealthy{}, time.Hour)
+	server := newBfsServer(bfs, dir, kubeletSocket, "bitfusion.sock", "bitfusion.io/gpu")
+	endpoints := httptest.NewServer(newMetricsMux(func() []*bfsServer { return []*bfsServer{server} }))
+	defer endpoints.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, probe(t, endpoints, "/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, probe(t, endpoints, "/readyz"))
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- server.Run(stop) }()
+	kubelet.waitRegister(t)
+	waitProbe(t, endpoints, "/healthz", http.StatusOK)
+	// Ready once kubelet received the devices
+	assert.Equal(t, 10, len(kubelet.waitDevices(t, "bitfusion.io/gpu")))
+	waitProbe(t, endpoints, "/readyz", http.StatusOK)
+
+	close(stop)
+	assert.Nil(t, <-done)
+	assert.Equal(t, http.StatusServiceUnavailable, probe(t, endpoints, "/healthz"))
+
+	// Without servers, such as in controller mode, the probes always succeed
+	controller := httptest.NewServer(newMetricsMux(nil))
+	defer controller.Close()
+	assert.Equal(t, http.StatusOK, probe(t, controller, "/healthz"))
+	assert.Equal(t, http.StatusOK, probe(t, controller, "/readyz"))
+}
+
+func TestBfsServerSocketRemoved(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	bfs, _ := NewbfsManager(staticCapacity{nums: 10}, alwaysHealthy{}, time.Hour)
+	server := newBfsServer(bfs, dir, path.Join(dir, "kubelet.sock"), "bitfusion.sock", "bitfusion.io/gpu")
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	assert.Nil(t, server.healthy())
+	assert.NotNil(t, server.ready())
+
+	os.Remove(server.socketPath())
+	assert.NotNil(t, server.healthy())
+}
@@ -0,0 +1,281 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// simKubelet is an in-process kubelet serving the registration service on a unix socket.
+// Like kubelet, it connects to every registered device plugin, reads its options and follows ListAndWatch,
+// and allocates devices on request. It drives the simulation mode and the tests
+type simKubelet struct {
+	socket string
+	server *grpc.Server
+
+	mu      sync.Mutex
+	stopped bool
+	plugins map[string]*simPlugin
+	// requests receives every registration
+	requests chan *pluginapi.RegisterRequest
+	// updates receives every device list sent by a plugin
+	updates chan simUpdate
+}
+
+// simPlugin is a device plugin registered with the simKubelet
+type simPlugin struct {
+	conn      *grpc.ClientConn
+	client    pluginapi.DevicePluginClient
+	options   *pluginapi.DevicePluginOptions
+	devices   []*pluginapi.Device
+	allocated map[string]bool
+	cancel    context.CancelFunc
+}
+
+// simUpdate is a device list sent by the plugin of a resource
+type simUpdate struct {
+	resource string
+	devices  []*pluginapi.Device
+}
+
+// startSimKubelet serves the registration service on socket, the plugin sockets are looked up next to it
+func startSimKubelet(socket string) (*simKubelet, error) {
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on %s: %v ", socket, err)
+	}
+	k := &simKubelet{
+		socket:   socket,
+		server:   grpc.NewServer(),
+		plugins:  make(map[string]*simPlugin),
+		requests: make(chan *pluginapi.RegisterRequest, 100),
+		updates:  make(chan simUpdate, 100),
+	}
+	pluginapi.RegisterRegistrationServer(k.server, k)
+	go k.server.Serve(lis)
+	return k, nil
+}
+
+// Register accepts the plugin and connects to it in the background, as kubelet does
+func (k *simKubelet) Register(ctx context.Context, r *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	if r.Version != pluginapi.Version {
+		return nil, fmt.Errorf("unsupported device plugin API version %s ", r.Version)
+	}
+	select {
+	case k.requests <- r:
+	default:
+	}
+	go k.connect(r)
+	return &pluginapi.Empty{}, nil
+}
+
+// connect replaces the plugin of the resource and follows its ListAndWatch stream
+func (k *simKubelet) connect(r *pluginapi.RegisterRequest) {
+	sock := path.Join(path.Dir(k.socket), r.Endpoint)
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := grpc.DialContext(ctx, "unix://"+sock, grpc.WithInsecure())
+	if err != nil {
+		glog.Errorf("Simulated kubelet can't connect to %s: %v", sock, err)
+		cancel()
+		return
+	}
+	plugin := &simPlugin{
+		conn:      conn,
+		client:    pluginapi.NewDevicePluginClient(conn),
+		allocated: make(map[string]bool),
+		cancel:    cancel,
+	}
+	if plugin.options, err = plugin.client.GetDevicePluginOptions(ctx, &pluginapi.Empty{}); err != nil {
+		glog.Errorf("Simulated kubelet can't get the options of %s: %v", r.ResourceName, err)
+		cancel()
+		conn.Close()
+		return
+	}
+
+	k.mu.Lock()
+	if k.stopped {
+		k.mu.Unlock()
+		cancel()
+		conn.Close()
+		return
+	}
+	if old, ok := k.plugins[r.ResourceName]; ok {
+		old.cancel()
+		old.conn.Close()
+	}
+	k.plugins[r.ResourceName] = plugin
+	k.mu.Unlock()
+
+	stream, err := plugin.client.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		glog.Errorf("Simulated kubelet can't watch %s: %v", r.ResourceName, err)
+		return
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			glog.Infof("Simulated kubelet stopped watching %s: %v", r.ResourceName, err)
+			return
+		}
+		k.mu.Lock()
+		plugin.devices = resp.Devices
+		k.mu.Unlock()
+		select {
+		case k.updates <- simUpdate{resource: r.ResourceName, devices: resp.Devices}:
+		default:
+		}
+	}
+}
+
+// devices returns the last device list of a resource
+func (k *simKubelet) devices(resource string) []*pluginapi.Device {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if plugin, ok := k.plugins[resource]; ok {
+		return plugin.devices
+	}
+	return nil
+}
+
+// allocate allocates size healthy free devices of a resource to a container like kubelet,
+// asking the plugin for its preferred devices and running PreStartContainer if it supports them
+func (k *simKubelet) allocate(resource string, size int) ([]string, *pluginapi.ContainerAllocateResponse, error) {
+	k.mu.Lock()
+	plugin, ok := k.plugins[resource]
+	var available []string
+	if ok {
+		for _, dev := range plugin.devices {
+			if dev.Health == pluginapi.Healthy && !plugin.allocated[dev.ID] {
+				available = append(available, dev.ID)
+			}
+		}
+	}
+	k.mu.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not registered ", resource)
+	}
+	if len(available) < size {
+		return nil, nil, fmt.Errorf("%d devices of %s requested, %d available ", size, resource, len(available))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ids := available[:size]
+	if plugin.options.GetPreferredAllocationAvailable {
+		resp, err := plugin.client.GetPreferredAllocation(ctx, &pluginapi.PreferredAllocationRequest{
+			ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+				AvailableDeviceIDs: available,
+				AllocationSize:     int32(size),
+			}},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if preferred := resp.ContainerResponses[0].DeviceIDs; len(preferred) == size {
+			ids = preferred
+		}
+	}
+
+	resp, err := plugin.client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if plugin.options.PreStartRequired {
+		if _, err := plugin.client.PreStartContainer(ctx, &pluginapi.PreStartContainerRequest{DevicesIDs: ids}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	k.mu.Lock()
+	for _, id := range ids {
+		plugin.allocated[id] = true
+	}
+	k.mu.Unlock()
+	return ids, resp.ContainerResponses[0], nil
+}
+
+// stop stops the registration service, disconnects the plugins and removes the socket like a kubelet restart
+func (k *simKubelet) stop() {
+	k.server.Stop()
+	k.mu.Lock()
+	k.stopped = true
+	for _, plugin := range k.plugins {
+		plugin.cancel()
+		plugin.conn.Close()
+	}
+	k.plugins = make(map[string]*simPlugin)
+	k.mu.Unlock()
+	os.Remove(k.socket)
+}
+
+// runSimulation runs the device plugin against a simulated kubelet until stop is closed.
+// It logs every device list and allocates one device of every resource once it is advertised
+func runSimulation(cfg *config, stop <-chan struct{}) error {
+	if cfg.DevicePluginDir == "" {
+		dir, err := ioutil.TempDir("", "bitfusion-simulation")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		cfg.DevicePluginDir = dir
+	}
+	kubelet, err := startSimKubelet(cfg.kubeletSocket())
+	if err != nil {
+		return err
+	}
+	defer kubelet.stop()
+	glog.Infof("Simulated kubelet serving at %s", kubelet.socket)
+
+	servers, err := newServers(cfg, nil)
+	if err != nil {
+		return err
+	}
+	serveMetrics(cfg.MetricsAddress, func() []*bfsServer { return servers })
+
+	go func() {
+		allocated := make(map[string]bool)
+		for {
+			select {
+			case <-stop:
+				return
+			case update := <-kubelet.updates:
+				healthy := 0
+				for _, dev := range update.devices {
+					if dev.Health == pluginapi.Healthy {
+						healthy++
+					}
+				}
+				glog.Infof("Simulated kubelet got %d devices of %s, %d healthy", len(update.devices), update.resource, healthy)
+				if allocated[update.resource] || healthy == 0 {
+					continue
+				}
+				ids, resp, err := kubelet.allocate(update.resource, 1)
+				if err != nil {
+					glog.Errorf("Simulated allocation of %s failed: %v", update.resource, err)
+					continue
+				}
+				allocated[update.resource] = true
+				glog.Infof("Simulated allocation of %s %v: envs %v, mounts %v, CDI devices %v",
+					update.resource, ids, resp.Envs, resp.Mounts, resp.CDIDevices)
+			}
+		}
+	}()
+	return runServers(servers, stop)
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestSimulatedKubelet(t *testing.T) {
+	dir := tempPluginDir(t)
+	defer os.RemoveAll(dir)
+	kubeletSocket := path.Join(dir, "kubelet.sock")
+	kubelet := startFakeKubelet(t, kubeletSocket)
+	defer kubelet.stop()
+
+	health := &fakeHealth{}
+	bfs, _ := NewbfsManager(fixedCapacity{
+		{Server: "10.0.0.1:56001", GPU: 0},
+		{Server: "10.0.0.1:56001", GPU: 0},
+		{Server: "10.0.0.2:56001", GPU: 1},
+	}, health, 10*time.Millisecond)
+	server := newBfsServer(bfs, dir, kubeletSocket, "bitfusion.sock", "bitfusion.io/gpu")
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- server.Run(stop) }()
+
+	// Register, then kubelet follows the devices
+	r := kubelet.waitRegister(t)
+	assert.Equal(t, "bitfusion.io/gpu", r.ResourceName)
+	devices := kubelet.waitDevices(t, "bitfusion.io/gpu")
+	assertDevicesHealth(t, &pluginapi.ListAndWatchResponse{Devices: devices}, 3, pluginapi.Healthy)
+	assert.Equal(t, "10.0.0.1:56001/0/0", devices[0].ID)
+	assert.Equal(t, devices, kubelet.devices("bitfusion.io/gpu"))
+
+	// Nothing is allocated while the devices are unhealthy
+	health.set(false)
+	assertDevicesHealth(t, &pluginapi.ListAndWatchResponse{Devices: kubelet.waitDevices(t, "bitfusion.io/gpu")}, 3, pluginapi.Unhealthy)
+	_, _, err := kubelet.allocate("bitfusion.io/gpu", 1)
+	assert.NotNil(t, err)
+	health.set(true)
+	assertDevicesHealth(t, &pluginapi.ListAndWatchResponse{Devices: kubelet.waitDevices(t, "bitfusion.io/gpu")}, 3, pluginapi.Healthy)
+
+	ids, resp, err := kubelet.allocate("bitfusion.io/gpu", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1:56001/0/0", "10.0.0.1:56001/0/1"}, ids)
+	assert.Equal(t, "10.0.0.1:56001", resp.Envs[serverListEnv])
+
+	// Allocated devices aren't handed out twice
+	ids, resp, err = kubelet.allocate("bitfusion.io/gpu", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.2:56001/1/0"}, ids)
+	assert.Equal(t, "10.0.0.2:56001", resp.Envs[serverListEnv])
+	_, _, err = kubelet.allocate("bitfusion.io/gpu", 1)
+	assert.NotNil(t, err)
+	_, _, err = kubelet.allocate("bitfusion.io/other", 1)
+	assert.NotNil(t, err)
+
+	close(stop)
+	assert.Nil(t, <-done)
+}
+
+func TestRunSimulation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Mode = modeSimulate
+	cfg.MetricsAddress = ""
+	cfg.ResourceNums = 4
+	assert.Nil(t, cfg.validate())
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- runSimulation(cfg, stop) }()
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	assert.Nil(t, <-done)
+	// The temporary plugin directory is removed
+	_, err := os.Stat(cfg.DevicePluginDir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,2 +1,3 @@
 #!/bin/bash
-./bitfusion-device-plugin $INTERVAL  $SOCKET_NAME $RESOURCE_NAME  $RESOURCE_NUMS -logtostderr=true
+# The configuration is read from the environment, see the flags of bitfusion-device-plugin
+./bitfusion-device-plugin -logtostderr=true "$@"
@@ -3,13 +3,17 @@ module github.com/vmware/bitfusion-device-plugin
 go 1.14
 
 require (
-	github.com/gogo/protobuf v1.3.2 // indirect
-	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
-	github.com/stretchr/testify v1.4.0
-	golang.org/x/net v0.17.0
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/golang/glog v1.1.0 // minimum version required by google.golang.org/grpc v1.56.3
+	github.com/prometheus/client_golang v1.16.0
+	github.com/stretchr/testify v1.8.3 // minimum version required by google.golang.org/grpc v1.56.3 through envoyproxy/go-control-plane
+	golang.org/x/net v0.23.0
 	google.golang.org/grpc v1.56.3
-	k8s.io/kubelet v0.19.6
-        k8s.io/client-go v0.19.6
+	gopkg.in/yaml.v2 v2.4.0
+	k8s.io/api v0.28.15
+	k8s.io/apimachinery v0.28.15
+	k8s.io/client-go v0.28.15
+	k8s.io/kubelet v0.28.15
 )
 
 replace (
@@ -13,6 +13,7 @@ import (
 	"fmt"
 
 	"github.com/golang/glog"
+	"github.com/vmware/bitfusion-device-plugin/pkg/registry"
 	"github.com/vmware/bitfusion-device-plugin/pkg/validationwebhook"
 	mutatingWebhook "github.com/vmware/bitfusion-device-plugin/pkg/webhook"
 
@@ -20,10 +21,11 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 // Build a map to store Bitfusion client information
-func buildBitfusionClientMap(distroInfo *mutatingWebhook.BitfusionClientDistro) *map[string]map[string]mutatingWebhook.BFClientConfig {
+func buildBitfusionClientMap(distroInfo *mutatingWebhook.BitfusionClientDistro) map[string]map[string]mutatingWebhook.BFClientConfig {
 	clientMap := make(map[string]map[string]mutatingWebhook.BFClientConfig)
 	for _, bfClient := range distroInfo.BitfusionClients {
 		if _, has := clientMap[bfClient.OSVersion]; !has {
@@ -32,7 +34,7 @@ func buildBitfusionClientMap(distroInfo *mutatingWebhook.BitfusionClientDistro)
 		clientMap[bfClient.OSVersion][bfClient.BitfusionVersion] = mutatingWebhook.BFClientConfig{
 			BinaryPath: bfClient.BinaryPath, EnvVariable: bfClient.EnvVariable}
 	}
-	return &clientMap
+	return clientMap
 }
 
 func main() {
@@ -54,6 +56,9 @@ func main() {
 		"/etc/webhook/bitfusion-client-config/bitfusion-client-config.yaml",
 		"File containing the Bitfusion client configuration.")
 
+	flag.BoolVar(&parameters.ResolveImageCommand, "resolveImageCommand", false,
+		"Look up the entrypoint and cmd of the images of containers without a command in their registry.")
+
 	flag.Parse()
 
 	distroInfo, err := mutatingWebhook.ConstructBitfusionDistroInfo(parameters.BitfusionClientConfig)
@@ -61,8 +66,6 @@ func main() {
 		glog.Errorf("Failed to build Bitfusion distro info")
 	}
 
-	mutatingWebhook.BitfusionClientMap = buildBitfusionClientMap(distroInfo)
-
 	sidecarConfig, err := mutatingWebhook.LoadConfig(parameters.SidecarCfgFile)
 	if err != nil {
 		glog.Errorf("Failed to load configuration: %v", err)
@@ -74,12 +77,16 @@ func main() {
 	}
 
 	mutatingWebhookSv := &mutatingWebhook.WebhookServer{
-		SidecarConfig: sidecarConfig,
+		SidecarConfig:      sidecarConfig,
+		BitfusionClientMap: buildBitfusionClientMap(distroInfo),
 		Server: &http.Server{
 			Addr:      fmt.Sprintf(":%v", parameters.Port),
 			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
 		},
 	}
+	if parameters.ResolveImageCommand {
+		mutatingWebhookSv.ImageResolver = registry.NewClient(&http.Client{Timeout: 10 * time.Second})
+	}
 
 	validateWebhookSv := &validationwebhook.ValidateWebhookServer{
 		Server: &http.Server{
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package admissionreview serves AdmissionReviews of admission.k8s.io/v1 and v1beta1.
+// The request is handed to the webhook as v1 and the response is sent back in the version of the request
+package admissionreview
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+)
+
+var (
+	runtimeScheme = runtime.NewScheme()
+	codecs        = serializer.NewCodecFactory(runtimeScheme)
+	deserializer  = codecs.UniversalDeserializer()
+)
+
+func init() {
+	_ = admissionv1.AddToScheme(runtimeScheme)
+	_ = v1beta1.AddToScheme(runtimeScheme)
+}
+
+// Handler admits the request of a review
+type Handler func(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse
+
+// Review is a received AdmissionReview with its request converted to v1
+type Review struct {
+	// GroupVersionKind the review was sent in, the response is encoded in it
+	GroupVersionKind schema.GroupVersionKind
+	Request          *admissionv1.AdmissionRequest
+}
+
+// Decode decodes an AdmissionReview of admission.k8s.io/v1 or v1beta1.
+// A review the version of which can't be read is answered in v1
+func Decode(body []byte) (*Review, error) {
+	review := &Review{GroupVersionKind: admissionv1.SchemeGroupVersion.WithKind("AdmissionReview")}
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
+		// Answer in the version of the review if it is a known one
+		if gvk != nil && gvk.Kind == "AdmissionReview" &&
+			(gvk.GroupVersion() == admissionv1.SchemeGroupVersion || gvk.GroupVersion() == v1beta1.SchemeGroupVersion) {
+			review.GroupVersionKind = *gvk
+		}
+		return review, err
+	}
+	switch ar := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		review.Request = ar.Request
+	case *v1beta1.AdmissionReview:
+		review.GroupVersionKind = *gvk
+		if ar.Request != nil {
+			// v1 has the same fields as v1beta1
+			review.Request = &admissionv1.AdmissionRequest{}
+			if err := convert(ar.Request, review.Request); err != nil {
+				return review, err
+			}
+		}
+	default:
+		return review, fmt.Errorf("unexpected object %v, expect an AdmissionReview ", gvk)
+	}
+	if review.Request == nil {
+		return review, fmt.Errorf("AdmissionReview has no request ")
+	}
+	return review, nil
+}
+
+// Encode encodes the review with resp in the version of the request, the response UID is the request UID
+func (review *Review) Encode(resp *admissionv1.AdmissionResponse) ([]byte, error) {
+	if resp == nil {
+		resp = &admissionv1.AdmissionResponse{}
+	}
+	if review.Request != nil {
+		resp.UID = review.Request.UID
+	}
+	typeMeta := metav1.TypeMeta{
+		APIVersion: review.GroupVersionKind.GroupVersion().String(),
+		Kind:       "AdmissionReview",
+	}
+	if review.GroupVersionKind.GroupVersion() == v1beta1.SchemeGroupVersion {
+		out := &v1beta1.AdmissionReview{TypeMeta: typeMeta, Response: &v1beta1.AdmissionResponse{}}
+		if err := convert(resp, out.Response); err != nil {
+			return nil, err
+		}
+		return json.Marshal(out)
+	}
+	return json.Marshal(&admissionv1.AdmissionReview{TypeMeta: typeMeta, Response: resp})
+}
+
+// convert copies in to out, a request or response of admission.k8s.io/v1 and v1beta1 which share their JSON encoding
+func convert(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("can't convert AdmissionReview: %v ", err)
+	}
+	return nil
+}
+
+// Serve reads the AdmissionReview of r, admits it with handler and writes the review with the response to w
+func Serve(w http.ResponseWriter, r *http.Request, handler Handler) {
+	var body []byte
+	if r.Body != nil {
+		if data, err := ioutil.ReadAll(r.Body); err == nil {
+			body = data
+		}
+	}
+	if len(body) == 0 {
+		glog.Error("Empty body")
+		http.Error(w, "Empty body", http.StatusBadRequest)
+		return
+	}
+
+	// Verify the content type is accurate
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		glog.Errorf("Content-Type=%s, expect application/json", contentType)
+		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var admissionResponse *admissionv1.AdmissionResponse
+	review, err := Decode(body)
+	if err != nil {
+		glog.Errorf("Can't decode body: %v", err)
+		admissionResponse = &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	} else {
+		admissionResponse = handler(review.Request)
+	}
+
+	resp, err := review.Encode(admissionResponse)
+	if err != nil {
+		glog.Errorf("Can't encode response: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("Ready to write %s response ...", review.GroupVersionKind.GroupVersion())
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package admissionreview
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+)
+
+func TestDecodeEncode(t *testing.T) {
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		body := []byte(`{"apiVersion":"` + apiVersion + `","kind":"AdmissionReview",` +
+			`"request":{"uid":"uid-1","namespace":"default","operation":"CREATE","object":{"kind":"Pod"}}}`)
+		review, err := Decode(body)
+		if !assert.Nil(t, err, apiVersion) {
+			continue
+		}
+		assert.Equal(t, apiVersion, review.GroupVersionKind.GroupVersion().String())
+		assert.Equal(t, "uid-1", string(review.Request.UID))
+		assert.Equal(t, admissionv1.Create, review.Request.Operation)
+		assert.Equal(t, `{"kind":"Pod"}`, string(review.Request.Object.Raw))
+
+		patchType := admissionv1.PatchTypeJSONPatch
+		data, err := review.Encode(&admissionv1.AdmissionResponse{Allowed: true, Patch: []byte("[]"), PatchType: &patchType})
+		assert.Nil(t, err)
+		var out v1beta1.AdmissionReview
+		assert.Nil(t, json.Unmarshal(data, &out))
+		assert.Equal(t, apiVersion, out.APIVersion)
+		assert.Equal(t, "AdmissionReview", out.Kind)
+		assert.Equal(t, "uid-1", string(out.Response.UID))
+		assert.True(t, out.Response.Allowed)
+		assert.Equal(t, v1beta1.PatchTypeJSONPatch, *out.Response.PatchType)
+	}
+
+	// Reviews of an unknown version or without a request are answered in v1
+	for _, body := range []string{
+		`{"apiVersion":"admission.k8s.io/v2","kind":"AdmissionReview","request":{"uid":"uid-1"}}`,
+		`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`,
+		`{"apiVersion":"v1","kind":"Pod"}`,
+	} {
+		review, err := Decode([]byte(body))
+		assert.NotNil(t, err, body)
+		assert.Equal(t, "admission.k8s.io/v1", review.GroupVersionKind.GroupVersion().String(), body)
+	}
+}
@@ -0,0 +1,433 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package registry looks up the config of container images with the Docker Registry HTTP API V2.
+// Only anonymous access is supported, as public images such as the NGC images allow
+package registry
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+
+	dockerHub         = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+
+	// defaultMaxConfigs is the number of image configs a client caches by default
+	defaultMaxConfigs = 1024
+	// defaultTimeout bounds the requests of a client created without an http.Client
+	defaultTimeout = 10 * time.Second
+	// maxResponseSize bounds the manifests and configs read from a registry, maxTokenSize the token responses
+	maxResponseSize = 4 << 20
+	maxTokenSize    = 64 << 10
+	// maxRedirects bounds the redirects of a token request
+	maxRedirects = 10
+)
+
+// ImageConfig is the command an image runs by default
+type ImageConfig struct {
+	Entrypoint []string
+	Cmd        []string
+}
+
+// Client looks up image configs and caches them by manifest digest
+type Client struct {
+	httpClient *http.Client
+	// OS and Architecture select the manifest of a multi-platform image
+	OS           string
+	Architecture string
+	// MaxConfigs is the number of image configs cached, the least recently used one is evicted beyond it
+	MaxConfigs int
+	// allowAddress reports whether a token realm may be fetched from an address, public ones by default
+	allowAddress func(ip net.IP) bool
+
+	mu sync.Mutex
+	// configs holds the elements of lru by manifest digest, the front of lru is the most recently used config
+	configs map[string]*list.Element
+	lru     *list.List
+}
+
+// cachedConfig is an element of the lru list of a client
+type cachedConfig struct {
+	digest string
+	config *ImageConfig
+}
+
+// NewClient returns a client for linux/amd64 images sending its requests with httpClient
+func NewClient(httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultTimeout}
+	}
+	return &Client{
+		httpClient:   httpClient,
+		OS:           "linux",
+		Architecture: "amd64",
+		MaxConfigs:   defaultMaxConfigs,
+		allowAddress: publicAddress,
+		configs:      make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+// reference is a parsed image name
+type reference struct {
+	// registry is the host of the registry API
+	registry   string
+	repository string
+	// tag or digest of the image
+	reference string
+}
+
+// parseReference splits an image name such as nvcr.io/nvidia/tensorflow:19.07-py3 into its registry, repository
+// and tag or digest. Images without a registry are on Docker Hub
+func parseReference(image string) reference {
+	name, ref := image, "latest"
+	if i := strings.Index(name, "@"); i != -1 {
+		name, ref = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i:], "/") {
+		name, ref = name[:i], name[i+1:]
+	}
+	registry := dockerHub
+	if i := strings.Index(name, "/"); i != -1 {
+		if domain := name[:i]; strings.ContainsAny(domain, ".:") || domain == "localhost" {
+			registry, name = domain, name[i+1:]
+		}
+	}
+	if registry == dockerHub {
+		registry = dockerHubRegistry
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+	return reference{registry: registry, repository: name, reference: ref}
+}
+
+// isDigest reports whether ref is a content digest such as sha256:...
+func isDigest(ref string) bool {
+	return strings.Contains(ref, ":")
+}
+
+// manifest is an image manifest or a list of the manifests of several platforms
+type manifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// ImageConfig returns the Entrypoint and Cmd of an image. Images named by digest are answered from the cache
+// without a request, images named by tag cost a manifest request while their config is cached
+func (c *Client) ImageConfig(ctx context.Context, image string) (*ImageConfig, error) {
+	ref := parseReference(image)
+	if isDigest(ref.reference) {
+		if config := c.cached(ref.reference); config != nil {
+			return config, nil
+		}
+	}
+	session := &session{client: c, ref: ref}
+
+	digest, m, err := session.manifest(ctx, ref.reference)
+	if err != nil {
+		return nil, err
+	}
+	if config := c.cached(digest); config != nil {
+		return config, nil
+	}
+	if len(m.Manifests) != 0 {
+		platform := ""
+		for _, entry := range m.Manifests {
+			if entry.Platform.OS == c.OS && entry.Platform.Architecture == c.Architecture {
+				platform = entry.Digest
+				break
+			}
+		}
+		if platform == "" {
+			return nil, fmt.Errorf("image %s has no %s/%s manifest ", image, c.OS, c.Architecture)
+		}
+		if _, m, err = session.manifest(ctx, platform); err != nil {
+			return nil, err
+		}
+	}
+	if m.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest of image %s has no config ", image)
+	}
+
+	data, _, err := session.get(ctx, "/blobs/"+m.Config.Digest, "")
+	if err != nil {
+		return nil, err
+	}
+	var blob struct {
+		Config ImageConfig `json:"config"`
+	}
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return nil, fmt.Errorf("can't decode config of image %s: %v ", image, err)
+	}
+	glog.Infof("Image %s (%s) has entrypoint %q and cmd %q", image, digest, blob.Config.Entrypoint, blob.Config.Cmd)
+
+	c.cache(digest, &blob.Config)
+	return &blob.Config, nil
+}
+
+// cached returns the config of a manifest digest if it is known
+func (c *Client) cached(digest string) *ImageConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.configs[digest]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cachedConfig).config
+}
+
+// cache adds the config of a manifest digest, evicting the least recently used configs beyond MaxConfigs
+func (c *Client) cache(digest string, config *ImageConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.configs[digest]; ok {
+		element.Value.(*cachedConfig).config = config
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.configs[digest] = c.lru.PushFront(&cachedConfig{digest: digest, config: config})
+	for c.lru.Len() > c.MaxConfigs && c.lru.Len() > 1 {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.configs, oldest.Value.(*cachedConfig).digest)
+	}
+}
+
+// session sends the requests of one lookup, reusing the token of the repository
+type session struct {
+	client *Client
+	ref    reference
+	token  string
+}
+
+// manifest fetches a manifest by tag or digest and returns its digest
+func (s *session) manifest(ctx context.Context, ref string) (string, *manifest, error) {
+	accept := strings.Join([]string{mediaTypeDockerManifestList, mediaTypeOCIIndex, mediaTypeDockerManifest, mediaTypeOCIManifest}, ", ")
+	data, header, err := s.get(ctx, "/manifests/"+ref, accept)
+	if err != nil {
+		return "", nil, err
+	}
+	digest := header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", nil, fmt.Errorf("can't decode manifest %s of %s: %v ", ref, s.ref.repository, err)
+	}
+	return digest, &m, nil
+}
+
+// get sends a GET request for a path of the repository, fetching an anonymous token if the registry asks for one
+func (s *session) get(ctx context.Context, path, accept string) ([]byte, http.Header, error) {
+	u := "https://" + s.ref.registry + "/v2/" + s.ref.repository + path
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req = req.WithContext(ctx)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		resp, err := s.client.httpClient.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := readAll(resp.Body, maxResponseSize)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("GET %s: %v ", u, err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			if s.token, err = s.fetchToken(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("GET %s: %s ", u, resp.Status)
+		}
+		return data, resp.Header, nil
+	}
+}
+
+// challengeParamRegexp matches a parameter of a WWW-Authenticate challenge, such as realm="https://auth.docker.io/token"
+var challengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// fetchToken fetches an anonymous token for the Bearer challenge of the registry
+func (s *session) fetchToken(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", fmt.Errorf("registry %s asks for unsupported authentication %q ", s.ref.registry, challenge)
+	}
+	params := make(map[string]string)
+	for _, m := range challengeParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("registry %s sent no token realm in %q ", s.ref.registry, challenge)
+	}
+	if err := s.checkRealm(ctx, realm); err != nil {
+		return "", err
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + s.ref.repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	// The redirects of the realm are checked as the realm itself
+	tokenClient := *s.client.httpClient
+	tokenClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects ", maxRedirects)
+		}
+		return s.checkRealm(req.Context(), req.URL)
+	}
+	resp, err := tokenClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET token of %s: %s ", s.ref.repository, resp.Status)
+	}
+	data, err := readAll(resp.Body, maxTokenSize)
+	if err != nil {
+		return "", fmt.Errorf("GET token of %s: %v ", s.ref.repository, err)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", fmt.Errorf("can't decode token of %s: %v ", s.ref.repository, err)
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// checkRealm rejects token realms which aren't https or whose host is internal, so that a registry can't make the
+// webhook send requests into the cluster. A realm on the host of the registry itself is always allowed
+func (s *session) checkRealm(ctx context.Context, realm *url.URL) error {
+	if realm.Scheme != "https" {
+		return fmt.Errorf("registry %s sent token realm %s which isn't https ", s.ref.registry, realm)
+	}
+	if realm.Host == s.ref.registry {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(realm.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".local") || strings.HasSuffix(host, ".svc") ||
+		strings.HasSuffix(host, ".internal") {
+		return fmt.Errorf("registry %s sent token realm %s on an internal host ", s.ref.registry, realm)
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("can't resolve token realm %s of registry %s: %v ", realm, s.ref.registry, err)
+		}
+		ips = ips[:0]
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !s.client.allowAddress(ip) {
+			return fmt.Errorf("registry %s sent token realm %s on internal address %s ", s.ref.registry, realm, ip)
+		}
+	}
+	return nil
+}
+
+// privateNetworks are the private, unique local and shared address ranges
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// publicAddress reports whether ip is neither loopback, link-local, private nor unspecified
+func publicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// readAll reads r up to limit bytes, a longer response is an error
+func readAll(r io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("response is larger than %d bytes ", limit)
+	}
+	return data, nil
+}
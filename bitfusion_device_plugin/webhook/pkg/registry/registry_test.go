@@ -0,0 +1,219 @@
+/*
+ * Copyright 2020 VMware, Inc.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReference(t *testing.T) {
+	for image, want := range map[string]reference{
+		"nvcr.io/nvidia/tensorflow:19.07-py3": {"nvcr.io", "nvidia/tensorflow", "19.07-py3"},
+		"ubuntu":                              {"registry-1.docker.io", "library/ubuntu", "latest"},
+		"bitfusiondeviceplugin/bitfusion-client:test": {"registry-1.docker.io", "bitfusiondeviceplugin/bitfusion-client", "test"},
+		"localhost:5000/train":                        {"localhost:5000", "train", "latest"},
+		"harbor.local:8443/ai/train@sha256:abcd":      {"harbor.local:8443", "ai/train", "sha256:abcd"},
+	} {
+		assert.Equal(t, want, parseReference(image), image)
+	}
+}
+
+// fakeRegistry is a stand-in registry serving one multi-platform image behind an anonymous token
+type fakeRegistry struct {
+	mu       sync.Mutex
+	requests map[string]int
+	// realm is sent in the challenge instead of the /token path of the registry
+	realm string
+}
+
+func (f *fakeRegistry) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests[r.URL.Path]++
+	f.mu.Unlock()
+	if r.URL.Path == "/token" {
+		scope := r.URL.Query().Get("scope")
+		if !strings.HasPrefix(scope, "repository:nvidia/") || !strings.HasSuffix(scope, ":pull") || r.URL.Query().Get("service") != "fake" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "anonymous"})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer anonymous" {
+		realm := f.realm
+		if realm == "" {
+			realm = "https://" + r.Host + "/token"
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`",service="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/v2/nvidia/tensorflow/manifests/19.07-py3", "/v2/nvidia/tensorflow/manifests/sha256:list":
+		w.Header().Set("Docker-Content-Digest", "sha256:list")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mediaType": mediaTypeDockerManifestList,
+			"manifests": []map[string]interface{}{
+				{"digest": "sha256:arm64", "platform": map[string]string{"os": "linux", "architecture": "arm64"}},
+				{"digest": "sha256:amd64", "platform": map[string]string{"os": "linux", "architecture": "amd64"}},
+			},
+		})
+	case "/v2/nvidia/tensorflow/manifests/sha256:amd64":
+		w.Header().Set("Docker-Content-Digest", "sha256:amd64")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mediaType": mediaTypeDockerManifest,
+			"config":    map[string]string{"digest": "sha256:config"},
+		})
+	case "/v2/nvidia/tensorflow/blobs/sha256:large":
+		w.Write(make([]byte, maxResponseSize+1))
+	case "/v2/nvidia/tensorflow/blobs/sha256:config":
+		w.Write([]byte(`{"architecture":"amd64","config":{"Entrypoint":["/usr/local/bin/nvidia_entrypoint.sh"],"Cmd":["python","train.py"]}}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestImageConfig(t *testing.T) {
+	registry := &fakeRegistry{requests: make(map[string]int)}
+	server := httptest.NewTLSServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	client := NewClient(server.Client())
+
+	want := &ImageConfig{Entrypoint: []string{"/usr/local/bin/nvidia_entrypoint.sh"}, Cmd: []string{"python", "train.py"}}
+	config, err := client.ImageConfig(context.Background(), host+"/nvidia/tensorflow:19.07-py3")
+	if assert.Nil(t, err) {
+		assert.Equal(t, want, config)
+	}
+	assert.Equal(t, 1, registry.count("/token"))
+	assert.Equal(t, 1, registry.count("/v2/nvidia/tensorflow/blobs/sha256:config"))
+
+	// The config is cached by digest, a tag costs only its manifest and a digest no request at all
+	config, err = client.ImageConfig(context.Background(), host+"/nvidia/tensorflow:19.07-py3")
+	if assert.Nil(t, err) {
+		assert.Equal(t, want, config)
+	}
+	assert.Equal(t, 1, registry.count("/v2/nvidia/tensorflow/blobs/sha256:config"))
+	manifests := registry.count("/v2/nvidia/tensorflow/manifests/19.07-py3")
+	config, err = client.ImageConfig(context.Background(), host+"/nvidia/tensorflow@sha256:list")
+	if assert.Nil(t, err) {
+		assert.Equal(t, want, config)
+	}
+	assert.Equal(t, manifests, registry.count("/v2/nvidia/tensorflow/manifests/19.07-py3"))
+	assert.Equal(t, 0, registry.count("/v2/nvidia/tensorflow/manifests/sha256:list"))
+
+	// Unknown images and platforms are errors
+	_, err = client.ImageConfig(context.Background(), host+"/nvidia/pytorch:20.01-py3")
+	assert.NotNil(t, err)
+	client = NewClient(server.Client())
+	client.Architecture = "ppc64le"
+	_, err = client.ImageConfig(context.Background(), host+"/nvidia/tensorflow:19.07-py3")
+	assert.NotNil(t, err)
+}
+
+func TestCacheEviction(t *testing.T) {
+	client := NewClient(nil)
+	client.MaxConfigs = 2
+	first, second, third := &ImageConfig{Cmd: []string{"1"}}, &ImageConfig{Cmd: []string{"2"}}, &ImageConfig{Cmd: []string{"3"}}
+
+	client.cache("sha256:1", first)
+	client.cache("sha256:2", second)
+	// Using the first config makes the second one the least recently used
+	assert.Equal(t, first, client.cached("sha256:1"))
+	client.cache("sha256:3", third)
+
+	assert.Equal(t, first, client.cached("sha256:1"))
+	assert.Nil(t, client.cached("sha256:2"))
+	assert.Equal(t, third, client.cached("sha256:3"))
+	assert.Len(t, client.configs, 2)
+	assert.Equal(t, 2, client.lru.Len())
+}
+
+func TestTokenRealm(t *testing.T) {
+	tokens := &fakeRegistry{requests: make(map[string]int)}
+	tokenServer := httptest.NewTLSServer(tokens)
+	defer tokenServer.Close()
+	registry := &fakeRegistry{requests: make(map[string]int)}
+	server := httptest.NewTLSServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	redirect := httptest.NewTLSServer(http.RedirectHandler("https://169.254.169.254/token", http.StatusFound))
+	defer redirect.Close()
+
+	// Realms which aren't https or are on internal addresses of another host are rejected
+	for _, realm := range []string{
+		"http://" + host + "/token",
+		tokenServer.URL + "/token",
+		"https://169.254.169.254/token",
+		"https://[::1]/token",
+		"https://kube-dns.kube-system.svc/token",
+		"https://metadata.google.internal/token",
+	} {
+		registry.realm = realm
+		_, err := NewClient(server.Client()).ImageConfig(context.Background(), host+"/nvidia/tensorflow:19.07-py3")
+		assert.NotNil(t, err, realm)
+	}
+	assert.Equal(t, 0, tokens.count("/token"))
+
+	// An allowed realm is fetched, its redirects are checked too
+	client := NewClient(server.Client())
+	client.allowAddress = func(ip net.IP) bool { return ip.IsLoopback() }
+	registry.realm = tokenServer.URL + "/token"
+	_, err := client.ImageConfig(context.Background(), host+"/nvidia/tensorflow:19.07-py3")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, tokens.count("/token"))
+	registry.realm = redirect.URL + "/token"
+	_, err = client.ImageConfig(context.Background(), host+"/nvidia/tensorflow:latest")
+	assert.NotNil(t, err)
+}
+
+func TestResponseSize(t *testing.T) {
+	registry := &fakeRegistry{requests: make(map[string]int)}
+	server := httptest.NewTLSServer(registry)
+	defer server.Close()
+	ref := parseReference(strings.TrimPrefix(server.URL, "https://") + "/nvidia/tensorflow:19.07-py3")
+	session := &session{client: NewClient(server.Client()), ref: ref}
+
+	_, _, err := session.get(context.Background(), "/blobs/sha256:large", "")
+	assert.NotNil(t, err)
+	_, _, err = session.get(context.Background(), "/blobs/sha256:config", "")
+	assert.Nil(t, err)
+}
+
+func TestPublicAddress(t *testing.T) {
+	for address, public := range map[string]bool{
+		"8.8.8.8":         true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"10.96.0.1":       false,
+		"172.20.0.10":     false,
+		"192.168.1.1":     false,
+		"100.64.0.1":      false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+	} {
+		assert.Equal(t, public, publicAddress(net.ParseIP(address)), address)
+	}
+}
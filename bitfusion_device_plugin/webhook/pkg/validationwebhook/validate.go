@@ -8,19 +8,16 @@ package validationwebhook
 
 import (
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strings"
 
 	"github.com/golang/glog"
+	"github.com/vmware/bitfusion-device-plugin/pkg/admissionreview"
 	"golang.org/x/net/context"
-	"k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -34,91 +31,17 @@ type ValidateWebhookServer struct {
 	Server *http.Server
 }
 
-var (
-	runtimeScheme = runtime.NewScheme()
-	codecs        = serializer.NewCodecFactory(runtimeScheme)
-	deserializer  = codecs.UniversalDeserializer()
-)
-
-// Serve method for webhook server
+// Serve method for webhook server, it answers AdmissionReviews of admission.k8s.io/v1 and v1beta1
 func (webhookServer *ValidateWebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
-
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
-		}
-	}
-	if len(body) == 0 {
-		glog.Error("Empty body")
-		http.Error(w, "Empty body", http.StatusBadRequest)
-		return
-	}
-
-	// Verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		glog.Errorf("Content-Type=%s, expect application/json", contentType)
-		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
-		return
-	}
-
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
-	} else {
-		var pod corev1.Pod
-		req := ar.Request
-		if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return
-		}
-
-		glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-			req.Kind, req.Namespace, req.Name, pod.Name, req.UID, req.Operation, req.UserInfo)
-
-		// Call some functions to check resource
-		admissionResponse = webhookServer.validate(&ar)
-	}
-
-	admissionReview := v1beta1.AdmissionReview{}
-	admissionReview.Kind = "AdmissionReview"
-	admissionReview.APIVersion = "admission.k8s.io/v1"
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
-		}
-	}
-
-	resp, err := json.Marshal(admissionReview)
-
-	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
-	}
-	glog.Infof("Validating webhook ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
-		glog.Errorf("Can't write response: %v", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
-	}
-
+	admissionreview.Serve(w, r, webhookServer.validate)
 }
 
 // validate application resource exists
-func (webhookServer *ValidateWebhookServer) validate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
+func (webhookServer *ValidateWebhookServer) validate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		glog.Errorf("Could not unmarshal raw object: %v", err)
-		return &v1beta1.AdmissionResponse{
+		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
@@ -148,7 +71,7 @@ func (webhookServer *ValidateWebhookServer) validate(ar *v1beta1.AdmissionReview
 		if err != nil {
 			glog.Error("InClusterConfig Failed")
 			glog.Error(err.Error())
-			return &v1beta1.AdmissionResponse{
+			return &admissionv1.AdmissionResponse{
 				Result: &metav1.Status{
 					Message: err.Error(),
 				},
@@ -198,7 +121,7 @@ func (webhookServer *ValidateWebhookServer) validate(ar *v1beta1.AdmissionReview
 				if !ok {
 					glog.Infof("Resource validation failed")
 					war := []string{"Resource validation failed"}
-					return &v1beta1.AdmissionResponse{
+					return &admissionv1.AdmissionResponse{
 						Allowed:  false,
 						Warnings: war,
 						Result: &metav1.Status{
@@ -209,14 +132,14 @@ func (webhookServer *ValidateWebhookServer) validate(ar *v1beta1.AdmissionReview
 			}
 
 		}
-		return &v1beta1.AdmissionResponse{
+		return &admissionv1.AdmissionResponse{
 			Allowed: true,
 		}
 
 	}
 
-	return &v1beta1.AdmissionResponse{
-		UID:     ar.Request.UID,
+	return &admissionv1.AdmissionResponse{
+		UID:     req.UID,
 		Allowed: true,
 	}
 
@@ -8,12 +8,15 @@ package validationwebhook
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
-	"k8s.io/api/admission/v1beta1"
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
 )
@@ -36,11 +39,9 @@ func conver(path string) []byte {
 }
 
 func TestValidateWebhookServer_Validate(t *testing.T) {
-	ar := v1beta1.AdmissionReview{
-		Request: &v1beta1.AdmissionRequest{
-			Object: runtime.RawExtension{
-				Raw: conver(PodPath),
-			},
+	req := admissionv1.AdmissionRequest{
+		Object: runtime.RawExtension{
+			Raw: conver(PodPath),
 		},
 	}
 	validateWebhookSv := &ValidateWebhookServer{
@@ -49,17 +50,56 @@ func TestValidateWebhookServer_Validate(t *testing.T) {
 			//TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
 		},
 	}
-	admissionResponse := validateWebhookSv.validate(&ar)
+	admissionResponse := validateWebhookSv.validate(&req)
 	t.Log(admissionResponse)
-	ar = v1beta1.AdmissionReview{
-		Request: &v1beta1.AdmissionRequest{
-			Object: runtime.RawExtension{
-				Raw: []byte(""),
-			},
+	assert.Equal(t, admissionResponse.Allowed, true)
+	req = admissionv1.AdmissionRequest{
+		Object: runtime.RawExtension{
+			Raw: []byte(""),
 		},
 	}
-	admissionResponse = validateWebhookSv.validate(&ar)
+	admissionResponse = validateWebhookSv.validate(&req)
 
 	t.Log(admissionResponse)
-	assert.Equal(t, admissionResponse.Allowed, true)
+	assert.Equal(t, admissionResponse.Allowed, false)
+}
+
+func TestValidateWebhookServer_Serve(t *testing.T) {
+	validateWebhookSv := &ValidateWebhookServer{}
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		body, _ := json.Marshal(map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       "AdmissionReview",
+			"request": admissionv1.AdmissionRequest{
+				UID:       "705ab4f5-6393-11e8-b7cc-42010a800002",
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: conver(PodPath)},
+			},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		validateWebhookSv.Serve(rec, req)
+
+		var review struct {
+			APIVersion string                         `json:"apiVersion"`
+			Kind       string                         `json:"kind"`
+			Response   *admissionv1.AdmissionResponse `json:"response"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, apiVersion, review.APIVersion)
+		assert.Equal(t, "AdmissionReview", review.Kind)
+		if assert.NotNil(t, review.Response, apiVersion) {
+			assert.Equal(t, "705ab4f5-6393-11e8-b7cc-42010a800002", string(review.Response.UID))
+			assert.True(t, review.Response.Allowed, apiVersion)
+		}
+	}
+
+	// A request which isn't a JSON AdmissionReview is rejected
+	req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader([]byte("{}")))
+	rec := httptest.NewRecorder()
+	validateWebhookSv.Serve(rec, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
 }
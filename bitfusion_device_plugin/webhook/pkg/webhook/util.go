@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
+	"github.com/vmware/bitfusion-device-plugin/pkg/registry"
 	yamlv2 "gopkg.in/yaml.v2"
 	"io/ioutil"
 	corev1 "k8s.io/api/core/v1"
@@ -23,22 +24,76 @@ import (
 	"k8s.io/client-go/rest"
 	"math"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
-// addContainer adds container to pod
-func addContainer(target, added []corev1.Container, basePath string, bfClientConfig BFClientConfig) (patch []patchOperation) {
+// clientOpt is the copy of /opt/bitfusion of one Bitfusion client of the pod
+type clientOpt struct {
+	// source is /opt/bitfusion of the client in the Bitfusion distro
+	source string
+	volume string
+	// initPath is where the init container mounts the volume to copy source into
+	initPath string
+}
+
+// clientOptPath returns /opt/bitfusion of a client in the Bitfusion distro, found in its LD_LIBRARY_PATH
+func clientOptPath(client BFClientConfig) string {
+	index := strings.Index(client.EnvVariable, "/opt/bitfusion")
+	if index == -1 {
+		glog.Warningf("LD_LIBRARY_PATH %s of Bitfusion client %s has no /opt/bitfusion", client.EnvVariable, client.BinaryPath)
+		index = 0
+	}
+	return client.EnvVariable[0:index] + "/opt/bitfusion"
+}
+
+// clientOpts returns the copies of /opt/bitfusion of the pod. The first one, of mutation.clientConfig, is in the
+// volume of the sidecar config, every other client of a Bitfusion container gets a volume of its own
+func clientOpts(containers []corev1.Container, mutation *mutationContext) []clientOpt {
+	opts := []clientOpt{{source: clientOptPath(mutation.clientConfig), volume: optVolume, initPath: optInitPath}}
+	for i := range containers {
+		client, ok := mutation.clients[containers[i].Name]
+		if !ok || !requestsBitfusion(&containers[i]) || clientOptVolume(opts, client) != "" {
+			continue
+		}
+		n := len(opts)
+		opts = append(opts, clientOpt{
+			source:   clientOptPath(client),
+			volume:   fmt.Sprintf("%s-%d", optVolume, n),
+			initPath: fmt.Sprintf("%s-%d", optInitPath, n),
+		})
+	}
+	return opts
+}
+
+// clientOptVolume returns the volume of the copy of /opt/bitfusion of a client, empty if it has none
+func clientOptVolume(opts []clientOpt, client BFClientConfig) string {
+	source := clientOptPath(client)
+	for _, opt := range opts {
+		if opt.source == source {
+			return opt.volume
+		}
+	}
+	return ""
+}
+
+// addContainer adds container to pod, the containers mounting the opt volume copy /opt/bitfusion of every client
+func addContainer(target, added []corev1.Container, basePath string, opts []clientOpt) (patch []patchOperation) {
 	first := len(target) == 0
 
 	var value interface{}
 	for _, add := range added {
-		index := strings.Index(bfClientConfig.EnvVariable, "/opt/bitfusion")
-		optPath := bfClientConfig.EnvVariable[0:index]
 		// /bin/bash, -c, "command"
 		// The original data cannot be changed, the previous approach resulted in changes to the original data，so deep replication is used
 		container := add.DeepCopy()
-		container.Command[2] = strings.Replace(container.Command[2], "BITFUSION_CLIENT_OPT_PATH", optPath+"/opt/bitfusion/*", 1)
+		container.Command[2] = strings.Replace(container.Command[2], "BITFUSION_CLIENT_OPT_PATH", opts[0].source+"/*", 1)
+		if mountsVolume(container, optVolume) {
+			for _, opt := range opts[1:] {
+				container.Command[2] = strings.TrimRight(container.Command[2], " ") + fmt.Sprintf(" && cp -r %s/* %s", opt.source, opt.initPath)
+				container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: opt.volume, MountPath: opt.initPath})
+			}
+		}
 
 		glog.Infof("Command of InitContainer : %v", container.Command[2])
 
@@ -48,6 +103,7 @@ func addContainer(target, added []corev1.Container, basePath string, bfClientCon
 			value = []corev1.Container{*container}
 		} else {
 			path = path + "/-"
+			value = *container
 		}
 		patch = append(patch, patchOperation{
 			Op:    "add",
@@ -58,6 +114,16 @@ func addContainer(target, added []corev1.Container, basePath string, bfClientCon
 	return patch
 }
 
+// mountsVolume reports whether the container mounts the volume
+func mountsVolume(container *corev1.Container, volume string) bool {
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == volume {
+			return true
+		}
+	}
+	return false
+}
+
 func ConstructBitfusionDistroInfo(configFile string) (*BitfusionClientDistro, error) {
 	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
@@ -93,17 +159,86 @@ func getBfVersion(metadata *metav1.ObjectMeta) string {
 	return ""
 }
 
-// updateContainer updates env and volume to container
-func updateContainer(targets, source []corev1.Container, basePath string, bfClientConfig BFClientConfig) (patches []patchOperation) {
+// containerAnnotation returns the annotation key.<container> of a container and falls back to the pod-level key
+func containerAnnotation(annotations map[string]string, key, container string) (string, bool) {
+	if value, has := annotations[key+"."+container]; has {
+		return value, true
+	}
+	value, has := annotations[key]
+	return value, has
+}
+
+// newMutationContext looks up the Bitfusion client of the pod and of each container from the bitfusion-client/os and
+// bitfusion-client/version annotations. It returns nil if neither the pod nor a container names a client
+func newMutationContext(pod *corev1.Pod, clientMap map[string]map[string]BFClientConfig) (*mutationContext, error) {
+	annotations := pod.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	mutation := &mutationContext{
+		injectionMode: injectionMode(&pod.ObjectMeta),
+		clients:       make(map[string]BFClientConfig),
+		annotations:   annotations,
+	}
+	found := false
+	if os, version := getGuestOS(&pod.ObjectMeta), getBfVersion(&pod.ObjectMeta); os != "" && version != "" {
+		client, ok := clientMap[os][version]
+		if !ok {
+			return nil, fmt.Errorf("OS=%v BFVersion=%v ", os, version)
+		}
+		mutation.clientConfig = client
+		found = true
+	}
+	for _, container := range pod.Spec.Containers {
+		os, _ := containerAnnotation(annotations, guestOS, container.Name)
+		version, _ := containerAnnotation(annotations, bfVersion, container.Name)
+		if os == "" || version == "" {
+			continue
+		}
+		client, ok := clientMap[os][version]
+		if !ok {
+			return nil, fmt.Errorf("container %s OS=%v BFVersion=%v ", container.Name, os, version)
+		}
+		mutation.clients[container.Name] = client
+		if !found {
+			mutation.clientConfig = client
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return mutation, nil
+}
+
+// requestsBitfusion reports whether the container requests a Bitfusion resource
+func requestsBitfusion(container *corev1.Container) bool {
+	for _, name := range []corev1.ResourceName{bitFusionGPUResourceNum, bitFusionGPUResourcePartial, bitFusionGPUResourceMemory} {
+		if quantity, has := container.Resources.Requests[name]; has && quantity != zeroQuantity {
+			return true
+		}
+	}
+	return false
+}
+
+// updateContainer updates env and volume to container, the opt volume is the copy of /opt/bitfusion of its client
+func updateContainer(targets, source []corev1.Container, basePath string, mutation *mutationContext, opts []clientOpt) (patches []patchOperation) {
 
 	for i, container := range targets {
-		if container.Resources.Requests[bitFusionGPUResourceNum] == zeroQuantity {
+		bfClientConfig, ok := mutation.clients[container.Name]
+		if !requestsBitfusion(&container) || !ok {
 			// Pass if no Bitfusion resource was required
-			// It will fail on next step if only gpu-percent was provided
+			// It will fail on next step if the container has no Bitfusion client
 			continue
 		}
 
-		container.VolumeMounts = append(container.VolumeMounts, source[0].VolumeMounts...)
+		mounts := len(container.VolumeMounts)
+		container.VolumeMounts = append(append([]corev1.VolumeMount(nil), container.VolumeMounts...), source[0].VolumeMounts...)
+		for j := mounts; j < len(container.VolumeMounts); j++ {
+			if container.VolumeMounts[j].Name == optVolume {
+				container.VolumeMounts[j].Name = clientOptVolume(opts, bfClientConfig)
+			}
+		}
 		patches = append(patches, patchOperation{
 			Op:    "replace",
 			Path:  fmt.Sprintf("%s/%d/volumeMounts", basePath, i),
@@ -119,6 +254,8 @@ func updateContainer(targets, source []corev1.Container, basePath string, bfClie
 				glog.Infof("index = %d", index)
 			}
 		}
+		// The env of the pod is not changed, other containers may share its array
+		container.Env = append([]corev1.EnvVar(nil), container.Env...)
 		if index != -1 {
 			env := corev1.EnvVar{Name: "LD_LIBRARY_PATH", Value: bfClientConfig.EnvVariable + ":" + container.Env[index].Value}
 			container.Env[index] = env
@@ -134,29 +271,54 @@ func updateContainer(targets, source []corev1.Container, basePath string, bfClie
 			Value: container.Env,
 		})
 
-		targets[0] = container
+		targets[i] = container
 
 	}
 	return patches
 }
 
 // createPatch creates mutation patch for resource
-func createPatch(pod *corev1.Pod, sidecarConfig *Config, annotations map[string]string, bfClientConfig BFClientConfig) ([]byte, error) {
+func createPatch(pod *corev1.Pod, sidecarConfig *Config, mutation *mutationContext) ([]byte, error) {
 	var patch []patchOperation
 
 	var err error
-	initContainers := updateInitContainersResources(pod.Spec.Containers, sidecarConfig.InitContainers)
-	patch = append(patch, addContainer(pod.Spec.InitContainers, initContainers, "/spec/initContainers", bfClientConfig)...)
-	patch = append(patch, addVolume(pod.Spec.Volumes, sidecarConfig.Volumes, "/spec/volumes")...)
+	// Every Bitfusion client gets its own copy of /opt/bitfusion
+	opts := clientOpts(pod.Spec.Containers, mutation)
+	volumes := sidecarConfig.Volumes
+	if len(opts) > 1 {
+		var optSource *corev1.Volume
+		for i := range sidecarConfig.Volumes {
+			if sidecarConfig.Volumes[i].Name == optVolume {
+				optSource = &sidecarConfig.Volumes[i]
+			}
+		}
+		if optSource == nil {
+			return nil, fmt.Errorf("containers use several Bitfusion clients, the sidecar config needs the %s volume to copy them ", optVolume)
+		}
+		volumes = append([]corev1.Volume(nil), sidecarConfig.Volumes...)
+		for _, opt := range opts[1:] {
+			volume := optSource.DeepCopy()
+			volume.Name = opt.volume
+			volumes = append(volumes, *volume)
+		}
+	}
+	// The sidecar config is shared by all requests, the resources are set on a copy
+	initContainers := make([]corev1.Container, len(sidecarConfig.InitContainers))
+	for i := range sidecarConfig.InitContainers {
+		sidecarConfig.InitContainers[i].DeepCopyInto(&initContainers[i])
+	}
+	initContainers = updateInitContainersResources(pod.Spec.Containers, initContainers)
+	patch = append(patch, addContainer(pod.Spec.InitContainers, initContainers, "/spec/initContainers", opts)...)
+	patch = append(patch, addVolume(pod.Spec.Volumes, volumes, "/spec/volumes")...)
 	// Need to delete the other annotations
 	patch = append(patch, updateAnnotation(pod.Annotations, map[string]string{admissionWebhookAnnotationStatusKey: "injected"})...)
-	patch = append(patch, updateContainer(pod.Spec.Containers, sidecarConfig.Containers, "/spec/containers", bfClientConfig)...)
+	patch = append(patch, updateContainer(pod.Spec.Containers, sidecarConfig.Containers, "/spec/containers", mutation, opts)...)
 
 	glog.Infof("sidecarConfig: %v", sidecarConfig.InitContainers)
 	glog.Infof("sidecarConfig.Containers: %v", sidecarConfig.Containers[0].VolumeMounts)
 	glog.Infof("patch: %v", patch)
 
-	bfPatch, err := updateBFResource(pod.Spec.Containers, "/spec/containers", bfClientConfig, annotations)
+	bfPatch, err := updateBFResource(pod.Spec.Containers, "/spec/containers", mutation)
 	if err != nil {
 		glog.Errorf("Unable to create json patch for bitfusion resource")
 		return nil, err
@@ -333,156 +495,237 @@ func copySecret(namespace *string) error {
 	return err
 }
 
-// updateBFResource updates resource name and change container's cmd to add Bitfusion
-func updateBFResource(targets []corev1.Container, basePath string, bfClientConfig BFClientConfig, annotations map[string]string) (patches []patchOperation, e error) {
-	if len(targets) == 0 {
-		return patches, nil
+// resolveImageCommands looks up the images of the Bitfusion containers which have no command in mutation.images.
+// A container whose image can't be looked up keeps its command
+func resolveImageCommands(ctx context.Context, pod *corev1.Pod, mutation *mutationContext, resolver ImageResolver) {
+	if mutation.injectionMode == bitFusionOnlyInjection {
+		return
 	}
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		if len(container.Command) != 0 || !requestsBitfusion(container) {
+			continue
+		}
+		if _, ok := mutation.clients[container.Name]; !ok {
+			continue
+		}
+		image, err := resolver.ImageConfig(ctx, container.Image)
+		if err != nil {
+			glog.Warningf("Can't look up the command of image %s of container %s: %v", container.Image, container.Name, err)
+			continue
+		}
+		if mutation.images == nil {
+			mutation.images = make(map[string]*registry.ImageConfig)
+		}
+		mutation.images[container.Name] = image
+	}
+}
 
-	for i, target := range targets {
-		if len(target.Command) != 0 {
-
-			// Check bitFusionGPUResourceNum
-			gpuNum := target.Resources.Requests[bitFusionGPUResourceNum]
-			if gpuNum.Value() <= 0 {
-				return patches, fmt.Errorf("gpuNum.Value() Error ")
-			}
-
-			// Check bitFusionGPUResourcePartial and set fallback
-			gpuPartial := target.Resources.Requests[bitFusionGPUResourcePartial]
-			gpuMemory := target.Resources.Requests[bitFusionGPUResourceMemory]
-			if gpuNum != zeroQuantity && gpuPartial == zeroQuantity {
-				glog.Warning("No Partial was provide, use default value 100 which means 100%")
-				gpuPartial.Set(100)
-				delete(target.Resources.Requests, bitFusionGPUResourceNum)
-				delete(target.Resources.Limits, bitFusionGPUResourceNum)
-			} else if gpuNum != zeroQuantity && gpuPartial != zeroQuantity {
-				delete(target.Resources.Requests, bitFusionGPUResourceNum)
-				delete(target.Resources.Limits, bitFusionGPUResourceNum)
-				delete(target.Resources.Requests, bitFusionGPUResourcePartial)
-				delete(target.Resources.Limits, bitFusionGPUResourcePartial)
-			} else if gpuNum == zeroQuantity && gpuPartial == zeroQuantity {
-				// No patch for this container
-				continue
-			} else {
-				return patches, fmt.Errorf("No gpu num was provided but found percent ")
-			}
-
-			gpuPartialNum := gpuPartial.Value()
+// effectiveCommand returns the command line a container runs, from its command and args and from the entrypoint and
+// cmd of its image like the container runtime. ok is false if it depends on the config of the image which is unknown
+func effectiveCommand(container *corev1.Container, image *registry.ImageConfig) (argv []string, ok bool) {
+	if len(container.Command) != 0 {
+		return append(append([]string{}, container.Command...), container.Args...), true
+	}
+	if image == nil {
+		return nil, false
+	}
+	argv = append([]string{}, image.Entrypoint...)
+	if len(container.Args) != 0 {
+		argv = append(argv, container.Args...)
+	} else {
+		argv = append(argv, image.Cmd...)
+	}
+	return argv, len(argv) != 0
+}
 
-			// Also return error if exceed 100% or equals 0%
-			if gpuPartialNum > 100 || gpuPartialNum <= 0 {
-				return patches, fmt.Errorf("Invalid %s quantity: %d ", bitFusionGPUResourcePartial, gpuPartialNum)
-			}
-			var command string
-			var totalMem resource.Quantity
-			totalMemStr := os.Getenv("TOTAL_GPU_MEMORY")
-			glog.Infof("totalMemStr = %s", totalMemStr)
-			if gpuMemory != zeroQuantity {
-				totalMem = resource.MustParse(totalMemStr)
-				glog.Infof("totalMem = %d", totalMem.Value())
-				glog.Infof("gpuMemory = %v", gpuMemory)
-				m, ok := gpuMemory.AsInt64()
-				if ok {
-					m = m / 1000000
-					glog.Infof("gpuMemory = %d", m)
-					if m <= 0 || m >= totalMem.Value() {
-						glog.Error("Memory value Error")
-						return patches, fmt.Errorf("Memory value Error ")
-					}
-
-					if value, has := annotations[admissionWebhookAnnotationFilterKey]; has {
-						filter := ""
-						for _, v := range strings.Fields(value) {
-							filter += " --filter " + v
-						}
-						command = fmt.Sprintf(bfClientConfig.BinaryPath+" run -n %s -m %d  %s", gpuNum.String(), m, filter)
-					} else {
-						command = fmt.Sprintf(bfClientConfig.BinaryPath+" run -n %s -m %d", gpuNum.String(), m)
-					}
-
-					delete(target.Resources.Requests, bitFusionGPUResourceMemory)
-					delete(target.Resources.Limits, bitFusionGPUResourceMemory)
-				} else {
-					glog.Error("gpuMemory.AsInt64 Error")
-					return patches, fmt.Errorf("gpuMemory.AsInt64 Error")
-
-				}
-			} else {
-
-				if value, has := annotations[admissionWebhookAnnotationFilterKey]; has {
-					filter := ""
-					for _, v := range strings.Fields(value) {
-						filter += " --filter " + v
-					}
-					command = fmt.Sprintf(bfClientConfig.BinaryPath+" run -n %d -p %f %s", gpuNum.Value(), float64(gpuPartialNum)/100.0, filter)
-				} else {
-					command = fmt.Sprintf(bfClientConfig.BinaryPath+" run -n %d -p %f ", gpuNum.Value(), float64(gpuPartialNum)/100.0)
-				}
+// shellCommand returns a command line as the bash script run by "bitfusion run".
+// The script of "/bin/bash -c" and a single command line are run as they are, the other arguments are quoted
+func shellCommand(argv []string) string {
+	if len(argv) == 3 && (strings.ToLower(argv[0]) == "/bin/bash" || argv[0] == "bash") && argv[1] == "-c" {
+		return argv[2]
+	}
+	if len(argv) == 1 {
+		return argv[0]
+	}
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
 
-			}
-			glog.Infof("Command : %s", command)
-			glog.Infof("Request gpu with num %v", gpuNum.Value())
-			glog.Infof("Request gpu with partial %v", gpuPartial.Value())
+// shellSafeRegexp matches the arguments which need no quotes in bash
+var shellSafeRegexp = regexp.MustCompile(`^[A-Za-z0-9_./=:,+@%-]+$`)
 
-			hasPrefix := false
-			for _, v := range target.Command {
+// shellQuote quotes an argument for bash
+func shellQuote(arg string) string {
+	if shellSafeRegexp.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
 
-				if strings.ToLower(v) == "/bin/bash" {
-					continue
-				}
-				if strings.ToLower(v) == "-c" {
-					continue
-				}
+// updateBFResource updates resource name and change container's cmd to add Bitfusion.
+// Every container is handled on its own, the containers without a Bitfusion resource are left untouched
+func updateBFResource(targets []corev1.Container, basePath string, mutation *mutationContext) (patches []patchOperation, e error) {
+	for i := range targets {
+		containerPatches, err := updateBFContainer(&targets[i], basePath+"/"+strconv.Itoa(i), mutation)
+		if err != nil {
+			return patches, fmt.Errorf("container %s: %v ", targets[i].Name, err)
+		}
+		patches = append(patches, containerPatches...)
+	}
+	return patches, nil
+}
 
-				str := strings.TrimSpace(v)
-				if strings.HasPrefix(str, "bitfusion") {
-					hasPrefix = true
-				}
+// updateBFContainer replaces the Bitfusion resources of a container by bitfusion.io/gpu and wraps its command
+// with "bitfusion run", path is the path of the container in the pod
+func updateBFContainer(target *corev1.Container, path string, mutation *mutationContext) (patches []patchOperation, e error) {
+	if !requestsBitfusion(target) {
+		// No patch for this container
+		return patches, nil
+	}
+	bfClientConfig, ok := mutation.clients[target.Name]
+	if !ok {
+		return patches, fmt.Errorf("No %s and %s annotation for the container ", guestOS, bfVersion)
+	}
 
-				command += " -- " + v
+	// Check bitFusionGPUResourceNum
+	gpuNum := target.Resources.Requests[bitFusionGPUResourceNum]
+	if gpuNum.Value() <= 0 {
+		return patches, fmt.Errorf("No gpu num was provided but found percent or memory ")
+	}
 
-			}
-			if !hasPrefix && injectionStatus != bitFusionOnlyInjection {
-				cmd := []string{"/bin/bash", "-c", command}
-				target.Command = cmd
-				patches = append(patches, patchOperation{
-					Op:    "replace",
-					Path:  basePath + "/" + strconv.Itoa(i) + "/command",
-					Value: cmd,
-				})
-			}
+	// Check bitFusionGPUResourcePartial and set fallback
+	gpuPartial := target.Resources.Requests[bitFusionGPUResourcePartial]
+	gpuMemory := target.Resources.Requests[bitFusionGPUResourceMemory]
+	if gpuPartial == zeroQuantity {
+		glog.Warning("No Partial was provide, use default value 100 which means 100%")
+		gpuPartial.Set(100)
+	}
+	delete(target.Resources.Requests, bitFusionGPUResourceNum)
+	delete(target.Resources.Limits, bitFusionGPUResourceNum)
+	delete(target.Resources.Requests, bitFusionGPUResourcePartial)
+	delete(target.Resources.Limits, bitFusionGPUResourcePartial)
 
-			// Construct quantity
-			gpuQuantity := &resource.Quantity{}
-			if gpuMemory != zeroQuantity {
-				rate := float64(gpuMemory.Value()/1000000) / float64(totalMem.Value())
-				glog.Infof("rate = %f", rate)
-				gpuQuantity.Set(int64(math.Ceil(rate * float64(gpuNum.Value()) * 100)))
-			} else {
-				gpuQuantity.Set(gpuPartialNum * gpuNum.Value())
-			}
-			target.Resources.Requests[bitFusionGPUResource] = *gpuQuantity
-			target.Resources.Limits[bitFusionGPUResource] = *gpuQuantity
+	gpuPartialNum := gpuPartial.Value()
 
-			// Create JSON patch to target containers
-			targets[i] = target
+	// Also return error if exceed 100% or equals 0%
+	if gpuPartialNum > 100 || gpuPartialNum <= 0 {
+		return patches, fmt.Errorf("Invalid %s quantity: %d ", bitFusionGPUResourcePartial, gpuPartialNum)
+	}
+	filter := ""
+	if value, has := containerAnnotation(mutation.annotations, admissionWebhookAnnotationFilterKey, target.Name); has {
+		for _, v := range strings.Fields(value) {
+			filter += " --filter " + v
+		}
+	}
+	var command string
+	var totalMem resource.Quantity
+	if gpuMemory != zeroQuantity {
+		totalMemStr := os.Getenv("TOTAL_GPU_MEMORY")
+		glog.Infof("totalMemStr = %s", totalMemStr)
+		totalMem, e = resource.ParseQuantity(totalMemStr)
+		if e != nil {
+			return patches, fmt.Errorf("Invalid TOTAL_GPU_MEMORY %q: %v ", totalMemStr, e)
+		}
+		glog.Infof("totalMem = %d", totalMem.Value())
+		glog.Infof("gpuMemory = %v", gpuMemory)
+		m, ok := gpuMemory.AsInt64()
+		if !ok {
+			glog.Error("gpuMemory.AsInt64 Error")
+			return patches, fmt.Errorf("gpuMemory.AsInt64 Error")
+		}
+		m = m / 1000000
+		glog.Infof("gpuMemory = %d", m)
+		if m <= 0 || m >= totalMem.Value() {
+			glog.Error("Memory value Error")
+			return patches, fmt.Errorf("Memory value Error ")
+		}
+		if filter != "" {
+			command = fmt.Sprintf(bfClientConfig.BinaryPath+" run -n %s -m %d  %s", gpuNum.String(), m, filter)
+		} else {
+			command = fmt.Sprintf(bfClientConfig.BinaryPath+" run -n %s -m %d", gpuNum.String(), m)
+		}
+		delete(target.Resources.Requests, bitFusionGPUResourceMemory)
+		delete(target.Resources.Limits, bitFusionGPUResourceMemory)
+	} else if filter != "" {
+		command = fmt.Sprintf(bfClientConfig.BinaryPath+" run -n %d -p %f %s", gpuNum.Value(), float64(gpuPartialNum)/100.0, filter)
+	} else {
+		command = fmt.Sprintf(bfClientConfig.BinaryPath+" run -n %d -p %f ", gpuNum.Value(), float64(gpuPartialNum)/100.0)
+	}
+	// The device plugin places the container on the Bitfusion servers of its devices with these arguments.
+	// A filter picks the servers itself, the servers of the devices may not pass it
+	if filter == "" {
+		command += " $" + bitFusionRunArgsEnv
+	}
+	glog.Infof("Command of %s : %s", target.Name, command)
+	glog.Infof("Request gpu with num %v", gpuNum.Value())
+	glog.Infof("Request gpu with partial %v", gpuPartial.Value())
 
+	argv, ok := effectiveCommand(target, mutation.images[target.Name])
+	if !ok && mutation.injectionMode != bitFusionOnlyInjection {
+		glog.Warningf("Container %s runs the command of its image which is unknown, it is not run with Bitfusion", target.Name)
+	}
+	hasPrefix := false
+	for _, v := range argv {
+		if strings.HasPrefix(strings.TrimSpace(v), "bitfusion") {
+			hasPrefix = true
+		}
+	}
+	if ok && !hasPrefix && mutation.injectionMode != bitFusionOnlyInjection {
+		command += " -- " + shellCommand(argv)
+		cmd := []string{"/bin/bash", "-c", command}
+		op := "replace"
+		if len(target.Command) == 0 {
+			op = "add"
+		}
+		patches = append(patches, patchOperation{
+			Op:    op,
+			Path:  path + "/command",
+			Value: cmd,
+		})
+		// The args are part of the command of bitfusion run
+		if len(target.Args) != 0 {
 			patches = append(patches, patchOperation{
-				Op:   "replace",
-				Path: basePath + "/" + strconv.Itoa(i) + "/resources",
-				Value: map[string]corev1.ResourceList{
-					"limits": target.Resources.Limits,
-				},
-			})
-			patches = append(patches, patchOperation{
-				Op:    "replace",
-				Path:  basePath + "/" + strconv.Itoa(i) + "/resources/requests",
-				Value: target.Resources.Requests,
+				Op:   "remove",
+				Path: path + "/args",
 			})
-			glog.Infof("Now patches === %v", patches)
+			target.Args = nil
 		}
+		target.Command = cmd
 	}
+
+	// Construct quantity
+	gpuQuantity := &resource.Quantity{}
+	if gpuMemory != zeroQuantity {
+		rate := float64(gpuMemory.Value()/1000000) / float64(totalMem.Value())
+		glog.Infof("rate = %f", rate)
+		gpuQuantity.Set(int64(math.Ceil(rate * float64(gpuNum.Value()) * 100)))
+	} else {
+		gpuQuantity.Set(gpuPartialNum * gpuNum.Value())
+	}
+	if target.Resources.Limits == nil {
+		target.Resources.Limits = corev1.ResourceList{}
+	}
+	target.Resources.Requests[bitFusionGPUResource] = *gpuQuantity
+	target.Resources.Limits[bitFusionGPUResource] = *gpuQuantity
+
+	// Create JSON patch to target containers
+	patches = append(patches, patchOperation{
+		Op:   "replace",
+		Path: path + "/resources",
+		Value: map[string]corev1.ResourceList{
+			"limits": target.Resources.Limits,
+		},
+	})
+	patches = append(patches, patchOperation{
+		Op:    "replace",
+		Path:  path + "/resources/requests",
+		Value: target.Resources.Requests,
+	})
+	glog.Infof("Now patches === %v", patches)
 	return patches, nil
 }
 
@@ -505,17 +748,13 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
 
 	// Determine whether to perform mutation based on annotation for the target resource
 	var required bool
-	injectionStatus = ""
 	if strings.ToLower(status) == "injected" {
 		required = false
 	} else {
 		switch strings.ToLower(annotations[admissionWebhookAnnotationInjectKey]) {
 		default:
 			required = false
-		case "y", "yes", "true", "on", "all":
-			required = true
-		case bitFusionOnlyInjection:
-			injectionStatus = bitFusionOnlyInjection
+		case "y", "yes", "true", "on", "all", bitFusionOnlyInjection:
 			required = true
 		}
 	}
@@ -524,6 +763,14 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
 	return required
 }
 
+// injectionMode returns bitFusionOnlyInjection if only the Bitfusion client is injected and the commands are kept
+func injectionMode(metadata *metav1.ObjectMeta) string {
+	if strings.ToLower(metadata.GetAnnotations()[admissionWebhookAnnotationInjectKey]) == bitFusionOnlyInjection {
+		return bitFusionOnlyInjection
+	}
+	return ""
+}
+
 func LoadConfig(configFile string) (*Config, error) {
 	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
@@ -7,14 +7,43 @@
 package webhook
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/ghodss/yaml"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmware/bitfusion-device-plugin/pkg/registry"
 	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"log"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// testImageResolver answers the image configs of the golden tests without a registry
+type testImageResolver map[string]*registry.ImageConfig
+
+func (r testImageResolver) ImageConfig(ctx context.Context, image string) (*registry.ImageConfig, error) {
+	if config, ok := r[image]; ok {
+		return config, nil
+	}
+	return nil, fmt.Errorf("image %s not found ", image)
+}
+
+var testImages = testImageResolver{
+	"nvcr.io/nvidia/tensorflow:19.07-py3": {Entrypoint: []string{"/usr/local/bin/nvidia_entrypoint.sh"}},
+	"nvcr.io/nvidia/pytorch:21.07-py3": {
+		Entrypoint: []string{"/opt/nvidia/nvidia_entrypoint.sh"},
+		Cmd:        []string{"jupyter", "lab", "--ip=0.0.0.0"},
+	},
+}
+
 func TestLoadConfig(t *testing.T) {
 	testCfg := Cfg.DeepCopy()
 	key := "sidecarconfig.yaml"
@@ -55,15 +84,58 @@ func TestAddContainer(t *testing.T) {
 	pod := StaticPod
 	bfClientConfig := BFClientConfig{"/bitfusion/bitfusion-client-centos7-2.5.0-10/usr/bin/bitfusion",
 		"/bitfusion/bitfusion-client-centos7-2.5.0-10/opt/bitfusion/2.5.0-fd3e4839/x86_64-linux-gnu/lib/:$LD_LIBRARY_PATH"}
-	patch := addContainer(pod.Spec.InitContainers, TestSidecarConfig.InitContainers, "/spec/initContainers", bfClientConfig)
+	opts := clientOpts(pod.Spec.Containers, &mutationContext{clientConfig: bfClientConfig})
+	patch := addContainer(pod.Spec.InitContainers, TestSidecarConfig.InitContainers, "/spec/initContainers", opts)
 	assert.Equal(t, len(patch), 1)
-	patch = addContainer(pod.Spec.Containers, TestSidecarConfig.Containers, "/spec/containers", bfClientConfig)
+	patch = addContainer(pod.Spec.Containers, TestSidecarConfig.Containers, "/spec/containers", opts)
 	assert.Equal(t, len(patch), 1)
 }
+
+func TestClientOpts(t *testing.T) {
+	ubuntu := TestClientMap["ubuntu18"]["450"]
+	centos := TestClientMap["centos7"]["450"]
+	gpu := corev1.ResourceRequirements{Requests: corev1.ResourceList{bitFusionGPUResourceNum: resource.MustParse("1")}}
+	containers := []corev1.Container{
+		{Name: "train", Resources: gpu},
+		{Name: "preprocess", Resources: gpu},
+		{Name: "serve", Resources: gpu},
+		{Name: "log"},
+	}
+	mutation := &mutationContext{
+		clientConfig: ubuntu,
+		clients:      map[string]BFClientConfig{"train": ubuntu, "preprocess": centos, "serve": centos, "log": centos},
+	}
+
+	// The containers of the same client share its copy of /opt/bitfusion
+	opts := clientOpts(containers, mutation)
+	if assert.Len(t, opts, 2) {
+		assert.Equal(t, optVolume, opts[0].volume)
+		assert.Equal(t, optVolume+"-1", opts[1].volume)
+		assert.Equal(t, optInitPath+"-1", opts[1].initPath)
+		assert.Equal(t, clientOptPath(centos), opts[1].source)
+	}
+	assert.Equal(t, optVolume+"-1", clientOptVolume(opts, centos))
+
+	// The init container copies every client into its own volume
+	patch := addContainer(nil, TestSidecarConfig.InitContainers, "/spec/initContainers", opts)
+	if assert.Len(t, patch, 1) {
+		init := patch[0].Value.([]corev1.Container)[0]
+		assert.Contains(t, init.Command[2], fmt.Sprintf("cp -r %s/* %s", clientOptPath(ubuntu), optInitPath))
+		assert.Contains(t, init.Command[2], fmt.Sprintf("cp -r %s/* %s-1", clientOptPath(centos), optInitPath))
+		assert.Contains(t, init.VolumeMounts, corev1.VolumeMount{Name: optVolume + "-1", MountPath: optInitPath + "-1"})
+	}
+
+	// A sidecar config without the opt volume can't hold several clients
+	config := TestSidecarConfig
+	config.Volumes = []corev1.Volume{{Name: "bitfusion-distro"}}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: containers}}
+	_, err := createPatch(pod, &config, mutation)
+	assert.NotNil(t, err)
+}
 func TestAddVolume(t *testing.T) {
 	pod := StaticPod
 	patch := addVolume(pod.Spec.Volumes, TestSidecarConfig.Volumes, "/spec/volumes")
-	assert.Equal(t, len(patch), 1)
+	assert.Equal(t, len(patch), len(TestSidecarConfig.Volumes))
 }
 
 func TestUpdateAnnotation(t *testing.T) {
@@ -79,23 +151,168 @@ func TestUpdateAnnotation(t *testing.T) {
 }
 
 func TestCreatePatch(t *testing.T) {
-	pod := StaticPod
+	pod := StaticPod.DeepCopy()
 	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
 	bfClientConfig := BFClientConfig{"/bitfusion/bitfusion-client-centos7-2.5.0-10/usr/bin/bitfusion",
 		"/bitfusion/bitfusion-client-centos7-2.5.0-10/opt/bitfusion/2.5.0-fd3e4839/x86_64-linux-gnu/lib/:$LD_LIBRARY_PATH"}
-	bytes, err := createPatch(&pod, &TestSidecarConfig, annotations, bfClientConfig)
+	mutation := &mutationContext{
+		clientConfig: bfClientConfig,
+		clients:      map[string]BFClientConfig{pod.Spec.Containers[0].Name: bfClientConfig},
+		annotations:  annotations,
+	}
+	bytes, err := createPatch(pod, &TestSidecarConfig, mutation)
 	fmt.Print(bytes)
 	assert.Equal(t, err, nil)
-	mpod := StaticMemPod
-	bytes, err = createPatch(&mpod, &TestSidecarConfig, annotations, bfClientConfig)
+	mpod := StaticMemPod.DeepCopy()
+	mutation.clients = map[string]BFClientConfig{mpod.Spec.Containers[0].Name: bfClientConfig}
+	bytes, err = createPatch(mpod, &TestSidecarConfig, mutation)
 	fmt.Print(bytes)
 	assert.Equal(t, err, nil)
 
 }
 
+// TestCreatePatchGolden applies the patch of every pod in testdata and compares the mutated pod with its .golden file
+func TestCreatePatchGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.yaml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No pod in testdata: %v", err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		podJSON, err := yaml.YAMLToJSON(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pod corev1.Pod
+		if err := json.Unmarshal(podJSON, &pod); err != nil {
+			t.Fatal(err)
+		}
+
+		mutation, err := newMutationContext(&pod, TestClientMap)
+		if !assert.Nil(t, err, file) || !assert.NotNil(t, mutation, file) {
+			continue
+		}
+		resolveImageCommands(context.Background(), &pod, mutation, testImages)
+		patchBytes, err := createPatch(&pod, &TestSidecarConfig, mutation)
+		if !assert.Nil(t, err, file) {
+			continue
+		}
+		patch, err := jsonpatch.DecodePatch(patchBytes)
+		if !assert.Nil(t, err, file) {
+			continue
+		}
+		mutated, err := patch.Apply(podJSON)
+		if !assert.Nil(t, err, file) {
+			continue
+		}
+		got, err := yaml.JSONToYAML(mutated)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		golden := strings.TrimSuffix(file, ".yaml") + ".golden"
+		if *update {
+			if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("Can't read %s, run the test with -update to write it: %v", golden, err)
+		}
+		assert.Equal(t, string(want), string(got), file)
+	}
+}
+
+func TestNewMutationContext(t *testing.T) {
+	newPod := func(annotations map[string]string) *corev1.Pod {
+		pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "train"}, {Name: "preprocess"}}}}
+		pod.Annotations = annotations
+		return pod
+	}
+	ubuntu := TestClientMap["ubuntu18"]["450"]
+	centos := TestClientMap["centos7"]["450"]
+
+	// The container annotations override the pod-level ones
+	mutation, err := newMutationContext(newPod(map[string]string{
+		guestOS:                             "ubuntu18",
+		bfVersion:                           "450",
+		guestOS + ".preprocess":             "centos7",
+		admissionWebhookAnnotationInjectKey: bitFusionOnlyInjection,
+	}), TestClientMap)
+	if assert.Nil(t, err) && assert.NotNil(t, mutation) {
+		assert.Equal(t, ubuntu, mutation.clientConfig)
+		assert.Equal(t, map[string]BFClientConfig{"train": ubuntu, "preprocess": centos}, mutation.clients)
+		assert.Equal(t, bitFusionOnlyInjection, mutation.injectionMode)
+	}
+
+	// A client named only for a container
+	mutation, err = newMutationContext(newPod(map[string]string{
+		guestOS + ".preprocess":   "centos7",
+		bfVersion + ".preprocess": "450",
+	}), TestClientMap)
+	if assert.Nil(t, err) && assert.NotNil(t, mutation) {
+		assert.Equal(t, centos, mutation.clientConfig)
+		assert.Equal(t, map[string]BFClientConfig{"preprocess": centos}, mutation.clients)
+	}
+
+	// No client at all, or an unknown one
+	mutation, err = newMutationContext(newPod(nil), TestClientMap)
+	assert.Nil(t, err)
+	assert.Nil(t, mutation)
+	_, err = newMutationContext(newPod(map[string]string{guestOS: "ubuntu18", bfVersion: "450", bfVersion + ".train": "401"}), TestClientMap)
+	assert.NotNil(t, err)
+
+	value, has := containerAnnotation(map[string]string{admissionWebhookAnnotationFilterKey: "a", admissionWebhookAnnotationFilterKey + ".train": ""},
+		admissionWebhookAnnotationFilterKey, "train")
+	assert.True(t, has)
+	assert.Equal(t, "", value)
+}
+
 func TestMutationRequired(t *testing.T) {
 	pod := StaticPod
 	res := mutationRequired(ignoredNamespaces, &pod.ObjectMeta)
 	assert.Equal(t, res, true)
 	mutationRequired([]string{"injection"}, &pod.ObjectMeta)
 }
+
+func TestEffectiveCommand(t *testing.T) {
+	image := &registry.ImageConfig{Entrypoint: []string{"/entrypoint.sh"}, Cmd: []string{"python", "serve.py"}}
+	tests := []struct {
+		container corev1.Container
+		image     *registry.ImageConfig
+		argv      []string
+		ok        bool
+	}{
+		{corev1.Container{Command: []string{"python"}, Args: []string{"train.py"}}, nil, []string{"python", "train.py"}, true},
+		{corev1.Container{Command: []string{"python"}, Args: []string{"train.py"}}, image, []string{"python", "train.py"}, true},
+		{corev1.Container{Args: []string{"train.py"}}, image, []string{"/entrypoint.sh", "train.py"}, true},
+		{corev1.Container{}, image, []string{"/entrypoint.sh", "python", "serve.py"}, true},
+		{corev1.Container{Args: []string{"train.py"}}, nil, nil, false},
+		{corev1.Container{}, &registry.ImageConfig{}, nil, false},
+	}
+	for i, test := range tests {
+		argv, ok := effectiveCommand(&test.container, test.image)
+		assert.Equal(t, test.ok, ok, i)
+		if test.ok {
+			assert.Equal(t, test.argv, argv, i)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	tests := map[string][]string{
+		"python /benchmark/train.py":               {"python /benchmark/train.py"},
+		"python train.py && echo done":             {"/bin/bash", "-c", "python train.py && echo done"},
+		"echo $HOME":                               {"bash", "-c", "echo $HOME"},
+		"python train.py --model=inception3":       {"python", "train.py", "--model=inception3"},
+		`echo 'inception v3' '$HOME' 'it'\''s' ''`: {"echo", "inception v3", "$HOME", "it's", ""},
+		"/bin/sh -c 'python train.py'":             {"/bin/sh", "-c", "python train.py"},
+	}
+	for want, argv := range tests {
+		assert.Equal(t, want, shellCommand(argv), argv)
+	}
+}
@@ -7,18 +7,20 @@
 package webhook
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/golang/glog"
-	"io/ioutil"
-	"k8s.io/api/admission/v1beta1"
-	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	"github.com/vmware/bitfusion-device-plugin/pkg/admissionreview"
+	"github.com/vmware/bitfusion-device-plugin/pkg/registry"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"net/http"
+	"time"
 )
 
 // Bitfusion client binary path and environment variables value of LD_LIBRARY_PATH
@@ -47,9 +49,6 @@ var (
 
 	defaulter    = runtime.ObjectDefaulter(runtimeScheme)
 	zeroQuantity = resource.Quantity{}
-
-	injectionStatus    = ""
-	BitfusionClientMap *map[string]map[string]BFClientConfig
 )
 
 var ignoredNamespaces = []string{
@@ -58,6 +57,7 @@ var ignoredNamespaces = []string{
 }
 
 const (
+	// The bitfusion-client annotations apply to every container, suffixed with .<container name> to one container
 	guestOS                             = "bitfusion-client/os"
 	bfVersion                           = "bitfusion-client/version"
 	admissionWebhookAnnotationFilterKey = "bitfusion-client/filter"
@@ -69,14 +69,44 @@ const (
 	bitFusionGPUResourceMemory  = "bitfusion.io/gpu-memory"
 	bitFusionGPUResourcePartial = "bitfusion.io/gpu-percent"
 	bitFusionOnlyInjection      = "injection"
+	// optVolume is the volume of the sidecar config the init container copies /opt/bitfusion of the client into,
+	// mounted at optInitPath in the init container
+	optVolume   = "bitfusion-opt"
+	optInitPath = "/workload-container-opt"
+	// bitFusionRunArgsEnv is set by the device plugin to the "bitfusion run" arguments of the allocated devices
+	bitFusionRunArgsEnv = "BITFUSION_RUN_ARGS"
+	// imageLookupTimeout bounds the registry requests of one admission request, below the webhook timeout
+	imageLookupTimeout = 3 * time.Second
 )
 
+// ImageResolver looks up the default command of a container image
+type ImageResolver interface {
+	ImageConfig(ctx context.Context, image string) (*registry.ImageConfig, error)
+}
+
 // WebhookServer struct
 type WebhookServer struct {
 	SidecarConfig *Config
+	// BitfusionClientMap is the Bitfusion client of each OS and Bitfusion version
+	BitfusionClientMap map[string]map[string]BFClientConfig
+	// ImageResolver looks up the command of the containers which run the default command of their image, nil disables it
+	ImageResolver ImageResolver
 	Server        *http.Server
 }
 
+// mutationContext carries the settings of one admission request through the mutation of its pod
+type mutationContext struct {
+	// injectionMode is bitFusionOnlyInjection if the commands of the containers are kept
+	injectionMode string
+	// clientConfig is the pod-level client or the first of a container, its /opt/bitfusion is copied to the opt volume
+	clientConfig BFClientConfig
+	// clients are the Bitfusion clients of the containers by container name
+	clients map[string]BFClientConfig
+	// images are the configs of the images of the containers without a command by container name
+	images      map[string]*registry.ImageConfig
+	annotations map[string]string
+}
+
 // Webhook Server parameters
 type WhSvrParameters struct {
 	Port                  int    // webhook server port
@@ -84,6 +114,7 @@ type WhSvrParameters struct {
 	KeyFile               string // path to the x509 private key matching `CertFile`
 	SidecarCfgFile        string // path to sidecar injector configuration file
 	BitfusionClientConfig string // path to Bitfusion client configuration file
+	ResolveImageCommand   bool   // look up the command of images in their registry
 }
 
 // Config struct
@@ -102,7 +133,7 @@ type patchOperation struct {
 
 func init() {
 	_ = corev1.AddToScheme(runtimeScheme)
-	_ = admissionregistrationv1beta1.AddToScheme(runtimeScheme)
+	_ = admissionregistrationv1.AddToScheme(runtimeScheme)
 	_ = corev1.AddToScheme(runtimeScheme)
 }
 
@@ -115,66 +146,15 @@ func applyDefaultsWorkaround(containers []corev1.Container, volumes []corev1.Vol
 	})
 }
 
-// Serve method for webhook server
+// Serve method for webhook server, it answers AdmissionReviews of admission.k8s.io/v1 and v1beta1
 func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
-		}
-	}
-	if len(body) == 0 {
-		glog.Error("Empty body")
-		http.Error(w, "Empty body", http.StatusBadRequest)
-		return
-	}
-
-	// Verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		glog.Errorf("Content-Type=%s, expect application/json", contentType)
-		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
-		return
-	}
-
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
-	} else {
-		admissionResponse = whsvr.mutate(&ar)
-	}
-
-	admissionReview := v1beta1.AdmissionReview{}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
-		}
-	}
-
-	resp, err := json.Marshal(admissionReview)
-	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
-	}
-	glog.Infof("Ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
-		glog.Errorf("Can't write response: %v", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
-	}
+	admissionreview.Serve(w, r, whsvr.mutate)
 }
 
 // mutate is main mutation process
-func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
+func (whsvr *WebhookServer) mutate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
 	var pod corev1.Pod
-	response := &v1beta1.AdmissionResponse{}
+	response := &admissionv1.AdmissionResponse{}
 
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		glog.Errorf("Could not unmarshal raw object: %v", err)
@@ -193,45 +173,42 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admissi
 	}
 
 	// If user did not specify the GuestOS annotation, webhook will do nothing with the container
-	os := getGuestOS(&pod.ObjectMeta)
-	bfVersion := getBfVersion(&pod.ObjectMeta)
-	clientMap := *BitfusionClientMap
-	if os == "" || bfVersion == "" {
+	mutation, err := newMutationContext(&pod, whsvr.BitfusionClientMap)
+	if err != nil {
+		glog.Errorf("Could not find Bitfusion client info: %v", err)
+		response.Result = &metav1.Status{Message: "Could not find Bitfusion client info: " + err.Error()}
+		return response
+	}
+	if mutation == nil {
 		response.Allowed = true
 		return response
-	} else {
-		if _, ok := clientMap[os][bfVersion]; !ok {
-			glog.Errorf("Could not find Bitfusion client info, OS=%v BFVersion=%v", os, bfVersion)
-			response.Result = &metav1.Status{Message: "Could not find Bitfusion client info"}
-			return response
-		}
 	}
-
-	applyDefaultsWorkaround(whsvr.SidecarConfig.Containers, whsvr.SidecarConfig.Volumes)
-	//annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
-	// Adding support for the filter parameter requires obtaining the metadata content
-	metadata := &pod.ObjectMeta
-	annotations := metadata.GetAnnotations()
-	if annotations == nil {
-		annotations = map[string]string{}
+	if whsvr.ImageResolver != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), imageLookupTimeout)
+		resolveImageCommands(ctx, &pod, mutation, whsvr.ImageResolver)
+		cancel()
 	}
 
-	patchBytes, err := createPatch(&pod, whsvr.SidecarConfig, annotations, clientMap[os][bfVersion])
+	applyDefaultsWorkaround(whsvr.SidecarConfig.Containers, whsvr.SidecarConfig.Volumes)
+	patchBytes, err := createPatch(&pod, whsvr.SidecarConfig, mutation)
 	if err != nil {
 		response.Result = &metav1.Status{Message: err.Error()}
 		return response
 	}
 
-	if err = copySecret(&req.Namespace); err != nil {
-		glog.Errorf("Can't copy secret: %v", err)
-		response.Result = &metav1.Status{Message: err.Error()}
-		return response
+	// The secret is copied only when the pod is created, the webhook has no side effects on dry run
+	if req.DryRun == nil || !*req.DryRun {
+		if err = copySecret(&req.Namespace); err != nil {
+			glog.Errorf("Can't copy secret: %v", err)
+			response.Result = &metav1.Status{Message: err.Error()}
+			return response
+		}
 	}
 
 	response.Allowed = true
 	response.Patch = patchBytes
-	response.PatchType = func() *v1beta1.PatchType {
-		pt := v1beta1.PatchTypeJSONPatch
+	response.PatchType = func() *admissionv1.PatchType {
+		pt := admissionv1.PatchTypeJSONPatch
 		return &pt
 	}()
 
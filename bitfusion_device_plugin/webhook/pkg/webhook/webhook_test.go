@@ -9,18 +9,21 @@ package webhook
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"reflect"
 
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/ghodss/yaml"
 	"github.com/stretchr/testify/assert"
 
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -32,7 +35,7 @@ var PodPath = "../../../example/pod.yaml"
 var MemPodPath = "../../../example/pod-memory.yaml"
 var StaticPod corev1.Pod
 var StaticMemPod corev1.Pod
-var CfgPath = "../../deployment/bitfusion_injector_webhook_configmap.yaml"
+var CfgPath = "../../deployment/bitfusion-injector-webhook-configmap.yaml"
 var Cfg corev1.ConfigMap
 
 //var vfcfgstr = `initContainers:
@@ -55,9 +58,27 @@ initContainers:
       cp /root/.bitfusion/client.yaml /client &&
       cp -r BITFUSION_CLIENT_OPT_PATH /workload-container-opt
       "]
+  volumeMounts:
+  - name: bitfusion-opt
+    mountPath: /workload-container-opt
+containers:
+- name: sidecar-container
+  image: container
+  command: [/bin/bash, -c, "ls BITFUSION_CLIENT_OPT_PATH"]
+  volumeMounts:
+  - name: bitfusion-distro
+    mountPath: /bitfusion
+  - name: bitfusion-opt
+    mountPath: /opt/bitfusion
+volumes:
+- name: bitfusion-distro
+  emptyDir: {}
+- name: bitfusion-opt
+  emptyDir: {}
 `
 
 var TestSidecarConfig Config
+var TestClientMap map[string]map[string]BFClientConfig
 
 func init() {
 	if err := json.Unmarshal(conver(PodPath), &StaticPod); err != nil {
@@ -76,6 +97,15 @@ func init() {
 	StaticMemPod.Spec.Containers[0].Resources.Requests = StaticMemPod.Spec.Containers[0].Resources.Limits
 	StaticPod.Spec.Containers[0].Resources.Requests = StaticPod.Spec.Containers[0].Resources.Limits
 
+	// GPU memory size of the Bitfusion servers in MB, set in the webhook deployment
+	os.Setenv("TOTAL_GPU_MEMORY", "16000")
+	TestClientMap = map[string]map[string]BFClientConfig{
+		"ubuntu18": {"450": BFClientConfig{"/bitfusion/bitfusion-client-ubuntu1804_4.5.0-4_amd64.deb/usr/bin/bitfusion",
+			"/bitfusion/bitfusion-client-ubuntu1804_4.5.0-4_amd64.deb/opt/bitfusion/lib/x86_64-linux-gnu/bitfusion/lib/"}},
+		"centos7": {"450": BFClientConfig{"/bitfusion/bitfusion-client-centos7-4.5.0-4.x86_64.rpm/usr/bin/bitfusion",
+			"/bitfusion/bitfusion-client-centos7-4.5.0-4.x86_64.rpm/opt/bitfusion/lib/x86_64-linux-gnu/bitfusion/lib/"}},
+	}
+
 }
 
 func conver(path string) []byte {
@@ -94,30 +124,27 @@ func conver(path string) []byte {
 }
 
 func TestWebhookServer_Mutate(t *testing.T) {
-	ar := v1beta1.AdmissionReview{
-		Request: &v1beta1.AdmissionRequest{
-			Object: runtime.RawExtension{
-				Raw: conver(PodPath),
-			},
+	req := admissionv1.AdmissionRequest{
+		Object: runtime.RawExtension{
+			Raw: conver(PodPath),
 		},
 	}
 	mutatingWebhookSv := &WebhookServer{
-		SidecarConfig: &TestSidecarConfig,
+		SidecarConfig:      &TestSidecarConfig,
+		BitfusionClientMap: TestClientMap,
 		Server: &http.Server{
 			Addr: "8888",
 			//TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
 		},
 	}
-	admissionResponse := mutatingWebhookSv.mutate(&ar)
+	admissionResponse := mutatingWebhookSv.mutate(&req)
 	t.Log(admissionResponse)
-	ar = v1beta1.AdmissionReview{
-		Request: &v1beta1.AdmissionRequest{
-			Object: runtime.RawExtension{
-				Raw: []byte(""),
-			},
+	req = admissionv1.AdmissionRequest{
+		Object: runtime.RawExtension{
+			Raw: []byte(""),
 		},
 	}
-	admissionResponse = mutatingWebhookSv.mutate(&ar)
+	admissionResponse = mutatingWebhookSv.mutate(&req)
 	t.Log(admissionResponse)
 }
 
@@ -137,7 +164,8 @@ func (r *responseWriter) WriteHeader(statusCode int) {}
 
 func TestWebhookServer_Serve(t *testing.T) {
 	mutatingWebhookSv := &WebhookServer{
-		SidecarConfig: &TestSidecarConfig,
+		SidecarConfig:      &TestSidecarConfig,
+		BitfusionClientMap: TestClientMap,
 		Server: &http.Server{
 			Addr: "8888",
 			//TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
@@ -179,6 +207,99 @@ func TestWebhookServer_Serve(t *testing.T) {
 	f.Close()
 }
 
+// serveReview sends the pod to the webhook in an AdmissionReview of apiVersion on dry run, the secret isn't copied
+// and the pod is mutated without a cluster. It returns the apiVersion and the response of the answer
+func serveReview(t *testing.T, whsvr *WebhookServer, apiVersion string, pod *corev1.Pod) (string, *admissionv1.AdmissionResponse) {
+	dryRun := true
+	raw, _ := json.Marshal(pod)
+	body, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       "AdmissionReview",
+		"request": admissionv1.AdmissionRequest{
+			UID:       "705ab4f5-6393-11e8-b7cc-42010a800002",
+			Namespace: "default",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+			DryRun:    &dryRun,
+		},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	whsvr.Serve(rec, req)
+
+	var review struct {
+		APIVersion string                         `json:"apiVersion"`
+		Kind       string                         `json:"kind"`
+		Response   *admissionv1.AdmissionResponse `json:"response"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Error(err)
+		return "", nil
+	}
+	assert.Equal(t, "AdmissionReview", review.Kind)
+	return review.APIVersion, review.Response
+}
+
+func TestWebhookServer_ServeVersions(t *testing.T) {
+	mutatingWebhookSv := &WebhookServer{SidecarConfig: &TestSidecarConfig, BitfusionClientMap: TestClientMap}
+	// The requests are defaulted to the limits before the webhook is called
+	var pod corev1.Pod
+	if err := json.Unmarshal(conver(PodPath), &pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Spec.Containers[0].Resources.Requests = pod.Spec.Containers[0].Resources.Limits
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		version, response := serveReview(t, mutatingWebhookSv, apiVersion, &pod)
+		assert.Equal(t, apiVersion, version)
+		if assert.NotNil(t, response, apiVersion) {
+			assert.Equal(t, "705ab4f5-6393-11e8-b7cc-42010a800002", string(response.UID))
+			assert.True(t, response.Allowed, apiVersion)
+			if assert.NotNil(t, response.PatchType) {
+				assert.Equal(t, admissionv1.PatchTypeJSONPatch, *response.PatchType)
+			}
+			assert.NotEmpty(t, response.Patch)
+		}
+	}
+}
+
+func TestWebhookServer_ServeConcurrent(t *testing.T) {
+	mutatingWebhookSv := &WebhookServer{SidecarConfig: &TestSidecarConfig, BitfusionClientMap: TestClientMap}
+	var pod corev1.Pod
+	if err := json.Unmarshal(conver(PodPath), &pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Spec.Containers[0].Resources.Requests = pod.Spec.Containers[0].Resources.Limits
+
+	// The mode of one pod must not leak into the mutation of another one
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		modePod := pod.DeepCopy()
+		if i%2 == 1 {
+			modePod.Annotations[admissionWebhookAnnotationInjectKey] = bitFusionOnlyInjection
+		}
+		wg.Add(1)
+		go func(pod *corev1.Pod) {
+			defer wg.Done()
+			_, response := serveReview(t, mutatingWebhookSv, "admission.k8s.io/v1", pod)
+			if !assert.NotNil(t, response) || !assert.True(t, response.Allowed) {
+				return
+			}
+			var patches []patchOperation
+			assert.Nil(t, json.Unmarshal(response.Patch, &patches))
+			wrapped := false
+			for _, patch := range patches {
+				if strings.HasSuffix(patch.Path, "/command") {
+					wrapped = true
+				}
+			}
+			injectionOnly := pod.Annotations[admissionWebhookAnnotationInjectKey] == bitFusionOnlyInjection
+			assert.Equal(t, !injectionOnly, wrapped, pod.Annotations[admissionWebhookAnnotationInjectKey])
+		}(modePod)
+	}
+	wg.Wait()
+}
+
 func TestUpdateBFResource(t *testing.T) {
 	testPod := StaticPod.DeepCopy()
 
@@ -199,7 +320,11 @@ func TestUpdateBFResource(t *testing.T) {
 	}
 	bfClientConfig := BFClientConfig{"/bitfusion/bitfusion-client-centos7-2.5.0-10/usr/bin/bitfusion",
 		"/bitfusion/bitfusion-client-centos7-2.5.0-10/opt/bitfusion/2.5.0-fd3e4839/x86_64-linux-gnu/lib/:$LD_LIBRARY_PATH"}
-	patchs, err := updateBFResource(testPod.Spec.Containers, "spec/containers", bfClientConfig)
+	patchs, err := updateBFResource(testPod.Spec.Containers, "spec/containers", &mutationContext{
+		clientConfig: bfClientConfig,
+		clients:      map[string]BFClientConfig{testPod.Spec.Containers[0].Name: bfClientConfig},
+		annotations:  testPod.Annotations,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -221,7 +346,11 @@ func TestUpdateBFResource(t *testing.T) {
 	p := testPod.Spec.Containers[0].Resources.Requests[bitFusionGPUResourcePartial]
 	p.Set(101)
 	testPod.Spec.Containers[0].Resources.Requests[bitFusionGPUResourcePartial] = p
-	_, err = updateBFResource(testPod.Spec.Containers, "spec/containers", bfClientConfig)
+	_, err = updateBFResource(testPod.Spec.Containers, "spec/containers", &mutationContext{
+		clientConfig: bfClientConfig,
+		clients:      map[string]BFClientConfig{testPod.Spec.Containers[0].Name: bfClientConfig},
+		annotations:  testPod.Annotations,
+	})
 	t.Log(err)
 
 }
@@ -234,12 +363,12 @@ func TestConstructBitfusionDistroMap(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		want    *map[interface{}]interface{}
+		want    *BitfusionClientDistro
 		wantErr bool
 	}{
 		// TODO: Add test cases.
 		{name: "1", args: args{configFile: "./bitfusion-client-configmap.yaml"},
-			want: nil, wantErr: false},
+			want: nil, wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {